@@ -0,0 +1,69 @@
+package rediscache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/nakabonne/pbgopy/cache"
+)
+
+// Cache acts a cache stored on a Redis server.
+// Values are encoded with encoding/gob, so types other than the basic ones have to be registered with gob.Register.
+type Cache struct {
+	client *Client
+	prefix string
+	ttl    time.Duration
+}
+
+// NewCache gives back a cache whose keys are prefixed with the given prefix.
+// Entries expire after the given ttl using the native key expiry of the server; give 0 to disable it.
+func NewCache(client *Client, prefix string, ttl time.Duration) *Cache {
+	return &Cache{
+		client: client,
+		prefix: prefix,
+		ttl:    ttl,
+	}
+}
+
+func (c *Cache) Get(key interface{}) (interface{}, error) {
+	reply, err := c.client.Do("GET", c.key(key))
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, cache.ErrNotFound
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply type %T", reply)
+	}
+	var value interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value); err != nil {
+		return nil, fmt.Errorf("failed to decode the cached value: %w", err)
+	}
+	return value, nil
+}
+
+func (c *Cache) Put(key interface{}, value interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&value); err != nil {
+		return fmt.Errorf("failed to encode the value: %w", err)
+	}
+	args := []interface{}{"SET", c.key(key), buf.Bytes()}
+	if c.ttl > 0 {
+		args = append(args, "PX", c.ttl.Milliseconds())
+	}
+	_, err := c.client.Do(args...)
+	return err
+}
+
+func (c *Cache) Delete(key interface{}) error {
+	_, err := c.client.Do("DEL", c.key(key))
+	return err
+}
+
+func (c *Cache) key(key interface{}) string {
+	return c.prefix + fmt.Sprint(key)
+}
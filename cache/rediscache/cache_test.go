@@ -0,0 +1,170 @@
+package rediscache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nakabonne/pbgopy/cache"
+	"github.com/nakabonne/pbgopy/cache/rediscache/redistest"
+)
+
+func TestCache(t *testing.T) {
+	s, err := redistest.NewServer()
+	require.NoError(t, err)
+	defer s.Close()
+	client, err := NewClient(s.URL())
+	require.NoError(t, err)
+	defer client.Close()
+
+	c := NewCache(client, "pbgopy:", 0)
+	err = c.Put("bytes", []byte("value-1"))
+	require.NoError(t, err)
+	err = c.Put("int", int64(42))
+	require.NoError(t, err)
+
+	value, err := c.Get("bytes")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value-1"), value)
+	value, err = c.Get("int")
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), value)
+	assert.Equal(t, []string{"pbgopy:bytes", "pbgopy:int"}, s.Keys())
+
+	err = c.Delete("bytes")
+	require.NoError(t, err)
+	value, err = c.Get("bytes")
+	assert.Equal(t, cache.ErrNotFound, err)
+	assert.Equal(t, nil, value)
+}
+
+func TestCacheTTL(t *testing.T) {
+	s, err := redistest.NewServer()
+	require.NoError(t, err)
+	defer s.Close()
+	client, err := NewClient(s.URL())
+	require.NoError(t, err)
+	defer client.Close()
+
+	c := NewCache(client, "", time.Minute)
+	err = c.Put("key-1", "value-1")
+	require.NoError(t, err)
+	assert.True(t, s.TTL("key-1") > 0)
+
+	s.FastForward(2 * time.Minute)
+	value, err := c.Get("key-1")
+	assert.Equal(t, cache.ErrNotFound, err)
+	assert.Equal(t, nil, value)
+}
+
+func TestClientAuthAndTransaction(t *testing.T) {
+	s, err := redistest.NewServerWithPassword("secret")
+	require.NoError(t, err)
+	defer s.Close()
+
+	client, err := NewClient("redis://" + s.Addr())
+	require.NoError(t, err)
+	_, err = client.Do("GET", "key")
+	assert.Equal(t, Error("NOAUTH Authentication required."), err)
+
+	client, err = NewClient(s.URL() + "/1")
+	require.NoError(t, err)
+	defer client.Close()
+
+	conn, err := client.Conn()
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Do("WATCH", "key")
+	require.NoError(t, err)
+	// Another client modifies the watched key.
+	_, err = client.Do("SET", "key", "other")
+	require.NoError(t, err)
+	_, err = conn.Do("MULTI")
+	require.NoError(t, err)
+	_, err = conn.Do("SET", "key", "mine")
+	require.NoError(t, err)
+	reply, err := conn.Do("EXEC")
+	require.NoError(t, err)
+	assert.Nil(t, reply)
+
+	value, err := client.Do("GET", "key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("other"), value)
+}
+
+func TestClientIOTimeout(t *testing.T) {
+	// A server that accepts connections but never replies.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client, err := NewClient("redis://" + l.Addr().String() + "?io_timeout=50ms")
+	require.NoError(t, err)
+	defer client.Close()
+	start := time.Now()
+	_, err = client.Do("PING")
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr), err)
+	assert.True(t, netErr.Timeout())
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	for _, rawURL := range []string{"redis://localhost?io_timeout=soon", "redis://localhost?io_timeout=-1s", "redis://localhost?dial_timeout=0s"} {
+		_, err := NewClient(rawURL)
+		assert.Error(t, err, rawURL)
+	}
+}
+
+func TestClientIOTimeoutLargeValue(t *testing.T) {
+	value := bytes.Repeat([]byte("a"), 16<<20)
+	command := fmt.Sprintf("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$%d\r\n%s\r\n", len(value), value)
+
+	// A server on a slow link, which takes far longer than the io timeout to receive the value but never stalls.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	received := make(chan int, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 256<<10)
+		n := 0
+		for n < len(command) {
+			m, err := conn.Read(buf)
+			n += m
+			if err != nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		received <- n
+		conn.Write([]byte("+OK\r\n"))
+	}()
+
+	client, err := NewClient("redis://" + l.Addr().String() + "?io_timeout=200ms")
+	require.NoError(t, err)
+	defer client.Close()
+	start := time.Now()
+	reply, err := client.Do("SET", "key", Stream{Reader: bytes.NewReader(value), Size: int64(len(value))})
+	require.NoError(t, err)
+	assert.Equal(t, "OK", reply)
+	assert.Equal(t, len(command), <-received)
+	assert.True(t, time.Since(start) > 200*time.Millisecond, "the value has been received too fast to test the timeout")
+}
@@ -0,0 +1,360 @@
+// Package rediscache provides a cache.Cache backed by a server
+// speaking the Redis protocol, so that multiple pbgopy servers can share their state.
+package rediscache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPort        = "6379"
+	defaultDialTimeout = 5 * time.Second
+	defaultIOTimeout   = 30 * time.Second
+	maxIdleConns       = 8
+	// maxWriteSize is the most written to a connection under a single deadline.
+	maxWriteSize = 64 << 10
+)
+
+// Error is an error reply sent by the server.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// Client is a minimal client of the Redis protocol (RESP2) with a pool of connections.
+// It is safe for concurrent use by multiple goroutines.
+type Client struct {
+	addr        string
+	password    string
+	db          int
+	dialTimeout time.Duration
+	// ioTimeout is how long a read or a write on a connection may stall. Zero means no limit.
+	ioTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   []*Conn
+	closed bool
+}
+
+// NewClient gives back a client for the given URL such as "redis://:password@host:6379/0".
+// The dial_timeout and io_timeout query parameters, e.g. "?dial_timeout=1s&io_timeout=10s", change how long
+// connecting may take and how long sending a command or reading its reply may stall, which are 5s and 30s by default.
+// An io_timeout of 0 means no limit.
+// Connections are established lazily.
+func NewClient(rawURL string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse redis url: %w", err)
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported redis url scheme %q", u.Scheme)
+	}
+	c := &Client{
+		addr:        u.Host,
+		dialTimeout: defaultDialTimeout,
+		ioTimeout:   defaultIOTimeout,
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	query := u.Query()
+	if s := query.Get("dial_timeout"); s != "" {
+		if c.dialTimeout, err = time.ParseDuration(s); err != nil || c.dialTimeout <= 0 {
+			return nil, fmt.Errorf("invalid redis dial_timeout %q", s)
+		}
+	}
+	if s := query.Get("io_timeout"); s != "" {
+		if c.ioTimeout, err = time.ParseDuration(s); err != nil || c.ioTimeout < 0 {
+			return nil, fmt.Errorf("invalid redis io_timeout %q", s)
+		}
+	}
+	return c, nil
+}
+
+// Do issues a command on a pooled connection.
+// Replies are given back as string, int64, []byte, []interface{} or nil.
+func (c *Client) Do(args ...interface{}) (interface{}, error) {
+	conn, err := c.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Do(args...)
+}
+
+// Conn takes a dedicated connection out of the pool.
+// It is needed for commands that rely on connection state like WATCH and MULTI.
+// The caller must Close it to put it back.
+func (c *Client) Conn() (*Conn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errors.New("redis client is closed")
+	}
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, nil
+	}
+	c.mu.Unlock()
+	return c.dial()
+}
+
+// Close closes all idle connections. Connections in use are closed when they are given back.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, conn := range c.idle {
+		conn.netConn.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+func (c *Client) dial() (*Conn, error) {
+	nc, err := net.DialTimeout("tcp", c.addr, c.dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	tc := &timeoutConn{Conn: nc, timeout: c.ioTimeout}
+	conn := &Conn{
+		client:  c,
+		netConn: nc,
+		r:       bufio.NewReader(tc),
+		w:       bufio.NewWriter(tc),
+	}
+	if c.password != "" {
+		if _, err := conn.Do("AUTH", c.password); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("failed to authenticate to redis: %w", err)
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.Do("SELECT", c.db); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("failed to select redis database: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *Client) put(conn *Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.idle) >= maxIdleConns {
+		conn.netConn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// Conn is a single connection to the server.
+type Conn struct {
+	client  *Client
+	netConn net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	// broken is set once the connection has fallen into an unknown state.
+	broken bool
+}
+
+// Do issues a command and reads its reply. An error reply is given back as Error.
+// A connection stalled for longer than the io timeout of the client is left broken.
+func (c *Conn) Do(args ...interface{}) (interface{}, error) {
+	if err := writeCommand(c.w, args); err != nil {
+		c.broken = true
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		c.broken = true
+		return nil, err
+	}
+	reply, err := readReply(c.r)
+	if err != nil {
+		var redisErr Error
+		if !errors.As(err, &redisErr) {
+			c.broken = true
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Close gives the connection back to the pool, or closes it if it is broken.
+func (c *Conn) Close() error {
+	if c.broken {
+		return c.netConn.Close()
+	}
+	c.client.put(c)
+	return nil
+}
+
+// timeoutConn gives each read and write its own deadline, so that a command taking long as a whole,
+// such as one sending a large value over a slow link, fails only if the connection stops making progress.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	if c.timeout > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(p)
+}
+
+// Write writes p in pieces of up to maxWriteSize bytes, each with its own deadline.
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		piece := p
+		if len(piece) > maxWriteSize {
+			piece = piece[:maxWriteSize]
+		}
+		if c.timeout > 0 {
+			if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+				return written, err
+			}
+		}
+		n, err := c.Conn.Write(piece)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Stream is a command argument read from Reader, which must yield exactly Size bytes.
+// It lets a large value be sent without holding it in memory.
+type Stream struct {
+	Reader io.Reader
+	Size   int64
+}
+
+func writeCommand(w *bufio.Writer, args []interface{}) error {
+	if _, err := fmt.Fprintf(w, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		var b []byte
+		switch a := arg.(type) {
+		case Stream:
+			if _, err := fmt.Fprintf(w, "$%d\r\n", a.Size); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, a.Reader, a.Size); err != nil {
+				return fmt.Errorf("failed to stream argument: %w", err)
+			}
+			if _, err := w.WriteString("\r\n"); err != nil {
+				return err
+			}
+			continue
+		case []byte:
+			b = a
+		case string:
+			b = []byte(a)
+		case int:
+			b = strconv.AppendInt(nil, int64(a), 10)
+		case int64:
+			b = strconv.AppendInt(nil, a, 10)
+		default:
+			return fmt.Errorf("unsupported argument type %T", arg)
+		}
+		if _, err := fmt.Fprintf(w, "$%d\r\n", len(b)); err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed array length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		// Errors of the elements are kept in the array, as EXEC replies do.
+		values := make([]interface{}, n)
+		for i := range values {
+			v, err := readReply(r)
+			var redisErr Error
+			switch {
+			case errors.As(err, &redisErr):
+				values[i] = redisErr
+			case err != nil:
+				return nil, err
+			default:
+				values[i] = v
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unknown redis reply type %q", line[0])
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
@@ -0,0 +1,607 @@
+// Package redistest provides an in-process fake server speaking the Redis protocol, for use in tests.
+// Only the commands pbgopy relies on are implemented.
+package redistest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type item struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// Server is a fake Redis server listening on a local port.
+type Server struct {
+	// password is required by AUTH if set.
+	password string
+
+	ln       net.Listener
+	mu       sync.Mutex
+	data     map[string]*item
+	versions map[string]uint64
+	offset   time.Duration
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+
+	// calls counts the commands issued by their names and first arguments.
+	calls map[[2]string]int
+}
+
+// NewServer starts a fake server. The caller should Close it when finished.
+func NewServer() (*Server, error) {
+	return NewServerWithPassword("")
+}
+
+// NewServerWithPassword starts a fake server that requires clients to AUTH with the given password.
+func NewServerWithPassword(password string) (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		password: password,
+		ln:       ln,
+		data:     make(map[string]*item),
+		versions: make(map[string]uint64),
+		calls:    make(map[[2]string]int),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr gives back the address the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// URL gives back the URL to connect to the server.
+func (s *Server) URL() string {
+	if s.password != "" {
+		return "redis://:" + s.password + "@" + s.Addr()
+	}
+	return "redis://" + s.Addr()
+}
+
+// Close shuts down the server and closes all connections.
+func (s *Server) Close() {
+	s.ln.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// FastForward moves the clock of the server forward, which makes keys expire.
+func (s *Server) FastForward(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset += d
+}
+
+// Keys gives back the sorted keys that haven't expired.
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		if s.lookupLocked(k) != nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Calls gives back how many times the command of the given name has been issued on the given key.
+func (s *Server) Calls(name, key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[[2]string{strings.ToUpper(name), key}]
+}
+
+// TTL gives back the remaining time to live of the key; 0 means it has no expiry or doesn't exist.
+func (s *Server) TTL(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it := s.lookupLocked(key)
+	if it == nil || it.expiresAt.IsZero() {
+		return 0
+	}
+	return it.expiresAt.Sub(s.nowLocked())
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+// session is the per-connection state.
+type session struct {
+	authed  bool
+	watched map[string]uint64
+	multi   bool
+	queued  [][]string
+	// aborted is set when a queued command was malformed, making EXEC fail.
+	aborted bool
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	sess := &session{authed: s.password == ""}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		s.dispatch(w, sess, args)
+		if err := w.Flush(); err != nil {
+			return
+		}
+		if strings.ToUpper(args[0]) == "QUIT" {
+			return
+		}
+	}
+}
+
+func (s *Server) dispatch(w *bufio.Writer, sess *session, args []string) {
+	name := strings.ToUpper(args[0])
+	if len(args) > 1 {
+		s.mu.Lock()
+		s.calls[[2]string{name, args[1]}]++
+		s.mu.Unlock()
+	}
+	if name == "AUTH" {
+		if len(args) != 2 || args[1] != s.password {
+			writeError(w, "WRONGPASS invalid password")
+			return
+		}
+		sess.authed = true
+		writeSimple(w, "OK")
+		return
+	}
+	if !sess.authed {
+		writeError(w, "NOAUTH Authentication required.")
+		return
+	}
+
+	switch name {
+	case "MULTI":
+		if sess.multi {
+			writeError(w, "ERR MULTI calls can not be nested")
+			return
+		}
+		sess.multi = true
+		writeSimple(w, "OK")
+		return
+	case "DISCARD":
+		if !sess.multi {
+			writeError(w, "ERR DISCARD without MULTI")
+			return
+		}
+		sess.reset()
+		writeSimple(w, "OK")
+		return
+	case "EXEC":
+		if !sess.multi {
+			writeError(w, "ERR EXEC without MULTI")
+			return
+		}
+		s.exec(w, sess)
+		return
+	case "WATCH":
+		if sess.multi {
+			writeError(w, "ERR WATCH inside MULTI is not allowed")
+			return
+		}
+		s.mu.Lock()
+		if sess.watched == nil {
+			sess.watched = make(map[string]uint64)
+		}
+		for _, key := range args[1:] {
+			s.lookupLocked(key)
+			sess.watched[key] = s.versions[key]
+		}
+		s.mu.Unlock()
+		writeSimple(w, "OK")
+		return
+	case "UNWATCH":
+		sess.watched = nil
+		writeSimple(w, "OK")
+		return
+	}
+
+	if sess.multi {
+		if _, ok := commands[name]; !ok {
+			sess.aborted = true
+			writeError(w, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+			return
+		}
+		sess.queued = append(sess.queued, args)
+		writeSimple(w, "QUEUED")
+		return
+	}
+
+	s.mu.Lock()
+	reply := s.runLocked(args)
+	s.mu.Unlock()
+	writeReply(w, reply)
+}
+
+func (s *Server) exec(w *bufio.Writer, sess *session) {
+	defer sess.reset()
+	if sess.aborted {
+		writeError(w, "EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, version := range sess.watched {
+		s.lookupLocked(key)
+		if s.versions[key] != version {
+			w.WriteString("*-1\r\n")
+			return
+		}
+	}
+	replies := make([]interface{}, 0, len(sess.queued))
+	for _, args := range sess.queued {
+		replies = append(replies, s.runLocked(args))
+	}
+	writeReply(w, replies)
+}
+
+func (sess *session) reset() {
+	sess.multi = false
+	sess.queued = nil
+	sess.aborted = false
+	sess.watched = nil
+}
+
+type errorReply string
+
+type commandFunc func(s *Server, args []string) interface{}
+
+var commands = map[string]commandFunc{
+	"PING":     cmdPing,
+	"SELECT":   func(*Server, []string) interface{} { return "OK" },
+	"GET":      cmdGet,
+	"SET":      cmdSet,
+	"GETRANGE": cmdGetRange,
+	"STRLEN":   cmdStrlen,
+	"DEL":      cmdDel,
+	"EXISTS":   cmdExists,
+	"PEXPIRE":  cmdPexpire,
+	"PERSIST":  cmdPersist,
+	"PTTL":     cmdPttl,
+	"KEYS":     cmdKeys,
+	"FLUSHDB":  cmdFlushDB,
+	"QUIT":     func(*Server, []string) interface{} { return "OK" },
+}
+
+func (s *Server) runLocked(args []string) interface{} {
+	cmd, ok := commands[strings.ToUpper(args[0])]
+	if !ok {
+		return errorReply(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	return cmd(s, args[1:])
+}
+
+func cmdPing(_ *Server, args []string) interface{} {
+	if len(args) > 0 {
+		return []byte(args[0])
+	}
+	return "PONG"
+}
+
+func cmdGet(s *Server, args []string) interface{} {
+	if len(args) != 1 {
+		return wrongArgs("get")
+	}
+	it := s.lookupLocked(args[0])
+	if it == nil {
+		return nil
+	}
+	return it.value
+}
+
+func cmdGetRange(s *Server, args []string) interface{} {
+	if len(args) != 3 {
+		return wrongArgs("getrange")
+	}
+	start, err1 := strconv.ParseInt(args[1], 10, 64)
+	end, err2 := strconv.ParseInt(args[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return errorReply("ERR value is not an integer or out of range")
+	}
+	it := s.lookupLocked(args[0])
+	if it == nil {
+		return []byte{}
+	}
+	n := int64(len(it.value))
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= n {
+		end = n - 1
+	}
+	if start > end {
+		return []byte{}
+	}
+	return it.value[start : end+1]
+}
+
+func cmdStrlen(s *Server, args []string) interface{} {
+	if len(args) != 1 {
+		return wrongArgs("strlen")
+	}
+	it := s.lookupLocked(args[0])
+	if it == nil {
+		return int64(0)
+	}
+	return int64(len(it.value))
+}
+
+func cmdSet(s *Server, args []string) interface{} {
+	if len(args) < 2 {
+		return wrongArgs("set")
+	}
+	key, value := args[0], args[1]
+	var expiresAt time.Time
+	var nx, xx bool
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "PX", "EX":
+			if i+1 >= len(args) {
+				return errorReply("ERR syntax error")
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return errorReply("ERR invalid expire time in 'set' command")
+			}
+			unit := time.Millisecond
+			if strings.ToUpper(args[i]) == "EX" {
+				unit = time.Second
+			}
+			expiresAt = s.nowLocked().Add(time.Duration(n) * unit)
+			i++
+		default:
+			return errorReply("ERR syntax error")
+		}
+	}
+	exists := s.lookupLocked(key) != nil
+	if (nx && exists) || (xx && !exists) {
+		return nil
+	}
+	s.data[key] = &item{value: []byte(value), expiresAt: expiresAt}
+	s.versions[key]++
+	return "OK"
+}
+
+func cmdDel(s *Server, args []string) interface{} {
+	var n int64
+	for _, key := range args {
+		if s.lookupLocked(key) != nil {
+			delete(s.data, key)
+			s.versions[key]++
+			n++
+		}
+	}
+	return n
+}
+
+func cmdExists(s *Server, args []string) interface{} {
+	var n int64
+	for _, key := range args {
+		if s.lookupLocked(key) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func cmdPexpire(s *Server, args []string) interface{} {
+	if len(args) != 2 {
+		return wrongArgs("pexpire")
+	}
+	ms, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errorReply("ERR value is not an integer or out of range")
+	}
+	it := s.lookupLocked(args[0])
+	if it == nil {
+		return int64(0)
+	}
+	it.expiresAt = s.nowLocked().Add(time.Duration(ms) * time.Millisecond)
+	s.versions[args[0]]++
+	return int64(1)
+}
+
+func cmdPersist(s *Server, args []string) interface{} {
+	if len(args) != 1 {
+		return wrongArgs("persist")
+	}
+	it := s.lookupLocked(args[0])
+	if it == nil || it.expiresAt.IsZero() {
+		return int64(0)
+	}
+	it.expiresAt = time.Time{}
+	s.versions[args[0]]++
+	return int64(1)
+}
+
+func cmdPttl(s *Server, args []string) interface{} {
+	if len(args) != 1 {
+		return wrongArgs("pttl")
+	}
+	it := s.lookupLocked(args[0])
+	switch {
+	case it == nil:
+		return int64(-2)
+	case it.expiresAt.IsZero():
+		return int64(-1)
+	default:
+		return it.expiresAt.Sub(s.nowLocked()).Milliseconds()
+	}
+}
+
+func cmdKeys(s *Server, args []string) interface{} {
+	if len(args) != 1 {
+		return wrongArgs("keys")
+	}
+	keys := make([]interface{}, 0)
+	for key := range s.data {
+		if s.lookupLocked(key) == nil {
+			continue
+		}
+		if ok, _ := path.Match(args[0], key); ok {
+			keys = append(keys, []byte(key))
+		}
+	}
+	return keys
+}
+
+func cmdFlushDB(s *Server, _ []string) interface{} {
+	for key := range s.data {
+		delete(s.data, key)
+		s.versions[key]++
+	}
+	return "OK"
+}
+
+func wrongArgs(name string) errorReply {
+	return errorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+}
+
+// lookupLocked gives back the live item of the key, evicting it if it has expired.
+func (s *Server) lookupLocked(key string) *item {
+	it, ok := s.data[key]
+	if !ok {
+		return nil
+	}
+	if !it.expiresAt.IsZero() && !it.expiresAt.After(s.nowLocked()) {
+		delete(s.data, key)
+		s.versions[key]++
+		return nil
+	}
+	return it
+}
+
+func (s *Server) nowLocked() time.Time {
+	return time.Now().Add(s.offset)
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		// Inline command.
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, errors.New("malformed command")
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		header = strings.TrimRight(header, "\r\n")
+		if !strings.HasPrefix(header, "$") {
+			return nil, errors.New("malformed command")
+		}
+		size, err := strconv.Atoi(header[1:])
+		if err != nil || size < 0 {
+			return nil, errors.New("malformed command")
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args = append(args, string(b[:size]))
+	}
+	return args, nil
+}
+
+func writeSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func writeError(w *bufio.Writer, s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case string:
+		writeSimple(w, v)
+	case errorReply:
+		writeError(w, string(v))
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n", len(v))
+		w.Write(v)
+		w.WriteString("\r\n")
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(w, e)
+		}
+	default:
+		writeError(w, fmt.Sprintf("ERR unsupported reply %T", reply))
+	}
+}
@@ -0,0 +1,260 @@
+package commands
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// archiveMIME is the MIME type of the data copied from files and directories.
+const archiveMIME = "application/x-tar"
+
+// errArchiveTooLarge is returned when the archive being made exceeds the size limit.
+var errArchiveTooLarge = errors.New("archive exceeds the size limit")
+
+// limitedWriter writes to w until n bytes are written, and fails after that.
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, errArchiveTooLarge
+	}
+	n, err := l.w.Write(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// writeArchive writes the given files and directories to w as a tar archive.
+// Each of them is put at the top of the archive under its base name, keeping the names and modes of what's inside.
+// Symbolic links inside them are archived as links, and other special files are skipped with a warning to stderr.
+func writeArchive(w io.Writer, paths []string, stderr io.Writer) error {
+	tw := tar.NewWriter(w)
+	names := make(map[string]string, len(paths))
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", p, err)
+		}
+		base := filepath.Base(abs)
+		if base == string(filepath.Separator) {
+			return fmt.Errorf("can't copy the root directory")
+		}
+		if other, ok := names[base]; ok {
+			return fmt.Errorf("both %s and %s would be named %s in the archive", other, p, base)
+		}
+		names[base] = p
+
+		// A symbolic link given as an argument is archived as what it points to, under its own name,
+		// since its target, often absolute, wouldn't be extracted.
+		root, err := filepath.EvalSymlinks(abs)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", p, err)
+		}
+		if filepath.Dir(root) == root {
+			return fmt.Errorf("can't copy the root directory")
+		}
+		err = filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			return addToArchive(tw, file, path.Join(base, filepath.ToSlash(rel)), info, stderr)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to archive %s: %w", p, err)
+		}
+	}
+	return tw.Close()
+}
+
+func addToArchive(tw *tar.Writer, file, name string, info os.FileInfo, stderr io.Writer) error {
+	var link string
+	switch mode := info.Mode(); {
+	case mode.IsRegular(), mode.IsDir():
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(file)
+		if err != nil {
+			return err
+		}
+		link = target
+	default:
+		fmt.Fprintf(stderr, "Skipped %s, which is neither a regular file, a directory nor a symbolic link\n", file)
+		return nil
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	// Owners don't carry over to another machine.
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// extractArchive extracts the tar archive read from r into dir, which is created if it doesn't exist.
+// Entries that would end up outside of dir, either by their names or through symbolic links, are refused.
+func extractArchive(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	// Directories are given their modes at the end, so that read-only ones can still be filled.
+	type dirMode struct {
+		path string
+		mode os.FileMode
+	}
+	var dirs []dirMode
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the archive: %w", err)
+		}
+		name, err := archiveEntryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := checkNoSymlink(dir, name); err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirMode{path: target, mode: mode})
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			if err := extractFile(tr, target, mode); err != nil {
+				return err
+			}
+			if err := os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if !symlinkStaysInside(name, hdr.Linkname) {
+				return fmt.Errorf("refused to extract %s: the link to %s points outside of the destination", hdr.Name, hdr.Linkname)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("refused to extract %s: unsupported type %q", hdr.Name, hdr.Typeflag)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractFile(r io.Reader, target string, mode os.FileMode) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// The mode given to OpenFile is masked by umask, and isn't applied to existing files.
+	return os.Chmod(target, mode)
+}
+
+// archiveEntryName gives back the cleaned name of an archive entry, refusing the ones that would end up outside of the destination.
+func archiveEntryName(name string) (string, error) {
+	cleaned := path.Clean(strings.TrimSuffix(name, "/"))
+	if name == "" || path.IsAbs(name) || filepath.IsAbs(filepath.FromSlash(name)) || cleaned == "." ||
+		cleaned == ".." || strings.HasPrefix(cleaned, "../") || strings.Contains(name, `\`) {
+		return "", fmt.Errorf("refused to extract %q: the path points outside of the destination", name)
+	}
+	return cleaned, nil
+}
+
+// checkNoSymlink makes sure that none of the existing components of name under dir is a symbolic link,
+// so that nothing is written through a link extracted earlier.
+func checkNoSymlink(dir, name string) error {
+	current := dir
+	for _, c := range strings.Split(name, "/") {
+		current = filepath.Join(current, c)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refused to extract %s: %s is a symbolic link", name, current)
+		}
+	}
+	return nil
+}
+
+// symlinkStaysInside reports whether the target of the link at name is relative and stays inside of the destination.
+// A target may go up only at its start, since the directories it goes down through may be links
+// extracted before or after it, from which going up would lead elsewhere.
+func symlinkStaysInside(name, target string) bool {
+	if target == "" || path.IsAbs(target) || filepath.IsAbs(filepath.FromSlash(target)) || strings.Contains(target, `\`) {
+		return false
+	}
+	// How deep the directory of the link is in the destination.
+	depth := strings.Count(name, "/")
+	down := false
+	for _, c := range strings.Split(target, "/") {
+		switch c {
+		case "", ".":
+		case "..":
+			if down || depth == 0 {
+				return false
+			}
+			depth--
+		default:
+			down = true
+		}
+	}
+	return true
+}
@@ -0,0 +1,205 @@
+package commands
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCopyAndExtractArchive(t *testing.T) {
+	handler := newHistoryTestHandler(3, 0)
+	t.Setenv(pbgopyServerEnv, "http://pbgopy.test/")
+
+	src := t.TempDir()
+	project := filepath.Join(src, "project")
+	writeTestFile(t, filepath.Join(project, "main.go"), "package main\n", 0o644)
+	writeTestFile(t, filepath.Join(project, "bin", "run.sh"), "#!/bin/sh\n", 0o755)
+	if err := os.Symlink("bin/run.sh", filepath.Join(project, "run")); err != nil {
+		t.Fatal(err)
+	}
+	notes := filepath.Join(src, "notes.txt")
+	writeTestFile(t, notes, "notes", 0o600)
+
+	c := &copyRunner{
+		password:   "secret",
+		maxBufSize: "500mb",
+		stderr:     &bytes.Buffer{},
+		client:     newHandlerClient(handler),
+	}
+	if err := c.run(nil, []string{project, notes}); err != nil {
+		t.Fatal(err)
+	}
+	if entry := getHistory(t, handler)[0]; entry.Kind != historyKindEncrypted || entry.MIME != archiveMIME {
+		t.Fatalf("archive entry: %+v", entry)
+	}
+
+	dest := filepath.Join(t.TempDir(), "dest")
+	p := &pasteRunner{
+		password:   "secret",
+		maxBufSize: "500mb",
+		extract:    dest,
+		stdout:     &bytes.Buffer{},
+		client:     newHandlerClient(handler),
+	}
+	if err := p.run(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]struct {
+		data string
+		mode os.FileMode
+	}{
+		"project/main.go":    {"package main\n", 0o644},
+		"project/bin/run.sh": {"#!/bin/sh\n", 0o755},
+		"notes.txt":          {"notes", 0o600},
+	} {
+		file := filepath.Join(dest, filepath.FromSlash(name))
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want.data || info.Mode().Perm() != want.mode {
+			t.Fatalf("%s: got %q %v want %q %v", name, data, info.Mode().Perm(), want.data, want.mode)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "project", "run")); err != nil || target != "bin/run.sh" {
+		t.Fatalf("symbolic link: got %q, %v", target, err)
+	}
+
+	// The size limit applies to the archive.
+	c.maxBufSize = "1kb"
+	writeTestFile(t, filepath.Join(project, "large"), strings.Repeat("a", 2048), 0o644)
+	if err := c.run(nil, []string{project}); err == nil || !strings.Contains(err.Error(), "exceeds set limit") {
+		t.Fatalf("copying a large directory: got %v", err)
+	}
+}
+
+func TestCopySymlinkArguments(t *testing.T) {
+	handler := newHistoryTestHandler(3, 0)
+	t.Setenv(pbgopyServerEnv, "http://pbgopy.test/")
+
+	src := t.TempDir()
+	project := filepath.Join(src, "project")
+	writeTestFile(t, filepath.Join(project, "main.go"), "package main\n", 0o644)
+	writeTestFile(t, filepath.Join(src, "notes.txt"), "notes", 0o644)
+	links := t.TempDir()
+	// Links given as arguments are often absolute, which wouldn't be extracted as links.
+	for name, target := range map[string]string{"current": project, "todo.txt": filepath.Join(src, "notes.txt")} {
+		if err := os.Symlink(target, filepath.Join(links, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &copyRunner{maxBufSize: "500mb", stderr: &bytes.Buffer{}, client: newHandlerClient(handler)}
+	if err := c.run(nil, []string{filepath.Join(links, "current"), filepath.Join(links, "todo.txt")}); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "dest")
+	p := &pasteRunner{maxBufSize: "500mb", extract: dest, stdout: &bytes.Buffer{}, client: newHandlerClient(handler)}
+	if err := p.run(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"current/main.go": "package main\n", "todo.txt": "notes"} {
+		file := filepath.Join(dest, filepath.FromSlash(name))
+		info, err := os.Lstat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := os.ReadFile(file); !info.Mode().IsRegular() || string(data) != want {
+			t.Fatalf("%s: mode %v data %q want %q", name, info.Mode(), data, want)
+		}
+	}
+}
+
+func TestExtractArchiveRefusesPathTraversal(t *testing.T) {
+	tests := map[string][]tar.Header{
+		"parent directory": {{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0o644}},
+		"nested parent":    {{Name: "a/../../evil", Typeflag: tar.TypeReg, Mode: 0o644}},
+		"absolute path":    {{Name: "/tmp/evil", Typeflag: tar.TypeReg, Mode: 0o644}},
+		"absolute link":    {{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"}},
+		"escaping link":    {{Name: "a/link", Typeflag: tar.TypeSymlink, Linkname: "../../etc"}},
+		"write through link": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "sub"},
+			{Name: "link/evil", Typeflag: tar.TypeReg, Mode: 0o644},
+		},
+		"link through a link": {
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "x/x/x/.."},
+		},
+		"link through a later link": {
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "x/x/x/.."},
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "."},
+		},
+		"hard link": {{Name: "hard", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"}},
+	}
+	for name, headers := range tests {
+		var b bytes.Buffer
+		tw := tar.NewWriter(&b)
+		for _, hdr := range headers {
+			hdr := hdr
+			hdr.ModTime = time.Now()
+			if err := tw.WriteHeader(&hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		root := t.TempDir()
+		dest := filepath.Join(root, "dest")
+		if err := os.MkdirAll(filepath.Join(dest, "sub"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := extractArchive(&b, dest); err == nil {
+			t.Fatalf("%s: extracted", name)
+		}
+		if _, err := os.Lstat(filepath.Join(root, "evil")); !os.IsNotExist(err) {
+			t.Fatalf("%s: written outside of the destination", name)
+		}
+	}
+}
+
+func TestSymlinkStaysInside(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		want   bool
+	}{
+		{name: "run", target: "bin/run.sh", want: true},
+		{name: "a/b/link", target: "../../c", want: true},
+		{name: "a/link", target: "./b/./c", want: true},
+		{name: "x", target: ".", want: true},
+		{name: "a/link", target: "../../etc", want: false},
+		{name: "link", target: "..", want: false},
+		{name: "a/link", target: "b/../c", want: false},
+		{name: "l", target: "x/x/x/..", want: false},
+		{name: "link", target: "/etc", want: false},
+		{name: "link", target: "", want: false},
+	}
+	for _, tt := range tests {
+		if got := symlinkStaysInside(tt.name, tt.target); got != tt.want {
+			t.Errorf("symlinkStaysInside(%q, %q): got %v want %v", tt.name, tt.target, got, tt.want)
+		}
+	}
+}
+
+func writeTestFile(t *testing.T, name, data string, mode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(data), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(name, mode); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,266 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	channelPathPrefix = "/c/"
+
+	// historyChannelsDir is where the histories of named channels are persisted, under the data directory.
+	historyChannelsDir = "channels"
+
+	// defaultMaxChannels is the default maximum number of named channels.
+	defaultMaxChannels = 1000
+)
+
+var (
+	// errChannelNotFound is given back for a channel that doesn't exist and isn't asked to be created.
+	errChannelNotFound = errors.New("channel not found")
+	// errTooManyChannels is given back for a channel that can't be created since there are already as many as allowed.
+	errTooManyChannels = errors.New("too many channels")
+)
+
+var channelNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// validChannelName reports whether the given name can be used as a channel,
+// which is also safe to use as a path element and a part of a Redis key.
+func validChannelName(name string) bool {
+	return channelNamePattern.MatchString(name)
+}
+
+// channelURL gives back the base URL of the given channel on the server at address.
+// The default channel is given by an empty name.
+func channelURL(address, name string) string {
+	if name == "" {
+		return address
+	}
+	return strings.TrimRight(address, "/") + channelPathPrefix + url.PathEscape(name)
+}
+
+// channel is a clipboard with its own history. The default channel has an empty name.
+type channel struct {
+	name    string
+	history HistoryBackend
+	// spoolDir is where uploads to the channel are temporarily written to.
+	spoolDir string
+
+	events  *eventHub
+	uploads *uploadSessions
+
+	// mu guards updated, which is closed when an entry is added to the channel.
+	mu      sync.Mutex
+	updated chan struct{}
+}
+
+func newChannel(name string, history HistoryBackend, spoolDir string) *channel {
+	c := &channel{
+		name:     name,
+		history:  history,
+		spoolDir: spoolDir,
+		events:   newEventHub(),
+		uploads:  newUploadSessions(),
+	}
+	history.Observe(func(ev HistoryEvent) {
+		c.events.publish(ev)
+		if ev.Type == historyEventAdded {
+			c.notify()
+		}
+	})
+	return c
+}
+
+func (c *channel) lastUpdatedKey() string {
+	if c.name == "" {
+		return lastUpdatedCacheKey
+	}
+	return lastUpdatedCacheKey + ":" + c.name
+}
+
+// channelSet holds the channels of a server. Named channels are opened on first use.
+type channelSet struct {
+	mu       sync.Mutex
+	channels map[string]*channel
+	// open opens the named channel. It gives back errChannelNotFound if the channel doesn't exist yet, unless create is true.
+	open func(name string, create bool) (*channel, error)
+	// max is the maximum number of named channels that can be created. Zero means unlimited.
+	max int
+}
+
+func newChannelSet(defaultChannel *channel, open func(name string, create bool) (*channel, error), max int) *channelSet {
+	return &channelSet{
+		channels: map[string]*channel{"": defaultChannel},
+		open:     open,
+		max:      max,
+	}
+}
+
+// get gives back the named channel. A channel that doesn't exist yet is created only if create is true,
+// and errChannelNotFound is given back otherwise.
+func (s *channelSet) get(name string, create bool) (*channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.channels[name]; ok {
+		return c, nil
+	}
+	c, err := s.open(name, false)
+	if errors.Is(err, errChannelNotFound) && create {
+		// The default channel doesn't count.
+		if s.max > 0 && len(s.channels)-1 >= s.max {
+			return nil, errTooManyChannels
+		}
+		c, err = s.open(name, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.channels[name] = c
+	return c, nil
+}
+
+// all gives back the channels opened so far.
+func (s *channelSet) all() []*channel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channels := make([]*channel, 0, len(s.channels))
+	for _, c := range s.channels {
+		channels = append(channels, c)
+	}
+	return channels
+}
+
+type channelContextKey struct{}
+
+// channelOf gives back the channel the request is addressed to.
+func (r *serveRunner) channelOf(req *http.Request) *channel {
+	if c, ok := req.Context().Value(channelContextKey{}).(*channel); ok {
+		return c
+	}
+	c, _ := r.channels.get("", false)
+	return c
+}
+
+// handleChannel serves the requests under /c/<name> with the same routes as the default channel.
+// A channel is created by the first request to write to it, so that reading doesn't leave channels behind.
+func (r *serveRunner) handleChannel(w http.ResponseWriter, req *http.Request) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, channelPathPrefix), "/")
+	if !validChannelName(name) {
+		http.Error(w, "The channel name is invalid", http.StatusBadRequest)
+		return
+	}
+	c, err := r.channels.get(name, requiredScope(req) != tokenScopeRead)
+	if errors.Is(err, errChannelNotFound) {
+		http.Error(w, "The channel not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errTooManyChannels) {
+		http.Error(w, fmt.Sprintf("The channel can't be created beyond the limit of %d channels", r.maxChannels), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open channel: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	req = req.WithContext(context.WithValue(req.Context(), channelContextKey{}, c))
+	u := *req.URL
+	u.Path = "/" + rest
+	u.RawPath = ""
+	req.URL = &u
+	r.routes.ServeHTTP(w, req)
+}
+
+// openChannel opens a named channel on the same kind of storage as the default one, with its own retention policy.
+// Unless create is true, it gives back errChannelNotFound for a channel of which nothing is stored
+// and for which no policy is configured.
+func (r *serveRunner) openChannel(name string, create bool) (*channel, error) {
+	create = create || r.channelConfigured(name)
+	policy := r.channelHistoryPolicy(name)
+	switch {
+	case r.redisClient != nil:
+		prefix := redisKeyPrefix + historyChannelsDir + ":" + name + ":history:"
+		history := newRedisHistoryStore(r.redisClient, prefix, policy)
+		if !create {
+			// The channel can have been created through another server sharing the Redis server.
+			entries, err := history.List()
+			if err != nil {
+				return nil, err
+			}
+			if len(entries) == 0 {
+				return nil, errChannelNotFound
+			}
+		}
+		return newChannel(name, history, r.spoolDir), nil
+	case r.dataDir != "":
+		dir := filepath.Join(r.dataDir, historyChannelsDir, name)
+		if _, err := os.Stat(dir); !create && errors.Is(err, os.ErrNotExist) {
+			return nil, errChannelNotFound
+		}
+		history, err := openHistoryStore(dir, policy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the history in %s: %w", dir, err)
+		}
+		return newChannel(name, history, filepath.Join(dir, historyTmpDir)), nil
+	default:
+		if !create {
+			return nil, errChannelNotFound
+		}
+		return newChannel(name, newHistoryStore(policy), r.spoolDir), nil
+	}
+}
+
+// channelConfigured reports whether a retention policy of its own is configured for the named channel.
+func (r *serveRunner) channelConfigured(name string) bool {
+	_, ttl := r.channelTTLs[name]
+	_, limit := r.channelHistoryLimits[name]
+	return ttl || limit
+}
+
+// channelHistoryPolicy gives back the retention policy of the named channel, which is that of the default channel
+// except for what is configured for it.
+func (r *serveRunner) channelHistoryPolicy(name string) historyPolicy {
+	policy := r.historyPolicy()
+	if ttl, ok := r.channelTTLs[name]; ok {
+		policy.ttl = ttl
+	}
+	if limit, ok := r.channelHistoryLimits[name]; ok {
+		policy.limit = limit
+	}
+	return policy
+}
+
+// parseChannelPolicies parses the per-channel TTLs and history limits given by the flags.
+func (r *serveRunner) parseChannelPolicies() error {
+	r.channelTTLs = make(map[string]time.Duration, len(r.channelTTLFlag))
+	for name, s := range r.channelTTLFlag {
+		if !validChannelName(name) {
+			return fmt.Errorf("invalid channel name %q in channel-ttl", name)
+		}
+		ttl, err := time.ParseDuration(s)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("invalid TTL %q of channel %q", s, name)
+		}
+		r.channelTTLs[name] = ttl
+	}
+	for name, limit := range r.channelHistoryLimits {
+		if !validChannelName(name) {
+			return fmt.Errorf("invalid channel name %q in channel-history-limit", name)
+		}
+		if limit < 0 {
+			return fmt.Errorf("history limit of channel %q must be greater than or equal to 0", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nakabonne/pbgopy/cache/memorycache"
+)
+
+func TestChannelsHaveIndependentHistories(t *testing.T) {
+	handler := newHistoryTestHandler(3, 0)
+	putClipboard(t, handler, []byte("default"), false)
+	rr := serveHistoryRequest(t, handler, http.MethodPut, "/c/team", []byte("team"))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("PUT /c/team status: got %d want %d", rr.Code, http.StatusOK)
+	}
+
+	for path, want := range map[string]string{"/": "default", "/c/team": "team", "/c/team/": "team"} {
+		rr := serveHistoryRequest(t, handler, http.MethodGet, path, nil)
+		if rr.Code != http.StatusOK || rr.Body.String() != want {
+			t.Fatalf("GET %s: status %d body %q want %q", path, rr.Code, rr.Body.String(), want)
+		}
+	}
+	if entries := getHistory(t, handler); len(entries) != 1 || entries[0].Preview != "default" {
+		t.Fatalf("default history: %+v", entries)
+	}
+	rr = serveHistoryRequest(t, handler, http.MethodGet, "/c/team"+historyPath, nil)
+	var entries []HistoryEntry
+	if err := json.Unmarshal(rr.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Preview != "team" {
+		t.Fatalf("team history: %+v", entries)
+	}
+	rr = serveHistoryRequest(t, handler, http.MethodGet, "/c/team"+historyPath+"/"+entries[0].ID, nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != "team" {
+		t.Fatalf("GET team entry: status %d body %q", rr.Code, rr.Body.String())
+	}
+	// Entries can't be reached through another channel.
+	rr = serveHistoryRequest(t, handler, http.MethodGet, historyPath+"/"+entries[0].ID, nil)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("GET team entry through the default channel: got %d want %d", rr.Code, http.StatusNotFound)
+	}
+
+	if rr := serveHistoryRequest(t, handler, http.MethodGet, "/c/team"+lastUpdatedPath, nil); rr.Code != http.StatusOK {
+		t.Fatalf("GET /c/team/lastupdated: got %d want %d", rr.Code, http.StatusOK)
+	}
+	if rr := serveHistoryRequest(t, handler, http.MethodGet, "/c/other"+lastUpdatedPath, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("GET /c/other/lastupdated: got %d want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestChannelInvalidName(t *testing.T) {
+	handler := newHistoryTestHandler(3, 0)
+	for _, path := range []string{"/c/", "/c/-dash", "/c/.hidden/history", "/c/" + string(bytes.Repeat([]byte("a"), 65))} {
+		rr := serveHistoryRequest(t, handler, http.MethodGet, path, nil)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("GET %s: got %d want %d", path, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestChannelPersistedUnderDataDir(t *testing.T) {
+	dir := t.TempDir()
+	newHandler := func() http.Handler {
+		history, err := openHistoryStore(dir, historyPolicy{limit: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &serveRunner{dataDir: dir, historyLimit: 3, history: history}
+		return r.newServer().Handler
+	}
+	handler := newHandler()
+	if rr := serveHistoryRequest(t, handler, http.MethodPut, "/c/team", []byte("team")); rr.Code != http.StatusOK {
+		t.Fatalf("PUT /c/team status: got %d", rr.Code)
+	}
+	if got := bodyFiles(t, filepath.Join(dir, historyChannelsDir, "team")); len(got) != 1 {
+		t.Fatalf("channel body files: %v", got)
+	}
+
+	handler = newHandler()
+	rr := serveHistoryRequest(t, handler, http.MethodGet, "/c/team", nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != "team" {
+		t.Fatalf("GET /c/team after restart: status %d body %q", rr.Code, rr.Body.String())
+	}
+	if rr := serveHistoryRequest(t, handler, http.MethodGet, "/", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("GET / after restart: got %d want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestClientChannel(t *testing.T) {
+	handler := newHistoryTestHandler(3, 0)
+	client := newHandlerClient(handler)
+	t.Setenv(pbgopyServerEnv, "http://pbgopy.test")
+	t.Setenv(pbgopyChannelEnv, "team")
+	putClipboard(t, handler, []byte("default"), false)
+	serveHistoryRequest(t, handler, http.MethodPut, "/c/team", []byte("from env"))
+	serveHistoryRequest(t, handler, http.MethodPut, "/c/flag", []byte("from flag"))
+
+	tests := []struct {
+		channel string
+		want    string
+	}{
+		{channel: "", want: "from env"},
+		{channel: "flag", want: "from flag"},
+	}
+	for _, tt := range tests {
+		var stdout bytes.Buffer
+		r := &pasteRunner{
+			timeout:    time.Second,
+			maxBufSize: "500mb",
+			channel:    tt.channel,
+			stdout:     &stdout,
+			client:     client,
+		}
+		if err := r.run(nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := stdout.String(); got != tt.want {
+			t.Fatalf("paste --channel %q: got %q want %q", tt.channel, got, tt.want)
+		}
+	}
+
+	r := &pasteRunner{channel: "no/slash", maxBufSize: "500mb", client: client}
+	if err := r.run(nil, nil); err == nil {
+		t.Fatal("expected an error for an invalid channel name")
+	}
+}
+
+func TestChannelNotCreatedByReads(t *testing.T) {
+	dir := t.TempDir()
+	history, err := openHistoryStore(dir, historyPolicy{limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &serveRunner{dataDir: dir, historyLimit: 3, history: history, maxChannels: 1}
+	handler := r.newServer().Handler
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		for _, path := range []string{"/c/random", "/c/random" + historyPath, "/c/random" + watchPath + "?timeout=10ms"} {
+			if rr := serveHistoryRequest(t, handler, method, path, nil); rr.Code != http.StatusNotFound {
+				t.Fatalf("%s %s: got %d want %d", method, path, rr.Code, http.StatusNotFound)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, historyChannelsDir, "random")); !os.IsNotExist(err) {
+		t.Fatalf("a read has created the channel directory: %v", err)
+	}
+
+	if rr := serveHistoryRequest(t, handler, http.MethodPut, "/c/team", []byte("team")); rr.Code != http.StatusOK {
+		t.Fatalf("PUT /c/team: got %d", rr.Code)
+	}
+	if rr := serveHistoryRequest(t, handler, http.MethodPut, "/c/other", []byte("other")); rr.Code != http.StatusForbidden {
+		t.Fatalf("PUT to a channel beyond --max-channels: got %d want %d", rr.Code, http.StatusForbidden)
+	}
+	if rr := serveHistoryRequest(t, handler, http.MethodPut, "/c/team", []byte("again")); rr.Code != http.StatusOK {
+		t.Fatalf("PUT to an existing channel at --max-channels: got %d", rr.Code)
+	}
+}
+
+func TestChannelPolicy(t *testing.T) {
+	r := &serveRunner{
+		cache:                memorycache.NewCache(),
+		historyLimit:         3,
+		channelTTLFlag:       map[string]string{"scratch": "1ms"},
+		channelHistoryLimits: map[string]int{"team": 1},
+	}
+	if err := r.parseChannelPolicies(); err != nil {
+		t.Fatal(err)
+	}
+	handler := r.newServer().Handler
+	// A configured channel exists before anything is copied to it.
+	if rr := serveHistoryRequest(t, handler, http.MethodGet, "/c/team"+historyPath, nil); rr.Code != http.StatusOK {
+		t.Fatalf("GET /c/team/history: got %d want %d", rr.Code, http.StatusOK)
+	}
+	for _, path := range []string{"/", "/c/team", "/c/scratch"} {
+		for _, body := range []string{"one", "two"} {
+			if rr := serveHistoryRequest(t, handler, http.MethodPut, path, []byte(body)); rr.Code != http.StatusOK {
+				t.Fatalf("PUT %s: got %d", path, rr.Code)
+			}
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	for path, want := range map[string]int{"": 2, "/c/team": 1, "/c/scratch": 0} {
+		rr := serveHistoryRequest(t, handler, http.MethodGet, path+historyPath, nil)
+		var entries []HistoryEntry
+		if err := json.Unmarshal(rr.Body.Bytes(), &entries); err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != want {
+			t.Fatalf("history of %q: got %d entries want %d", path, len(entries), want)
+		}
+	}
+
+	for _, tt := range []struct {
+		ttls   map[string]string
+		limits map[string]int
+	}{
+		{ttls: map[string]string{"team": "forever"}},
+		{ttls: map[string]string{"no/slash": "1h"}},
+		{limits: map[string]int{"team": -1}},
+	} {
+		r := &serveRunner{channelTTLFlag: tt.ttls, channelHistoryLimits: tt.limits}
+		if err := r.parseChannelPolicies(); err == nil {
+			t.Fatalf("no error for %v %v", tt.ttls, tt.limits)
+		}
+	}
+}
+
+func TestPasteWatchNewChannel(t *testing.T) {
+	r := &serveRunner{cache: memorycache.NewCache(), historyLimit: 3}
+	handler := r.newServer().Handler
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	stdout := &syncBuffer{}
+	p := &pasteRunner{maxBufSize: "500mb", stdout: stdout, client: server.Client()}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- p.runWatch(ctx, p.client, channelURL(server.URL, "late"))
+	}()
+	// The watch keeps waiting until the channel is created.
+	time.Sleep(10 * time.Millisecond)
+	serveHistoryRequest(t, handler, http.MethodPut, "/c/late", []byte("first"))
+	waitOutput(t, stdout, "first\n")
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package commands
+
+import (
+	"errors"
+
+	"github.com/atotto/clipboard"
+)
+
+// errNotText is returned when binary data, such as an image, is about to be written to the clipboard, which holds only text.
+var errNotText = errors.New("the data isn't text, so it can't be written to the clipboard")
+
+// clipboardAccessor reads and writes the text on the clipboard of the local OS.
+type clipboardAccessor interface {
+	ReadAll() (string, error)
+	WriteAll(text string) error
+}
+
+// systemClipboard is the clipboard of the local OS.
+type systemClipboard struct{}
+
+func (systemClipboard) ReadAll() (string, error) {
+	return clipboard.ReadAll()
+}
+
+func (systemClipboard) WriteAll(text string) error {
+	return clipboard.WriteAll(text)
+}
+
+// writeClipboard writes the data to the clipboard if it is text.
+func writeClipboard(c clipboardAccessor, data []byte) error {
+	if !isLikelyText(data) {
+		return errNotText
+	}
+	return c.WriteAll(string(data))
+}
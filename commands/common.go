@@ -18,6 +18,8 @@ import (
 
 const (
 	pbgopyServerEnv           = "PBGOPY_SERVER"
+	pbgopyChannelEnv          = "PBGOPY_CHANNEL"
+	pbgopyTokenEnv            = "PBGOPY_TOKEN"
 	pbgopySymmetricKeyFileEnv = "PBGOPY_SYMMETRIC_KEY_FILE"
 
 	defaultGPGExecutablePath = "gpg"
@@ -39,6 +41,34 @@ func addBasicAuthHeader(req *http.Request, basicAuth string) {
 	req.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(basicAuth)))
 }
 
+// serverAddress gives back the base URL of the given channel on the pbgopy server.
+// The channel is taken from the environment variable if not given.
+func serverAddress(channel string) (string, error) {
+	address := os.Getenv(pbgopyServerEnv)
+	if address == "" {
+		return "", fmt.Errorf("put the pbgopy server's address into %s environment variable", pbgopyServerEnv)
+	}
+	if channel == "" {
+		channel = os.Getenv(pbgopyChannelEnv)
+	}
+	if channel != "" && !validChannelName(channel) {
+		return "", fmt.Errorf("invalid channel name %q: use up to 64 letters, digits, dots, underscores and hyphens", channel)
+	}
+	return channelURL(address, channel), nil
+}
+
+// addTokenHeader adds a Bearer token header if the token is given by either the flag or the environment variable.
+// It takes precedence over basic authentication.
+func addTokenHeader(req *http.Request, token string) {
+	if token == "" {
+		token = os.Getenv(pbgopyTokenEnv)
+	}
+	if token == "" {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+}
+
 func historyEntryURL(address, id string) string {
 	return strings.TrimRight(address, "/") + historyPath + "/" + url.PathEscape(id)
 }
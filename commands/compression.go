@@ -0,0 +1,123 @@
+package commands
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// historyContentEncodingHeader tells how the data was compressed by the client before encryption.
+	// Unlike Content-Encoding, which the server undoes on upload, it is kept along with the entry,
+	// since the server can't decompress ciphertext.
+	historyContentEncodingHeader = "X-Pbgopy-Content-Encoding"
+
+	encodingGzip = "gzip"
+	// minCompressSize is the size below which data isn't worth compressing.
+	minCompressSize = 1024
+)
+
+// errUnsupportedEncoding means that the request body is compressed in a way the server doesn't know.
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// compressible reports whether data of the given MIME type is likely to get smaller by compression.
+func compressible(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-ndjson", "application/yaml",
+		"application/x-yaml", "application/toml", "application/sql", "application/x-sh", archiveMIME:
+		return true
+	}
+	return false
+}
+
+// gzipBytes gives back the data compressed by gzip.
+func gzipBytes(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// decodePayload undoes the compression of the data made by the client before encryption.
+// It fails if the decompressed data exceeds max bytes.
+func decodePayload(data []byte, encoding string, max int64) ([]byte, error) {
+	switch encoding {
+	case "":
+		return data, nil
+	case encodingGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress the data: %w", err)
+		}
+		defer zr.Close()
+		data, err := readNoMoreThan(zr, max)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress the data: %w", err)
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// decodeRequestBody gives back the body of the request with its Content-Encoding undone.
+func decodeRequestBody(req *http.Request) (io.Reader, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return req.Body, nil
+	case encodingGzip, "x-gzip":
+		return gzip.NewReader(req.Body)
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, encoding)
+	}
+}
+
+// advertiseEncodings tells clients in every response that uploads compressed by gzip are decompressed,
+// with Accept-Encoding as in RFC 7694, so that they don't compress uploads to servers that would store them as they are.
+func advertiseEncodings(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Accept-Encoding", encodingGzip)
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// acceptsGzip reports whether the client accepts responses compressed by gzip.
+func acceptsGzip(req *http.Request) bool {
+	return gzipAccepted(req.Header)
+}
+
+// gzipAccepted reports whether the Accept-Encoding field of the given header allows gzip.
+func gzipAccepted(header http.Header) bool {
+	for _, v := range strings.Split(strings.Join(header.Values("Accept-Encoding"), ","), ",") {
+		coding, params, _ := strings.Cut(v, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != encodingGzip && coding != "x-gzip" && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package commands
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nakabonne/pbgopy/cache/memorycache"
+)
+
+func TestServeCompression(t *testing.T) {
+	r := &serveRunner{cache: memorycache.NewCache(), historyLimit: 10, entrySizeLimit: 4096}
+	handler := r.newServer().Handler
+	text := strings.Repeat("a log line\n", 200)
+
+	put := func(body []byte, encoding string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPut, "/", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", encoding)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET / status: got %d want %d", rr.Code, http.StatusOK)
+		}
+		return rr
+	}
+
+	// A compressed upload is stored decompressed.
+	if code := put(gzipTestBytes(t, []byte(text)), "gzip"); code != http.StatusOK {
+		t.Fatalf("PUT gzip: got %d", code)
+	}
+	if entry := getHistory(t, handler)[0]; entry.Size != len(text) || entry.Kind != historyKindText {
+		t.Fatalf("entry uploaded compressed: %+v", entry)
+	}
+	if rr := get(""); rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != text {
+		t.Fatalf("GET without Accept-Encoding: encoding %q body %d bytes", rr.Header().Get("Content-Encoding"), rr.Body.Len())
+	}
+
+	// The response is compressed only if the client accepts it.
+	rr := get("br, gzip")
+	if rr.Header().Get("Content-Encoding") != "gzip" || rr.Body.Len() >= len(text) {
+		t.Fatalf("GET with gzip accepted: encoding %q body %d bytes", rr.Header().Get("Content-Encoding"), rr.Body.Len())
+	}
+	zr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(zr); err != nil || string(data) != text {
+		t.Fatalf("decompressed body: %d bytes, %v", len(data), err)
+	}
+	if rr := get("gzip;q=0"); rr.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("GET with gzip refused: got encoding %q", rr.Header().Get("Content-Encoding"))
+	}
+
+	// Small entries aren't worth compressing.
+	if code := put([]byte("small"), ""); code != http.StatusOK {
+		t.Fatalf("PUT small: got %d", code)
+	}
+	if rr := get("gzip"); rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != "small" {
+		t.Fatalf("GET small: encoding %q body %q", rr.Header().Get("Content-Encoding"), rr.Body.String())
+	}
+
+	if code := put([]byte("data"), "br"); code != http.StatusUnsupportedMediaType {
+		t.Fatalf("PUT br: got %d want %d", code, http.StatusUnsupportedMediaType)
+	}
+	if code := put([]byte("not gzip at all"), "gzip"); code != http.StatusBadRequest {
+		t.Fatalf("PUT a corrupt gzip body: got %d want %d", code, http.StatusBadRequest)
+	}
+	compressed := gzipTestBytes(t, []byte(text))
+	if code := put(compressed[:len(compressed)/2], "gzip"); code != http.StatusBadRequest {
+		t.Fatalf("PUT a truncated gzip body: got %d want %d", code, http.StatusBadRequest)
+	}
+	req := httptest.NewRequest(http.MethodOptions, "/", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if got := rr.Header().Get("Accept-Encoding"); got != encodingGzip {
+		t.Fatalf("OPTIONS /: Accept-Encoding %q want %q", got, encodingGzip)
+	}
+	// The size limit applies to the decompressed body.
+	if code := put(gzipTestBytes(t, bytes.Repeat([]byte("a"), 8192)), "gzip"); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("PUT a gzip bomb: got %d want %d", code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestCopyCompressesBeforeEncryption(t *testing.T) {
+	handler := newHistoryTestHandler(10, 0)
+	t.Setenv(pbgopyServerEnv, "http://pbgopy.test/")
+	text := []byte(strings.Repeat(`{"level":"info","msg":"hello"}`+"\n", 100))
+
+	for _, password := range []string{"", "secret"} {
+		c := &copyRunner{password: password, compress: true, client: newHandlerClient(handler)}
+		if err := c.upload(c.client, "http://pbgopy.test/", text); err != nil {
+			t.Fatal(err)
+		}
+		entry := getHistory(t, handler)[0]
+		switch {
+		case password == "" && (entry.Size != len(text) || entry.ContentEncoding != ""):
+			t.Fatalf("plaintext entry: %+v", entry)
+		case password != "" && (entry.Size >= len(text) || entry.ContentEncoding != encodingGzip):
+			t.Fatalf("encrypted entry: %+v", entry)
+		}
+
+		var stdout bytes.Buffer
+		p := &pasteRunner{password: password, maxBufSize: "500mb", stdout: &stdout, client: newHandlerClient(handler)}
+		if err := p.run(nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(stdout.Bytes(), text) {
+			t.Fatalf("pasted %d bytes want %d", stdout.Len(), len(text))
+		}
+	}
+}
+
+func TestCopyToServerWithoutCompression(t *testing.T) {
+	// A server older than compression neither advertises it nor decompresses uploads.
+	var (
+		uploaded []byte
+		header   http.Header
+	)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPut {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		header = req.Header
+		uploaded, _ = io.ReadAll(req.Body)
+	})
+	text := []byte(strings.Repeat("a log line\n", 200))
+	for _, password := range []string{"", "secret"} {
+		c := &copyRunner{password: password, compress: true, client: newHandlerClient(handler)}
+		if err := c.upload(c.client, "http://pbgopy.test/", text); err != nil {
+			t.Fatal(err)
+		}
+		if header.Get("Content-Encoding") != "" || header.Get(historyContentEncodingHeader) != "" {
+			t.Fatalf("compressed for an older server: %v", header)
+		}
+		if password == "" && !bytes.Equal(uploaded, text) {
+			t.Fatalf("uploaded %d bytes want %d", len(uploaded), len(text))
+		}
+	}
+}
+
+func gzipTestBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	compressed, err := gzipBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compressed
+}
@@ -9,12 +9,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/atotto/clipboard"
 	"github.com/spf13/cobra"
 
 	pbcrypto "github.com/nakabonne/pbgopy/crypto"
@@ -28,11 +30,25 @@ type copyRunner struct {
 	gpgUserID        string
 	gpgPath          string
 	basicAuth        string
+	channel          string
+	token            string
+	tls              tlsClientOptions
 	maxBufSize       string
 	fromClipboard    bool
+	mime             string
+	compress         bool
+	chunkSize        string
+	retries          int
+	ttl              time.Duration
+	maxReads         int
+	tags             []string
+	note             string
 
 	stdout io.Writer
 	stderr io.Writer
+	client *http.Client
+	// retryInterval overrides uploadRetryInterval if not zero.
+	retryInterval time.Duration
 }
 
 func NewCopyCommand(stdout, stderr io.Writer) *cobra.Command {
@@ -41,10 +57,14 @@ func NewCopyCommand(stdout, stderr io.Writer) *cobra.Command {
 		stderr: stderr,
 	}
 	cmd := &cobra.Command{
-		Use:   "copy",
-		Short: "Copy from stdin",
+		Use:   "copy [PATH]...",
+		Short: "Copy from stdin, or the given files and directories",
 		Example: `  export PBGOPY_SERVER=http://host.xz:9090
-  echo hello | pbgopy copy`,
+  echo hello | pbgopy copy
+  pbgopy copy ./project notes.txt
+  pbgopy copy --ttl 5m <token.txt
+  pbgopy copy --max-reads 1 <secret.txt
+  pbgopy copy --tag k8s --note "prod kubeconfig" <kubeconfig`,
 		RunE: r.run,
 	}
 	cmd.Flags().DurationVar(&r.timeout, "timeout", 5*time.Second, "Time limit for requests")
@@ -54,66 +74,206 @@ func NewCopyCommand(stdout, stderr io.Writer) *cobra.Command {
 	cmd.Flags().StringVarP(&r.gpgUserID, "gpg-user-id", "u", "", "GPG user id associated with public-key to be used for encryption")
 	cmd.Flags().StringVar(&r.gpgPath, "gpg-path", defaultGPGExecutablePath, "Path to gpg executable")
 	cmd.Flags().StringVarP(&r.basicAuth, "basic-auth", "a", "", "Basic authentication, username:password")
+	r.tls.addFlags(cmd.Flags())
+	cmd.Flags().StringVar(&r.token, "token", "", "API token to authenticate with. Defaults to $PBGOPY_TOKEN")
+	cmd.Flags().StringVar(&r.channel, "channel", "", "Name of the channel to use. Defaults to $PBGOPY_CHANNEL, or the default channel if it is not set either")
 	cmd.Flags().StringVar(&r.maxBufSize, "max-size", "500mb", "Max data size with unit")
+	cmd.Flags().StringVar(&r.mime, "mime", "", "MIME type of the data, e.g. image/png. Detected from the data if not given")
+	cmd.Flags().StringVar(&r.chunkSize, "chunk-size", defaultChunkSize, "Size of the chunks to upload larger data in, resuming from the last one received by the server after a failure. Give 0 to upload in a single request")
+	cmd.Flags().IntVar(&r.retries, "retries", 5, "Number of times to retry a failed request in a row when uploading in chunks")
+	cmd.Flags().BoolVar(&r.compress, "compress", true, "Compress the data by gzip if it's worth it. Encrypted data is compressed before encryption")
+	cmd.Flags().DurationVar(&r.ttl, "ttl", 0, "How long the server keeps the entry, e.g. 5m for a password. Up to the max TTL of the server. The default TTL of the server if not given")
+	cmd.Flags().IntVar(&r.maxReads, "max-reads", 0, "Number of times the entry can be pasted before the server deletes it. Give 1 to burn it after reading. Unlimited if not given")
+	cmd.Flags().StringSliceVar(&r.tags, "tag", nil, "Tag to find the entry by, e.g. with \"pbgopy paste --tag\". Can be given multiple times")
+	cmd.Flags().StringVar(&r.note, "note", "", "Free-text note on the entry, shown by \"pbgopy history\"")
 	cmd.Flags().BoolVarP(&r.fromClipboard, "from-clipboard", "c", false, "Put the data stored at local clipboard into pbgopy server")
 	return cmd
 }
 
-func (r *copyRunner) run(_ *cobra.Command, _ []string) error {
-	address := os.Getenv(pbgopyServerEnv)
-	if address == "" {
-		return fmt.Errorf("put the pbgopy server's address into %s environment variable", pbgopyServerEnv)
+func (r *copyRunner) run(_ *cobra.Command, args []string) error {
+	address, err := serverAddress(r.channel)
+	if err != nil {
+		return err
+	}
+	if r.fromClipboard && len(args) > 0 {
+		return fmt.Errorf("can't specify both --from-clipboard and paths")
+	}
+	if r.ttl < 0 {
+		return fmt.Errorf("ttl must be greater than or equal to 0")
+	}
+	if r.maxReads < 0 {
+		return fmt.Errorf("max-reads must be greater than or equal to 0")
+	}
+	if err := validateHistoryTags(r.tags); err != nil {
+		return err
+	}
+	if err := validateHistoryNote(r.note); err != nil {
+		return err
+	}
+	sizeInBytes, err := datasizeToBytes(r.maxBufSize)
+	if err != nil {
+		return fmt.Errorf("failed to parse data size: %w", err)
 	}
 
 	// Start reading data.
-	var source io.Reader = os.Stdin
-	if r.fromClipboard {
-		clipboardData, err := clipboard.ReadAll()
+	var data []byte
+	if len(args) > 0 {
+		data, err = r.archive(args, sizeInBytes)
 		if err != nil {
 			return err
 		}
-		source = strings.NewReader(clipboardData)
+	} else {
+		var source io.Reader = os.Stdin
+		if r.fromClipboard {
+			clipboardData, err := systemClipboard{}.ReadAll()
+			if err != nil {
+				return err
+			}
+			source = strings.NewReader(clipboardData)
+		}
+		data, err = readNoMoreThan(source, sizeInBytes)
+		if err != nil {
+			return fmt.Errorf("failed to read from source: %w", err)
+		}
 	}
-	sizeInBytes, err := datasizeToBytes(r.maxBufSize)
+
+	client, err := r.httpClient()
 	if err != nil {
-		return fmt.Errorf("failed to parse data size: %w", err)
+		return err
 	}
-	data, err := readNoMoreThan(source, sizeInBytes)
-	if err != nil {
-		return fmt.Errorf("failed to read from source: %w", err)
+	return r.upload(client, address, data)
+}
+
+// upload compresses and encrypts the data if needed, and puts it to the server at address along with its MIME type.
+func (r *copyRunner) upload(client *http.Client, address string, data []byte) error {
+	// The type is detected before encryption, since the server can only see the ciphertext.
+	mimeType := r.mime
+	if mimeType == "" {
+		mimeType = detectMIME(data)
+	} else if _, _, err := mime.ParseMediaType(mimeType); err != nil {
+		return fmt.Errorf("invalid MIME type %q: %w", mimeType, err)
+	}
+
+	// Compress before encryption, since ciphertext doesn't get any smaller.
+	var encoding string
+	if r.compress && len(data) >= minCompressSize && compressible(mimeType) && r.serverAcceptsGzip(client, address) {
+		compressed, err := gzipBytes(data)
+		if err != nil {
+			return fmt.Errorf("failed to compress the data: %w", err)
+		}
+		if len(compressed) < len(data) {
+			data, encoding = compressed, encodingGzip
+		}
 	}
 
 	// Start encryption.
-	var encrypted bool
-	data, encrypted, err = r.encrypt(data)
+	data, encrypted, err := r.encrypt(data)
 	if err != nil {
 		return err
 	}
 
-	// Start issuing an HTTP request.
-	client := &http.Client{
-		Timeout: r.timeout,
+	header := http.Header{}
+	header.Set(historyContentTypeHeader, mimeType)
+	if encrypted {
+		header.Set(historyEncryptedHeader, "true")
+		header.Set("Content-Type", "application/octet-stream")
+	} else {
+		header.Set("Content-Type", mimeType)
+	}
+	// The server decompresses plaintext to keep it searchable, while it keeps encrypted data as it is.
+	if encoding != "" && encrypted {
+		header.Set(historyContentEncodingHeader, encoding)
+	} else if encoding != "" {
+		header.Set("Content-Encoding", encoding)
 	}
+	if r.ttl > 0 {
+		header.Set(historyTTLHeader, r.ttl.String())
+	}
+	if r.maxReads > 0 {
+		header.Set(historyMaxReadsHeader, strconv.Itoa(r.maxReads))
+	}
+	if len(r.tags) > 0 {
+		header.Set(historyTagsHeader, strings.Join(r.tags, ","))
+	}
+	if r.note != "" {
+		header.Set(historyNoteHeader, url.PathEscape(r.note))
+	}
+
+	if r.chunkSize != "" {
+		chunkSize, err := datasizeToBytes(r.chunkSize)
+		if err != nil {
+			return fmt.Errorf("failed to parse chunk size: %w", err)
+		}
+		if chunkSize > maxUploadChunkSize {
+			return fmt.Errorf("chunk size must be up to %d bytes", maxUploadChunkSize)
+		}
+		if chunkSize > 0 && int64(len(data)) > chunkSize {
+			err := r.uploadChunked(client, address, data, header, chunkSize)
+			if !errors.Is(err, errChunkedUploadUnsupported) {
+				return err
+			}
+		}
+	}
+
+	// Start issuing an HTTP request.
 	req, err := http.NewRequest(http.MethodPut, address, bytes.NewBuffer(data))
 	if err != nil {
 		return fmt.Errorf("failed to make request: %w", err)
 	}
-	if encrypted {
-		req.Header.Set(historyEncryptedHeader, "true")
-	}
+	req.Header = header
 	addBasicAuthHeader(req, r.basicAuth)
+	addTokenHeader(req, r.token)
 	res, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to issue request: %w", err)
 	}
 	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed request: Status %s", res.Status)
+		return failedRequestError(res)
 	}
 
 	return nil
 }
 
+// serverAcceptsGzip asks the server with OPTIONS whether it takes uploads compressed by gzip.
+// Older servers don't tell, and would store compressed data as it is.
+func (r *copyRunner) serverAcceptsGzip(client *http.Client, address string) bool {
+	req, err := http.NewRequest(http.MethodOptions, address, nil)
+	if err != nil {
+		return false
+	}
+	addBasicAuthHeader(req, r.basicAuth)
+	addTokenHeader(req, r.token)
+	res, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+	return gzipAccepted(res.Header)
+}
+
+// archive bundles the given files and directories into a tar archive of up to max bytes.
+func (r *copyRunner) archive(paths []string, max int64) ([]byte, error) {
+	var b bytes.Buffer
+	if err := writeArchive(&limitedWriter{w: &b, n: max}, paths, r.stderr); err != nil {
+		if errors.Is(err, errArchiveTooLarge) {
+			return nil, fmt.Errorf("input data exceeds set limit %dBytes", max)
+		}
+		return nil, err
+	}
+	if r.mime == "" {
+		r.mime = archiveMIME
+	}
+	return b.Bytes(), nil
+}
+
+func (r *copyRunner) httpClient() (*http.Client, error) {
+	if r.client != nil {
+		return r.client, nil
+	}
+	return newHTTPClient(r.timeout, r.tls)
+}
+
 // encrypts with the user-specified way. It directly gives back plaintext if any key doesn't exists.
 func (r *copyRunner) encrypt(plaintext []byte) ([]byte, bool, error) {
 	if (r.password != "" || r.symmetricKeyFile != "") && (r.publicKeyFile != "" || r.gpgUserID != "") {
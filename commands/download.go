@@ -0,0 +1,217 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// partialSuffix is the suffix of the file a download is written to until it completes.
+const partialSuffix = ".part"
+
+// download writes the entry at url into r.output, failing if it exceeds max bytes.
+// The body is first written to a partial file next to the output, named after the digest of the body,
+// which --resume continues with a Range request when a previous download was interrupted.
+// Once complete, the file is checked against the digest, decrypted if needed, and renamed into place.
+// Nothing is downloaded if the output already holds the entry.
+func (r *pasteRunner) download(client *http.Client, url string, max int64) error {
+	var (
+		entry   http.Header
+		partial string
+		offset  int64
+		size    int64 = -1
+	)
+	// Only unencrypted entries can be told apart by the digest of the output.
+	current, _ := hashFile(r.output)
+	if r.resume {
+		// Ask which body is there now, to tell whether the partial file is of the same one.
+		res, err := r.request(client, http.MethodHead, url, nil)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return failedRequestError(res)
+		}
+		entry, size = res.Header, res.ContentLength
+		sha := entry.Get(historySHA256Header)
+		if !validSHA256(sha) {
+			return fmt.Errorf("the server gave no digest of the entry to resume with")
+		}
+		if sha == current {
+			removePartials(r.output, "")
+			return nil
+		}
+		partial = partialPath(r.output, sha)
+		if info, err := os.Stat(partial); err == nil && info.Size() <= size {
+			offset = info.Size()
+		}
+	}
+	removePartials(r.output, partial)
+	if size > max {
+		return fmt.Errorf("input data exceeds set limit %dBytes", max)
+	}
+
+	if !r.resume || size < 0 || offset < size {
+		header := http.Header{}
+		if current != "" {
+			header.Set("If-None-Match", strconv.Quote(current))
+		}
+		if offset > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			// The whole body is sent instead if it has changed in the meantime.
+			header.Set("If-Range", strconv.Quote(entry.Get(historySHA256Header)))
+		}
+		res, err := r.request(client, http.MethodGet, url, header)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		switch res.StatusCode {
+		case http.StatusNotModified:
+			removePartials(r.output, "")
+			return nil
+		case http.StatusPartialContent:
+			if !strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+				return fmt.Errorf("the server sent an unexpected range %q", res.Header.Get("Content-Range"))
+			}
+		case http.StatusOK:
+			entry, offset, flag = res.Header, 0, flag|os.O_TRUNC
+			sha := entry.Get(historySHA256Header)
+			if !validSHA256(sha) {
+				return fmt.Errorf("the server gave no digest of the entry to check the download with")
+			}
+			if p := partialPath(r.output, sha); p != partial {
+				removePartials(r.output, "")
+				partial = p
+			}
+		default:
+			return failedRequestError(res)
+		}
+		if err := r.writePartial(partial, flag, res.Body, max-offset); err != nil {
+			return err
+		}
+	}
+
+	sha, err := hashFile(partial)
+	if err != nil {
+		return err
+	}
+	if sha != entry.Get(historySHA256Header) {
+		os.Remove(partial)
+		return fmt.Errorf("the downloaded data doesn't match the SHA256 of the entry, try again")
+	}
+	if entry.Get(historyEncryptedHeader) != "true" && entry.Get(historyContentEncodingHeader) == "" {
+		if err := os.Rename(partial, r.output); err != nil {
+			return err
+		}
+		return syncDir(filepath.Dir(r.output))
+	}
+
+	// Encrypted data has to be decrypted as a whole.
+	f, err := os.Open(partial)
+	if err != nil {
+		return err
+	}
+	data, err := readNoMoreThan(f, max)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", partial, err)
+	}
+	if data, err = r.decrypt(data); err != nil {
+		return err
+	}
+	if data, err = decodePayload(data, entry.Get(historyContentEncodingHeader), max); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(r.output, data); err != nil {
+		return err
+	}
+	return os.Remove(partial)
+}
+
+// writePartial appends the body to the partial file, failing if more than max bytes come.
+func (r *pasteRunner) writePartial(partial string, flag int, body io.Reader, max int64) error {
+	f, err := os.OpenFile(partial, flag, 0o600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(body, max+1))
+	if err == nil && n > max {
+		err = errors.New("input data exceeds set limit")
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("the download was interrupted, run it again with --resume to continue: %w", err)
+	}
+	return nil
+}
+
+func (r *pasteRunner) request(client *http.Client, method, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	addBasicAuthHeader(req, r.basicAuth)
+	addTokenHeader(req, r.token)
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue %s request: %w", strings.ToLower(method), err)
+	}
+	return res, nil
+}
+
+// partialPath gives back the path of the partial file of the output, for the body of the given digest.
+func partialPath(output, sha string) string {
+	return output + "." + sha + partialSuffix
+}
+
+// removePartials removes the partial files of the output, except for the given one.
+func removePartials(output, except string) {
+	dir, base := filepath.Split(output)
+	if dir == "" {
+		dir = "."
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		rest, ok := strings.CutPrefix(f.Name(), base+".")
+		if !ok {
+			continue
+		}
+		if sha, ok := strings.CutSuffix(rest, partialSuffix); !ok || !validSHA256(sha) {
+			continue
+		}
+		if path := filepath.Join(dir, f.Name()); except == "" || path != filepath.Clean(except) {
+			os.Remove(path)
+		}
+	}
+}
+
+func validSHA256(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,292 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHistoryEntryRange(t *testing.T) {
+	handler := newHistoryTestHandler(3, 0)
+	putClipboard(t, handler, []byte("0123456789"), false)
+	entry := getHistory(t, handler)[0]
+	path := historyPath + "/" + entry.ID
+
+	do := func(method string, header map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do(http.MethodGet, map[string]string{"Range": "bytes=2-4"})
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "234" || rr.Header().Get("Content-Range") != "bytes 2-4/10" {
+		t.Fatalf("range: got %d %q %q", rr.Code, rr.Body.String(), rr.Header().Get("Content-Range"))
+	}
+	etag := strconv.Quote(entry.SHA256)
+	if rr.Header().Get("ETag") != etag || rr.Header().Get(historySHA256Header) != entry.SHA256 || rr.Header().Get(historyIDHeader) != entry.ID {
+		t.Fatalf("headers: %v", rr.Header())
+	}
+	if rr := do(http.MethodGet, map[string]string{"Range": "bytes=8-", "If-Range": etag}); rr.Code != http.StatusPartialContent || rr.Body.String() != "89" {
+		t.Fatalf("range if the entry is the same: got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := do(http.MethodGet, map[string]string{"Range": "bytes=8-", "If-Range": `"other"`}); rr.Code != http.StatusOK || rr.Body.String() != "0123456789" {
+		t.Fatalf("range if the entry has changed: got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := do(http.MethodHead, nil); rr.Code != http.StatusOK || rr.Header().Get("Content-Length") != "10" || rr.Body.Len() != 0 {
+		t.Fatalf("HEAD: got %d %v %q", rr.Code, rr.Header(), rr.Body.String())
+	}
+}
+
+func TestHistoryEntryConditionalGet(t *testing.T) {
+	handler := newHistoryTestHandler(3, 0)
+	text := strings.Repeat("a log line\n", 200)
+	putClipboard(t, handler, []byte(text), false)
+	entry := getHistory(t, handler)[0]
+	etag := strconv.Quote(entry.SHA256)
+
+	for _, path := range []string{"/", historyPath + "/" + entry.ID} {
+		for _, acceptEncoding := range []string{"", "gzip"} {
+			get := func(header map[string]string) *httptest.ResponseRecorder {
+				t.Helper()
+				req := httptest.NewRequest(http.MethodGet, path, nil)
+				req.Header.Set("Accept-Encoding", acceptEncoding)
+				for k, v := range header {
+					req.Header.Set(k, v)
+				}
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+				return rr
+			}
+			rr := get(nil)
+			if rr.Code != http.StatusOK || !strings.HasSuffix(rr.Header().Get("ETag"), etag) || rr.Header().Get("Last-Modified") == "" {
+				t.Fatalf("%s %q: got %d %v", path, acceptEncoding, rr.Code, rr.Header())
+			}
+			lastModified := rr.Header().Get("Last-Modified")
+			for _, header := range []map[string]string{
+				{"If-None-Match": etag},
+				{"If-None-Match": `"other", W/` + etag},
+				{"If-Modified-Since": lastModified},
+			} {
+				if rr := get(header); rr.Code != http.StatusNotModified || rr.Body.Len() != 0 || rr.Header().Get(historyIDHeader) != entry.ID {
+					t.Fatalf("%s %q %v: got %d %q", path, acceptEncoding, header, rr.Code, rr.Body.String())
+				}
+			}
+			// If-None-Match takes precedence over If-Modified-Since.
+			if rr := get(map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lastModified}); rr.Code != http.StatusOK {
+				t.Fatalf("%s %q with another ETag: got %d", path, acceptEncoding, rr.Code)
+			}
+		}
+	}
+}
+
+func TestHistoryEntryConditionalGetWithoutBody(t *testing.T) {
+	history := &countingHistory{HistoryBackend: newHistoryStore(historyPolicy{limit: 3})}
+	r := &serveRunner{history: history}
+	handler := r.newServer().Handler
+	putClipboard(t, handler, []byte("0123456789"), false)
+	entry := getHistory(t, handler)[0]
+
+	for _, path := range []string{"/", historyPath + "/" + entry.ID} {
+		for _, tt := range []struct {
+			method string
+			header map[string]string
+			want   int
+		}{
+			{method: http.MethodHead, want: http.StatusOK},
+			{method: http.MethodHead, header: map[string]string{"Range": "bytes=0-1,4-5"}, want: http.StatusPartialContent},
+			{method: http.MethodGet, header: map[string]string{"If-None-Match": strconv.Quote(entry.SHA256)}, want: http.StatusNotModified},
+			{method: http.MethodGet, header: map[string]string{"If-Modified-Since": entry.CreatedAt.UTC().Format(http.TimeFormat)}, want: http.StatusNotModified},
+		} {
+			req := httptest.NewRequest(tt.method, path, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.want || rr.Body.Len() != 0 || rr.Header().Get("ETag") == "" {
+				t.Fatalf("%s %s %v: got %d %v", tt.method, path, tt.header, rr.Code, rr.Header())
+			}
+			if tt.want == http.StatusOK && rr.Header().Get("Content-Length") != "10" {
+				t.Fatalf("%s %s: Content-Length %q", tt.method, path, rr.Header().Get("Content-Length"))
+			}
+		}
+	}
+	if history.opened != 0 {
+		t.Fatalf("bodies opened for responses without one: %d", history.opened)
+	}
+	if rr := serveHistoryRequest(t, handler, http.MethodGet, "/", nil); rr.Code != http.StatusOK || rr.Body.String() != "0123456789" || history.opened != 1 {
+		t.Fatalf("GET /: status %d body %q, %d bodies opened", rr.Code, rr.Body.String(), history.opened)
+	}
+}
+
+// countingHistory counts how many times the bodies of entries are opened.
+type countingHistory struct {
+	HistoryBackend
+	opened int
+}
+
+func (h *countingHistory) Get(id string) (HistoryEntry, io.ReadSeekCloser, error) {
+	h.opened++
+	return h.HistoryBackend.Get(id)
+}
+
+func (h *countingHistory) Read(id string) (HistoryEntry, io.ReadSeekCloser, error) {
+	h.opened++
+	return h.HistoryBackend.Read(id)
+}
+
+func (h *countingHistory) Latest() (HistoryEntry, io.ReadSeekCloser, error) {
+	h.opened++
+	return h.HistoryBackend.Latest()
+}
+
+func TestPasteOutputNotModified(t *testing.T) {
+	handler := newHistoryTestHandler(3, 0)
+	t.Setenv(pbgopyServerEnv, "http://pbgopy.test/")
+	putClipboard(t, handler, []byte("hello"), false)
+	var statuses []int
+	client := &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			statuses = append(statuses, rr.Code)
+			return rr.Result(), nil
+		}),
+	}
+	output := filepath.Join(t.TempDir(), "hello.txt")
+	p := &pasteRunner{maxBufSize: "500mb", output: output, client: client}
+	for i := 0; i < 2; i++ {
+		if err := p.run(nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _ := os.ReadFile(output); string(got) != "hello" {
+		t.Fatalf("output: %q", got)
+	}
+	if len(statuses) != 2 || statuses[0] != http.StatusOK || statuses[1] != http.StatusNotModified {
+		t.Fatalf("statuses: %v", statuses)
+	}
+}
+
+func TestPasteOutputResume(t *testing.T) {
+	handler := newHistoryTestHandler(3, 0)
+	t.Setenv(pbgopyServerEnv, "http://pbgopy.test/")
+	data := make([]byte, 10<<10)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, password := range []string{"", "secret"} {
+		c := &copyRunner{password: password}
+		if err := c.upload(newHandlerClient(handler), "http://pbgopy.test/", data); err != nil {
+			t.Fatal(err)
+		}
+		output := filepath.Join(t.TempDir(), "data.bin")
+		p := &pasteRunner{
+			password:   password,
+			maxBufSize: "500mb",
+			output:     output,
+			client:     newInterruptingClient(handler, 4096),
+		}
+		if err := p.run(nil, nil); err == nil || !strings.Contains(err.Error(), "--resume") {
+			t.Fatalf("interrupted download: got %v", err)
+		}
+		if _, err := os.Stat(output); !os.IsNotExist(err) {
+			t.Fatalf("the output exists before the download completes: %v", err)
+		}
+
+		// The rest is fetched by a Range request.
+		p.resume = true
+		p.client = newInterruptingClient(handler, 4096)
+		if err := p.run(nil, nil); err == nil {
+			t.Fatal("the download completed in a request of 4096 bytes")
+		}
+		p.client = newHandlerClient(handler)
+		if err := p.run(nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%q: downloaded %d bytes want %d", password, len(got), len(data))
+		}
+		if partials, _ := filepath.Glob(output + ".*" + partialSuffix); len(partials) != 0 {
+			t.Fatalf("partial files left: %v", partials)
+		}
+	}
+}
+
+func TestPasteResumeChecksDigest(t *testing.T) {
+	handler := newHistoryTestHandler(3, 0)
+	t.Setenv(pbgopyServerEnv, "http://pbgopy.test/")
+	putClipboard(t, handler, []byte("old data"), false)
+	old := getHistory(t, handler)[0]
+	putClipboard(t, handler, []byte("new data"), false)
+	entry := getHistory(t, handler)[0]
+	output := filepath.Join(t.TempDir(), "data.txt")
+	p := &pasteRunner{maxBufSize: "500mb", output: output, resume: true, client: newHandlerClient(handler)}
+
+	// A partial download of another entry is thrown away.
+	if err := os.WriteFile(partialPath(output, old.SHA256), []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.run(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(output); string(got) != "new data" {
+		t.Fatalf("output: %q", got)
+	}
+	if _, err := os.Stat(partialPath(output, old.SHA256)); !os.IsNotExist(err) {
+		t.Fatalf("the partial download of the old entry is left: %v", err)
+	}
+
+	// A corrupt one is detected by the digest.
+	if err := os.Remove(output); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partialPath(output, entry.SHA256), []byte("bad "), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.run(nil, nil); err == nil || !strings.Contains(err.Error(), "SHA256") {
+		t.Fatalf("corrupt partial download: got %v", err)
+	}
+	if _, err := os.Stat(partialPath(output, entry.SHA256)); !os.IsNotExist(err) {
+		t.Fatalf("the corrupt partial download is left: %v", err)
+	}
+}
+
+// newInterruptingClient gives back a client of the handler of which the response bodies break after n bytes.
+func newInterruptingClient(handler http.Handler, n int64) *http.Client {
+	return &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			res := rr.Result()
+			res.Body = io.NopCloser(io.MultiReader(io.LimitReader(res.Body, n), errReader{errors.New("connection reset")}))
+			return res, nil
+		}),
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
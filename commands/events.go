@@ -0,0 +1,214 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventsPath = "/events"
+
+	// eventBufferSize is how many of the latest events are kept for clients reconnecting with Last-Event-ID.
+	eventBufferSize = 256
+	// eventKeepAliveInterval is how often a comment is sent to keep an idle stream open through proxies.
+	eventKeepAliveInterval = 15 * time.Second
+	// historyJanitorInterval is how often expired entries are pruned, so that their expiry is reported.
+	historyJanitorInterval = 5 * time.Second
+
+	// eventTypeReset tells the client that events have been missed, e.g. because the server restarted,
+	// so that it should reload the history.
+	eventTypeReset = "reset"
+)
+
+// streamEvent is a HistoryEvent numbered in the order it happened.
+type streamEvent struct {
+	seq uint64
+	HistoryEvent
+}
+
+// eventHub keeps the latest events of a channel and wakes up the streams waiting for more.
+// Event IDs are made of the time the hub was created and a sequence number,
+// so that IDs given by a previous run of the server are told apart.
+type eventHub struct {
+	epoch int64
+
+	mu sync.Mutex
+	// events holds the latest events in a ring buffer, where the event numbered n is at events[(n-1)%eventBufferSize].
+	events  []streamEvent
+	seq     uint64
+	updated chan struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		epoch:   time.Now().UnixNano(),
+		updated: make(chan struct{}),
+	}
+}
+
+func (h *eventHub) publish(ev HistoryEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	e := streamEvent{seq: h.seq, HistoryEvent: ev}
+	if len(h.events) < eventBufferSize {
+		h.events = append(h.events, e)
+	} else {
+		h.events[(h.seq-1)%eventBufferSize] = e
+	}
+	close(h.updated)
+	h.updated = make(chan struct{})
+}
+
+// since gives back the events after the given sequence number, along with a channel closed when another one is published.
+// ok is false if some of the events are no longer kept.
+func (h *eventHub) since(seq uint64) (events []streamEvent, updated <-chan struct{}, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if seq > h.seq {
+		return nil, h.updated, false
+	}
+	oldest := h.seq - uint64(len(h.events)) + 1
+	if seq+1 < oldest {
+		return nil, h.updated, false
+	}
+	for s := seq + 1; s <= h.seq; s++ {
+		events = append(events, h.events[(s-1)%eventBufferSize])
+	}
+	return events, h.updated, true
+}
+
+// current gives back the sequence number of the latest event.
+func (h *eventHub) current() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.seq
+}
+
+func (h *eventHub) eventID(seq uint64) string {
+	return fmt.Sprintf("%d-%d", h.epoch, seq)
+}
+
+// parseEventID gives back the sequence number in the given event ID, if it was given by this hub.
+func (h *eventHub) parseEventID(id string) (uint64, bool) {
+	epoch, seq, ok := strings.Cut(id, "-")
+	if !ok || epoch != strconv.FormatInt(h.epoch, 10) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// handleEvents streams the changes to the history of the channel as Server-Sent Events.
+// Each event is named after its type, with the JSON-encoded HistoryEvent as data.
+// A client reconnecting with the Last-Event-ID header, or the lastEventId parameter, receives the events it missed.
+// If they are no longer kept, it receives a reset event instead.
+func (r *serveRunner) handleEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("Method %s is not allowed", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	hub := r.channelOf(req).events
+
+	lastID := req.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = req.URL.Query().Get("lastEventId")
+	}
+	seq := hub.current()
+	reset := false
+	if lastID != "" {
+		if n, ok := hub.parseEventID(lastID); ok {
+			seq = n
+		} else {
+			reset = true
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep reverse proxies such as nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		events, updated, ok := hub.since(seq)
+		if !ok || reset {
+			reset = false
+			seq = hub.current()
+			if err := writeEvent(w, hub.eventID(seq), HistoryEvent{Type: eventTypeReset}); err != nil {
+				return
+			}
+			flusher.Flush()
+			continue
+		}
+		for _, ev := range events {
+			if err := writeEvent(w, hub.eventID(ev.seq), ev.HistoryEvent); err != nil {
+				return
+			}
+			seq = ev.seq
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+		}
+
+		select {
+		case <-updated:
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.done:
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, id string, ev HistoryEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", id, ev.Type, data)
+	return err
+}
+
+// runHistoryJanitor periodically prunes the expired entries of every open channel until done is closed,
+// so that their expiry is reported to the event streams.
+func (r *serveRunner) runHistoryJanitor(done <-chan struct{}) {
+	ticker := time.NewTicker(historyJanitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		for _, c := range r.channels.all() {
+			if err := c.history.PruneExpired(); err != nil {
+				log.Printf("Failed to prune expired entries of the history: %v\n", err)
+			}
+		}
+	}
+}
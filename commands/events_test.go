@@ -0,0 +1,160 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nakabonne/pbgopy/cache/memorycache"
+)
+
+func TestEventHub(t *testing.T) {
+	h := newEventHub()
+	for i := 0; i < eventBufferSize+10; i++ {
+		h.publish(HistoryEvent{Type: historyEventAdded})
+	}
+	if _, _, ok := h.since(0); ok {
+		t.Fatal("got events no longer kept")
+	}
+	events, _, ok := h.since(h.current() - 3)
+	if !ok || len(events) != 3 || events[2].seq != h.current() {
+		t.Fatalf("latest events: %+v, %v", events, ok)
+	}
+	events, updated, ok := h.since(h.current())
+	if !ok || len(events) != 0 {
+		t.Fatalf("events after the latest: %+v, %v", events, ok)
+	}
+	h.publish(HistoryEvent{Type: historyEventCleared})
+	select {
+	case <-updated:
+	default:
+		t.Fatal("publish didn't wake up the waiters")
+	}
+
+	if seq, ok := h.parseEventID(h.eventID(42)); !ok || seq != 42 {
+		t.Fatalf("parsed event ID: %d, %v", seq, ok)
+	}
+	for _, id := range []string{"1-1", "42", h.eventID(1) + "x"} {
+		if _, ok := h.parseEventID(id); ok {
+			t.Fatalf("parsed the foreign event ID %q", id)
+		}
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	r := &serveRunner{cache: memorycache.NewCache(), historyLimit: 3, basicAuth: "user:pass"}
+	handler := r.newServer().Handler
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	open := func(path, lastEventID string) (*http.Response, *bufio.Reader) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("user", "pass")
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		res, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("GET %s: status %d content type %q", path, res.StatusCode, res.Header.Get("Content-Type"))
+		}
+		return res, bufio.NewReader(res.Body)
+	}
+	do := func(method, path, body string) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.SetBasicAuth("user", "pass")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code >= 300 {
+			t.Fatalf("%s %s: got %d", method, path, rr.Code)
+		}
+	}
+
+	unauthorized, err := http.Get(server.URL + eventsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unauthorized.Body.Close()
+	if unauthorized.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("GET /events without auth: got %d want %d", unauthorized.StatusCode, http.StatusUnauthorized)
+	}
+
+	res, stream := open(eventsPath, "")
+	do(http.MethodPut, "/c/team", "first")
+	teamRes, teamStream := open("/c/team"+eventsPath, "")
+	defer teamRes.Body.Close()
+	do(http.MethodPut, "/", "hello")
+	addedID, added := readEvent(t, stream)
+	if added.Type != historyEventAdded || added.Entry == nil || added.Entry.Preview != "hello" {
+		t.Fatalf("added event: %+v", added)
+	}
+	do(http.MethodDelete, historyPath+"/"+added.Entry.ID, "")
+	if _, deleted := readEvent(t, stream); deleted.Type != historyEventDeleted || deleted.Entry.ID != added.Entry.ID {
+		t.Fatalf("deleted event: %+v", deleted)
+	}
+	res.Body.Close()
+
+	// Reconnecting with the last event ID gives back the events missed in the meantime.
+	do(http.MethodPut, "/c/team", "team")
+	do(http.MethodDelete, historyPath, "")
+	res, stream = open(eventsPath, addedID)
+	defer res.Body.Close()
+	for _, want := range []string{historyEventDeleted, historyEventCleared} {
+		if _, ev := readEvent(t, stream); ev.Type != want {
+			t.Fatalf("resumed event: got %+v want %s", ev, want)
+		}
+	}
+	if _, ev := readEvent(t, teamStream); ev.Type != historyEventAdded || ev.Entry.Preview != "team" {
+		t.Fatalf("team event: %+v", ev)
+	}
+
+	// An ID given by a previous run of the server resets the client.
+	res, stream = open(eventsPath, "1-1")
+	defer res.Body.Close()
+	if _, ev := readEvent(t, stream); ev.Type != eventTypeReset {
+		t.Fatalf("event after an unknown ID: %+v", ev)
+	}
+}
+
+// readEvent reads a Server-Sent Event, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) (string, HistoryEvent) {
+	t.Helper()
+	var id, typ string
+	var ev HistoryEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if typ == "" {
+				continue
+			}
+			if ev.Type != typ {
+				t.Fatalf("event %q has data of type %q", typ, ev.Type)
+			}
+			return id, ev
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
@@ -1,11 +1,12 @@
 package commands
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"net/url"
 	"strconv"
 	"strings"
 	"text/tabwriter"
@@ -17,7 +18,16 @@ import (
 type historyRunner struct {
 	timeout    time.Duration
 	basicAuth  string
+	channel    string
+	token      string
+	tls        tlsClientOptions
 	jsonOutput bool
+	ttl        time.Duration
+	tag        string
+	tags       []string
+	note       string
+	regex      bool
+	ignoreCase bool
 
 	stdout io.Writer
 	stderr io.Writer
@@ -35,14 +45,66 @@ func NewHistoryCommand(stdout, stderr io.Writer) *cobra.Command {
 		Example: `  export PBGOPY_SERVER=http://host.xz:9090
   pbgopy history
   pbgopy history --json
+  pbgopy history --tag k8s
+  pbgopy history search "connection refused"
+  pbgopy history pin <entry-id>
+  pbgopy history touch <entry-id> --ttl 1h
+  pbgopy history edit <entry-id> --tag k8s --note "prod kubeconfig"
   pbgopy history delete <entry-id>
   pbgopy history clear`,
 		RunE: r.list,
 	}
 	cmd.PersistentFlags().DurationVar(&r.timeout, "timeout", 5*time.Second, "Time limit for requests")
 	cmd.PersistentFlags().StringVarP(&r.basicAuth, "basic-auth", "a", "", "Basic authentication, username:password")
+	r.tls.addFlags(cmd.PersistentFlags())
+	cmd.PersistentFlags().StringVar(&r.token, "token", "", "API token to authenticate with. Defaults to $PBGOPY_TOKEN")
+	cmd.PersistentFlags().StringVar(&r.channel, "channel", "", "Name of the channel to use. Defaults to $PBGOPY_CHANNEL, or the default channel if it is not set either")
 	cmd.Flags().BoolVar(&r.jsonOutput, "json", false, "Output history metadata as JSON")
+	cmd.Flags().StringVar(&r.tag, "tag", "", "List only the entries with the given tag")
 
+	search := &cobra.Command{
+		Use:   "search <query>",
+		Short: "List the history entries of which a line contains the query, or the tags or the note do",
+		Long: `List the history entries of which a line contains the query, or the tags or the note do.
+Only the data of plaintext text entries is searched. Entries encrypted or with --max-reads are found only by their tags and notes.
+The preview of an entry found by its data shows the first line that matches.`,
+		Args: cobra.ExactArgs(1),
+		RunE: r.search,
+	}
+	search.Flags().BoolVarP(&r.regex, "regexp", "E", false, "Take the query as a regular expression in the RE2 syntax")
+	search.Flags().BoolVarP(&r.ignoreCase, "ignore-case", "i", false, "Ignore case distinctions")
+	search.Flags().StringVar(&r.tag, "tag", "", "Search only the entries with the given tag")
+	search.Flags().BoolVar(&r.jsonOutput, "json", false, "Output history metadata as JSON")
+	cmd.AddCommand(search)
+	cmd.AddCommand(&cobra.Command{
+		Use:   "pin <entry-id>",
+		Short: "Keep a history entry regardless of the history limit and TTL",
+		Args:  cobra.ExactArgs(1),
+		RunE:  r.pin,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "unpin <entry-id>",
+		Short: "Let a pinned history entry be evicted and expire again",
+		Args:  cobra.ExactArgs(1),
+		RunE:  r.unpin,
+	})
+	touch := &cobra.Command{
+		Use:   "touch <entry-id>",
+		Short: "Make a history entry expire after the given TTL from now",
+		Args:  cobra.ExactArgs(1),
+		RunE:  r.touch,
+	}
+	touch.Flags().DurationVar(&r.ttl, "ttl", 0, "How long the server keeps the entry from now on. Up to the max TTL of the server. The default TTL of the server if not given")
+	cmd.AddCommand(touch)
+	edit := &cobra.Command{
+		Use:   "edit <entry-id>",
+		Short: "Change the tags and the note of a history entry",
+		Args:  cobra.ExactArgs(1),
+		RunE:  r.edit,
+	}
+	edit.Flags().StringSliceVar(&r.tags, "tag", nil, "Tag to replace the tags of the entry with. Can be given multiple times. Give an empty one to remove them all")
+	edit.Flags().StringVar(&r.note, "note", "", "Note to replace the note of the entry with. Give an empty one to remove it")
+	cmd.AddCommand(edit)
 	cmd.AddCommand(&cobra.Command{
 		Use:   "delete <entry-id>",
 		Short: "Delete a history entry",
@@ -59,12 +121,40 @@ func NewHistoryCommand(stdout, stderr io.Writer) *cobra.Command {
 }
 
 func (r *historyRunner) list(_ *cobra.Command, _ []string) error {
-	address := os.Getenv(pbgopyServerEnv)
-	if address == "" {
-		return fmt.Errorf("put the pbgopy server's address into %s environment variable", pbgopyServerEnv)
+	return r.listWith(url.Values{}, true)
+}
+
+func (r *historyRunner) search(_ *cobra.Command, args []string) error {
+	if args[0] == "" {
+		return fmt.Errorf("the query must not be empty")
+	}
+	query := url.Values{historySearchQuery: {args[0]}}
+	if r.regex {
+		query.Set(historyRegexpQuery, "true")
 	}
+	if r.ignoreCase {
+		query.Set(historyIgnoreCaseQuery, "true")
+	}
+	// The preview shows what matched instead of the note.
+	return r.listWith(query, false)
+}
 
-	res, err := r.do(http.MethodGet, historyURL(address))
+// listWith prints the entries given by the history API for the query, narrowed down to those with r.tag if it is set.
+// notes reports whether to show the notes of the entries in place of their previews.
+func (r *historyRunner) listWith(query url.Values, notes bool) error {
+	address, err := serverAddress(r.channel)
+	if err != nil {
+		return err
+	}
+
+	if r.tag != "" {
+		query.Set(historyTagQuery, r.tag)
+	}
+	reqURL := historyURL(address)
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+	res, err := r.do(http.MethodGet, reqURL, nil)
 	if err != nil {
 		return err
 	}
@@ -82,16 +172,82 @@ func (r *historyRunner) list(_ *cobra.Command, _ []string) error {
 		enc := json.NewEncoder(r.stdout)
 		return enc.Encode(entries)
 	}
-	return writeHistoryTable(r.stdout, entries, time.Now())
+	return writeHistoryTable(r.stdout, entries, time.Now(), notes)
+}
+
+func (r *historyRunner) pin(_ *cobra.Command, args []string) error {
+	pinned := true
+	return r.update(args[0], HistoryPatch{Pinned: &pinned})
+}
+
+func (r *historyRunner) unpin(_ *cobra.Command, args []string) error {
+	pinned := false
+	return r.update(args[0], HistoryPatch{Pinned: &pinned})
+}
+
+func (r *historyRunner) touch(_ *cobra.Command, args []string) error {
+	if r.ttl < 0 {
+		return fmt.Errorf("ttl must be greater than or equal to 0")
+	}
+	ttl := jsonDuration(r.ttl)
+	return r.update(args[0], HistoryPatch{TTL: &ttl})
+}
+
+func (r *historyRunner) edit(cmd *cobra.Command, args []string) error {
+	var patch HistoryPatch
+	if cmd.Flags().Changed("tag") {
+		tags := make([]string, 0, len(r.tags))
+		for _, tag := range r.tags {
+			if tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		if err := validateHistoryTags(tags); err != nil {
+			return err
+		}
+		patch.Tags = &tags
+	}
+	if cmd.Flags().Changed("note") {
+		if err := validateHistoryNote(r.note); err != nil {
+			return err
+		}
+		patch.Note = &r.note
+	}
+	if patch.Tags == nil && patch.Note == nil {
+		return fmt.Errorf("specify --tag or --note to change")
+	}
+	return r.update(args[0], patch)
+}
+
+// update applies the patch to the entry with the given id.
+func (r *historyRunner) update(id string, patch HistoryPatch) error {
+	address, err := serverAddress(r.channel)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return fmt.Errorf("failed to encode the patch: %w", err)
+	}
+
+	res, err := r.do(http.MethodPatch, historyEntryURL(address, id), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return failedRequestError(res)
+	}
+	return nil
 }
 
 func (r *historyRunner) delete(_ *cobra.Command, args []string) error {
-	address := os.Getenv(pbgopyServerEnv)
-	if address == "" {
-		return fmt.Errorf("put the pbgopy server's address into %s environment variable", pbgopyServerEnv)
+	address, err := serverAddress(r.channel)
+	if err != nil {
+		return err
 	}
 
-	res, err := r.do(http.MethodDelete, historyEntryURL(address, args[0]))
+	res, err := r.do(http.MethodDelete, historyEntryURL(address, args[0]), nil)
 	if err != nil {
 		return err
 	}
@@ -103,12 +259,12 @@ func (r *historyRunner) delete(_ *cobra.Command, args []string) error {
 }
 
 func (r *historyRunner) clear(_ *cobra.Command, _ []string) error {
-	address := os.Getenv(pbgopyServerEnv)
-	if address == "" {
-		return fmt.Errorf("put the pbgopy server's address into %s environment variable", pbgopyServerEnv)
+	address, err := serverAddress(r.channel)
+	if err != nil {
+		return err
 	}
 
-	res, err := r.do(http.MethodDelete, historyURL(address))
+	res, err := r.do(http.MethodDelete, historyURL(address), nil)
 	if err != nil {
 		return err
 	}
@@ -119,31 +275,38 @@ func (r *historyRunner) clear(_ *cobra.Command, _ []string) error {
 	return nil
 }
 
-func (r *historyRunner) do(method, url string) (*http.Response, error) {
-	req, err := http.NewRequest(method, url, nil)
+func (r *historyRunner) do(method, url string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make request: %w", err)
 	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 	addBasicAuthHeader(req, r.basicAuth)
-	res, err := r.httpClient().Do(req)
+	addTokenHeader(req, r.token)
+	client, err := r.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to issue request: %w", err)
 	}
 	return res, nil
 }
 
-func (r *historyRunner) httpClient() *http.Client {
+func (r *historyRunner) httpClient() (*http.Client, error) {
 	if r.client != nil {
-		return r.client
-	}
-	return &http.Client{
-		Timeout: r.timeout,
+		return r.client, nil
 	}
+	return newHTTPClient(r.timeout, r.tls)
 }
 
-func writeHistoryTable(w io.Writer, entries []HistoryEntry, now time.Time) error {
+// writeHistoryTable writes the entries as a table. If notes is true, the note of an entry is shown in place of its preview.
+func writeHistoryTable(w io.Writer, entries []HistoryEntry, now time.Time, notes bool) error {
 	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
-	if _, err := fmt.Fprintln(tw, "ID\tAGE\tTYPE\tSIZE\tLATEST\tPREVIEW"); err != nil {
+	if _, err := fmt.Fprintln(tw, "ID\tAGE\tTTL\tTYPE\tSIZE\tLATEST\tPINNED\tTAGS\tPREVIEW"); err != nil {
 		return err
 	}
 	for _, entry := range entries {
@@ -151,18 +314,29 @@ func writeHistoryTable(w io.Writer, entries []HistoryEntry, now time.Time) error
 		if entry.Latest {
 			latest = "*"
 		}
+		pinned := ""
+		if entry.Pinned {
+			pinned = "*"
+		}
+		// The note describes the entry better than the head of its body.
 		preview := entry.Preview
-		if entry.Kind == historyKindText {
+		switch {
+		case notes && entry.Note != "":
+			preview = strconv.Quote(entry.Note)
+		case entry.Kind == historyKindText:
 			preview = strconv.Quote(preview)
 		}
 		if _, err := fmt.Fprintf(
 			tw,
-			"%s\t%s\t%s\t%s\t%s\t%s\n",
+			"%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
 			entry.ID,
 			formatHistoryAge(now.Sub(entry.CreatedAt)),
+			formatHistoryTTL(entry, now),
 			historyDisplayType(entry),
 			formatHistorySize(entry.Size),
 			latest,
+			pinned,
+			strings.Join(entry.Tags, ","),
 			preview,
 		); err != nil {
 			return err
@@ -173,7 +347,12 @@ func writeHistoryTable(w io.Writer, entries []HistoryEntry, now time.Time) error
 
 func historyDisplayType(entry HistoryEntry) string {
 	switch entry.Kind {
-	case historyKindEncrypted, historyKindBinary, historyKindUnknown:
+	case historyKindEncrypted:
+		if entry.MIME != "" && entry.MIME != "application/octet-stream" {
+			return entry.Kind + " " + entry.MIME
+		}
+		return entry.Kind
+	case historyKindBinary, historyKindUnknown:
 		return entry.Kind
 	}
 	if entry.MIME != "" {
@@ -185,6 +364,14 @@ func historyDisplayType(entry HistoryEntry) string {
 	return historyKindUnknown
 }
 
+// formatHistoryTTL gives back the remaining lifetime of the entry, or "-" if it doesn't expire.
+func formatHistoryTTL(entry HistoryEntry, now time.Time) string {
+	if entry.ExpiresAt == nil || entry.Pinned {
+		return "-"
+	}
+	return formatHistoryAge(entry.ExpiresAt.Sub(now))
+}
+
 func formatHistoryAge(d time.Duration) string {
 	if d < 0 {
 		d = 0
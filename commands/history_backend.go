@@ -0,0 +1,49 @@
+package commands
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	// ErrHistoryNotFound is returned by a HistoryBackend when the requested entry doesn't exist or has expired.
+	ErrHistoryNotFound = errors.New("history entry not found")
+	// ErrHistoryTooLarge is returned by a HistoryBackend when a body can't fit in the total size budget on its own.
+	ErrHistoryTooLarge = errors.New("history entry is larger than the total size budget")
+)
+
+// HistoryBackend is a storage of the clipboard history.
+// Entries are ordered newest first, and the newest one is what a paste without id gives back.
+// Implementations must be safe for concurrent use, and are responsible for
+// applying their retention policy, such as TTL, the history limit and the total size budget.
+// See testHistoryBackend for the behavior every backend is expected to satisfy.
+type HistoryBackend interface {
+	// Add stores the body of the given upload as the newest entry.
+	// The backend may take over the temporary file of the upload instead of copying it.
+	Add(upload *HistoryUpload) (HistoryEntry, error)
+	// List gives back the metadata of all entries.
+	List() ([]HistoryEntry, error)
+	// Get gives back the entry with the given id along with a reader of its body, which the caller must close.
+	Get(id string) (HistoryEntry, io.ReadSeekCloser, error)
+	// Read is the same as Get, except that it counts a read of the entry if it has a read limit.
+	// The entry is deleted by the read that reaches the limit, atomically, so that no more reads than the limit
+	// succeed however many clients read it at once. The body given back stays readable even so.
+	Read(id string) (HistoryEntry, io.ReadSeekCloser, error)
+	// Latest gives back the newest entry along with a reader of its body, which the caller must close.
+	Latest() (HistoryEntry, io.ReadSeekCloser, error)
+	// Update applies the patch to the metadata of the entry with the given id, and gives back the updated entry.
+	Update(id string, patch HistoryPatch) (HistoryEntry, error)
+	// Delete removes the entry with the given id.
+	Delete(id string) error
+	// Clear removes all entries.
+	Clear() error
+	// Range calls fn for each entry in order until fn returns false.
+	Range(fn func(HistoryEntry) bool) error
+	// PruneExpired drops the entries whose TTL has passed. Backends may prune lazily otherwise,
+	// so this is called periodically to report expiry without waiting for the next access.
+	PruneExpired() error
+	// Observe registers fn to be called with every change made through the backend, in order.
+	// Changes made by others sharing the storage, such as other servers sharing a Redis server, aren't observed.
+	// fn must not block, since it may be called while the backend holds a lock.
+	Observe(fn func(HistoryEvent))
+}
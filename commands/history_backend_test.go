@@ -0,0 +1,777 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nakabonne/pbgopy/cache/rediscache"
+	"github.com/nakabonne/pbgopy/cache/rediscache/redistest"
+)
+
+// historyBackendFactory creates an empty backend with the given retention policy.
+// The backend must use now as its clock to decide whether an entry has expired.
+type historyBackendFactory func(t *testing.T, policy historyPolicy, now func() time.Time) HistoryBackend
+
+// testHistoryBackend is the conformance suite every HistoryBackend must pass.
+func testHistoryBackend(t *testing.T, newBackend historyBackendFactory) {
+	t.Run("Empty", func(t *testing.T) {
+		b := newBackend(t, historyPolicy{limit: 3}, time.Now)
+		entries, err := b.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Fatalf("entries of empty backend: %+v", entries)
+		}
+		if _, _, err := readHistory(b.Latest()); !errors.Is(err, ErrHistoryNotFound) {
+			t.Fatalf("Latest of empty backend: got %v want %v", err, ErrHistoryNotFound)
+		}
+		if _, _, err := readHistory(b.Get("missing")); !errors.Is(err, ErrHistoryNotFound) {
+			t.Fatalf("Get of missing entry: got %v want %v", err, ErrHistoryNotFound)
+		}
+		if err := b.Delete("missing"); !errors.Is(err, ErrHistoryNotFound) {
+			t.Fatalf("Delete of missing entry: got %v want %v", err, ErrHistoryNotFound)
+		}
+		if err := b.Clear(); err != nil {
+			t.Fatalf("Clear of empty backend: %v", err)
+		}
+	})
+
+	t.Run("AddAndGet", func(t *testing.T) {
+		b := newBackend(t, historyPolicy{limit: 3}, time.Now)
+		body := []byte{0x00, 0xff, 0x10, 0x20}
+		added, err := b.Add(newTestUpload(t, body, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added.ID == "" || !added.Latest || added.Size != len(body) || added.Kind != historyKindBinary {
+			t.Fatalf("added entry: %+v", added)
+		}
+		if added.SHA256 != newHistoryEntry("", time.Time{}, body, false).SHA256 {
+			t.Fatalf("sha256: got %s", added.SHA256)
+		}
+
+		entry, got, err := readHistory(b.Get(added.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Fatalf("body: got %v want %v", got, body)
+		}
+		if entry.ID != added.ID || entry.SHA256 != added.SHA256 || !entry.CreatedAt.Equal(added.CreatedAt) || !entry.Latest {
+			t.Fatalf("entry: got %+v want %+v", entry, added)
+		}
+
+		// Mutating the given body must not affect what is stored.
+		got[0] = 0x01
+		if _, again, _ := readHistory(b.Get(added.ID)); !bytes.Equal(again, body) {
+			t.Fatalf("stored body was mutated: %v", again)
+		}
+	})
+
+	t.Run("LargeBody", func(t *testing.T) {
+		b := newBackend(t, historyPolicy{limit: 3}, time.Now)
+		// Larger than what an upload keeps in memory, and than a single chunk of any backend.
+		body := []byte(strings.Repeat("a line of text\n", 3*uploadMemoryLimit/15))
+		added, err := b.Add(newTestUpload(t, body, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := newHistoryEntry(added.ID, added.CreatedAt, body, false)
+		if added.Size != len(body) || added.SHA256 != want.SHA256 || added.Kind != historyKindText || added.Preview != want.Preview {
+			t.Fatalf("added entry: got %+v want %+v", added, want)
+		}
+
+		_, r, err := b.Latest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if n, err := r.Seek(0, io.SeekEnd); err != nil || n != int64(len(body)) {
+			t.Fatalf("seek to end: got %d err %v", n, err)
+		}
+		if _, err := r.Seek(int64(len(body))-5, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		tail, err := io.ReadAll(r)
+		if err != nil || string(tail) != "text\n" {
+			t.Fatalf("tail: got %q err %v", tail, err)
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Fatalf("body of %d bytes differs from the given one of %d bytes", len(got), len(body))
+		}
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		b := newBackend(t, historyPolicy{limit: 3}, time.Now)
+		added, err := b.Add(newTestUpload(t, []byte("secret plaintext"), true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added.Kind != historyKindEncrypted {
+			t.Fatalf("kind: got %q want %q", added.Kind, historyKindEncrypted)
+		}
+	})
+
+	t.Run("NewestFirst", func(t *testing.T) {
+		b := newBackend(t, historyPolicy{}, time.Now)
+		for i := 0; i < 5; i++ {
+			if _, err := b.Add(newTestUpload(t, []byte(fmt.Sprintf("body-%d", i)), false)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, err := b.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 5 {
+			t.Fatalf("history length: got %d want 5", len(entries))
+		}
+		for i, entry := range entries {
+			if want := fmt.Sprintf("body-%d", 4-i); entry.Preview != want {
+				t.Fatalf("entry %d: got %q want %q", i, entry.Preview, want)
+			}
+			if entry.Latest != (i == 0) {
+				t.Fatalf("entry %d: latest is %v", i, entry.Latest)
+			}
+		}
+		latest, body, err := readHistory(b.Latest())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if latest.ID != entries[0].ID || string(body) != "body-4" || !latest.Latest {
+			t.Fatalf("latest: %+v body %q", latest, body)
+		}
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		b := newBackend(t, historyPolicy{limit: 2}, time.Now)
+		first, err := b.Add(newTestUpload(t, []byte("first"), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, body := range []string{"second", "third"} {
+			if _, err := b.Add(newTestUpload(t, []byte(body), false)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, err := b.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].Preview != "third" || entries[1].Preview != "second" {
+			t.Fatalf("history over limit: %+v", entries)
+		}
+		if _, _, err := readHistory(b.Get(first.ID)); !errors.Is(err, ErrHistoryNotFound) {
+			t.Fatalf("evicted entry: got %v want %v", err, ErrHistoryNotFound)
+		}
+	})
+
+	t.Run("TotalSize", func(t *testing.T) {
+		b := newBackend(t, historyPolicy{maxTotalSize: 10}, time.Now)
+		first, err := b.Add(newTestUpload(t, []byte("1111"), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, body := range []string{"2222", "3333"} {
+			if _, err := b.Add(newTestUpload(t, []byte(body), false)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, err := b.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].Preview != "3333" || entries[1].Preview != "2222" {
+			t.Fatalf("history over the total size: %+v", entries)
+		}
+		if _, _, err := readHistory(b.Get(first.ID)); !errors.Is(err, ErrHistoryNotFound) {
+			t.Fatalf("evicted entry: got %v want %v", err, ErrHistoryNotFound)
+		}
+
+		if _, err := b.Add(newTestUpload(t, []byte("too large body"), false)); !errors.Is(err, ErrHistoryTooLarge) {
+			t.Fatalf("Add of too large body: got %v want %v", err, ErrHistoryTooLarge)
+		}
+		if entries, err := b.List(); err != nil || len(entries) != 2 {
+			t.Fatalf("history after rejected add: %+v err %v", entries, err)
+		}
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		now := time.Now()
+		var mu sync.Mutex
+		clock := func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		}
+		b := newBackend(t, historyPolicy{ttl: time.Minute}, clock)
+		old, err := b.Add(newTestUpload(t, []byte("old"), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		now = now.Add(30 * time.Second)
+		mu.Unlock()
+		if _, err := b.Add(newTestUpload(t, []byte("new"), false)); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		now = now.Add(45 * time.Second)
+		mu.Unlock()
+
+		entries, err := b.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Preview != "new" || !entries[0].Latest {
+			t.Fatalf("history after expiration: %+v", entries)
+		}
+		if _, _, err := readHistory(b.Get(old.ID)); !errors.Is(err, ErrHistoryNotFound) {
+			t.Fatalf("expired entry: got %v want %v", err, ErrHistoryNotFound)
+		}
+
+		mu.Lock()
+		now = now.Add(time.Minute)
+		mu.Unlock()
+		if _, _, err := readHistory(b.Latest()); !errors.Is(err, ErrHistoryNotFound) {
+			t.Fatalf("Latest after expiration: got %v want %v", err, ErrHistoryNotFound)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		b := newBackend(t, historyPolicy{limit: 3}, time.Now)
+		if _, err := b.Add(newTestUpload(t, []byte("old"), false)); err != nil {
+			t.Fatal(err)
+		}
+		added, err := b.Add(newTestUpload(t, []byte("new"), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Delete(added.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := readHistory(b.Get(added.ID)); !errors.Is(err, ErrHistoryNotFound) {
+			t.Fatalf("deleted entry: got %v want %v", err, ErrHistoryNotFound)
+		}
+		latest, body, err := readHistory(b.Latest())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "old" || !latest.Latest {
+			t.Fatalf("latest after delete: %+v body %q", latest, body)
+		}
+		if err := b.Delete(added.ID); !errors.Is(err, ErrHistoryNotFound) {
+			t.Fatalf("second delete: got %v want %v", err, ErrHistoryNotFound)
+		}
+	})
+
+	t.Run("Clear", func(t *testing.T) {
+		b := newBackend(t, historyPolicy{limit: 3}, time.Now)
+		for _, body := range []string{"first", "second"} {
+			if _, err := b.Add(newTestUpload(t, []byte(body), false)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Clear(); err != nil {
+			t.Fatal(err)
+		}
+		if entries, err := b.List(); err != nil || len(entries) != 0 {
+			t.Fatalf("history after clear: %+v err %v", entries, err)
+		}
+		if _, _, err := readHistory(b.Latest()); !errors.Is(err, ErrHistoryNotFound) {
+			t.Fatalf("Latest after clear: got %v want %v", err, ErrHistoryNotFound)
+		}
+		if _, err := b.Add(newTestUpload(t, []byte("third"), false)); err != nil {
+			t.Fatal(err)
+		}
+		if _, body, err := readHistory(b.Latest()); err != nil || string(body) != "third" {
+			t.Fatalf("Latest after re-adding: body %q err %v", body, err)
+		}
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		b := newBackend(t, historyPolicy{}, time.Now)
+		for _, body := range []string{"first", "second", "third"} {
+			if _, err := b.Add(newTestUpload(t, []byte(body), false)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var previews []string
+		err := b.Range(func(entry HistoryEntry) bool {
+			previews = append(previews, entry.Preview)
+			// Backends must allow calling themselves from fn.
+			if _, _, err := readHistory(b.Get(entry.ID)); err != nil {
+				t.Errorf("Get from Range: %v", err)
+			}
+			return len(previews) < 2
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(previews) != 2 || previews[0] != "third" || previews[1] != "second" {
+			t.Fatalf("ranged entries: %v", previews)
+		}
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		now := time.Now()
+		var mu sync.Mutex
+		clock := func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		}
+		b := newBackend(t, historyPolicy{limit: 2, ttl: time.Minute}, clock)
+		var events []string
+		b.Observe(func(ev HistoryEvent) {
+			if ev.Entry == nil {
+				events = append(events, ev.Type)
+				return
+			}
+			events = append(events, ev.Type+" "+ev.Entry.Preview)
+		})
+
+		var second HistoryEntry
+		for _, body := range []string{"first", "second", "third"} {
+			added, err := b.Add(newTestUpload(t, []byte(body), false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body == "second" {
+				second = added
+			}
+		}
+		if err := b.Delete(second.ID); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		now = now.Add(2 * time.Minute)
+		mu.Unlock()
+		if err := b.PruneExpired(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Add(newTestUpload(t, []byte("fourth"), false)); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Clear(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"added first", "added second", "added third", "evicted first", "deleted second", "expired third", "added fourth", "cleared"}
+		if strings.Join(events, ", ") != strings.Join(want, ", ") {
+			t.Fatalf("events: got %q want %q", events, want)
+		}
+	})
+
+	t.Run("Pin", func(t *testing.T) {
+		now := time.Now()
+		var mu sync.Mutex
+		clock := func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		}
+		b := newBackend(t, historyPolicy{limit: 2, ttl: time.Minute}, clock)
+		pinned, err := b.Add(newTestUpload(t, []byte("pinned"), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		yes, no := true, false
+		updated, err := b.Update(pinned.ID, HistoryPatch{Pinned: &yes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !updated.Pinned || updated.ID != pinned.ID || !updated.Latest {
+			t.Fatalf("pinned entry: %+v", updated)
+		}
+		for _, body := range []string{"1", "2", "3"} {
+			if _, err := b.Add(newTestUpload(t, []byte(body), false)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, err := b.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 3 || entries[0].Preview != "3" || entries[1].Preview != "2" || entries[2].ID != pinned.ID {
+			t.Fatalf("history over the limit with a pinned entry: %+v", entries)
+		}
+
+		mu.Lock()
+		now = now.Add(2 * time.Minute)
+		mu.Unlock()
+		if _, body, err := readHistory(b.Latest()); err != nil || string(body) != "pinned" {
+			t.Fatalf("pinned entry after the TTL: %q err %v", body, err)
+		}
+		// Unpinned, it expires right away.
+		if _, err := b.Update(pinned.ID, HistoryPatch{Pinned: &no}); err != nil {
+			t.Fatal(err)
+		}
+		if entries, err := b.List(); err != nil || len(entries) != 0 {
+			t.Fatalf("history after unpinning an expired entry: %+v err %v", entries, err)
+		}
+		if _, err := b.Update(pinned.ID, HistoryPatch{Pinned: &yes}); !errors.Is(err, ErrHistoryNotFound) {
+			t.Fatalf("Update of missing entry: got %v want %v", err, ErrHistoryNotFound)
+		}
+	})
+
+	t.Run("EntryTTL", func(t *testing.T) {
+		now := time.Now()
+		var mu sync.Mutex
+		clock := func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		}
+		b := newBackend(t, historyPolicy{ttl: time.Hour, maxTTL: 10 * time.Minute}, clock)
+		add := func(body string, ttl time.Duration) HistoryEntry {
+			t.Helper()
+			upload := newTestUpload(t, []byte(body), false)
+			upload.TTL = ttl
+			added, err := b.Add(upload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return added
+		}
+		for _, tc := range []struct {
+			entry HistoryEntry
+			want  time.Duration
+		}{
+			{add("default", 0), time.Hour},
+			{add("capped", 24*time.Hour), 10 * time.Minute},
+			{add("short", time.Minute), time.Minute},
+		} {
+			if tc.entry.ExpiresAt == nil || !tc.entry.ExpiresAt.Equal(now.Add(tc.want)) {
+				t.Fatalf("%s: expires at %v want %v later", tc.entry.Preview, tc.entry.ExpiresAt, tc.want)
+			}
+		}
+
+		mu.Lock()
+		now = now.Add(2 * time.Minute)
+		mu.Unlock()
+		entries, err := b.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].Preview != "capped" {
+			t.Fatalf("history after the short TTL: %+v", entries)
+		}
+		ttl := jsonDuration(5 * time.Minute)
+		touched, err := b.Update(entries[1].ID, HistoryPatch{TTL: &ttl})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if touched.ExpiresAt == nil || !touched.ExpiresAt.Equal(now.Add(5*time.Minute)) {
+			t.Fatalf("touched entry expires at %v", touched.ExpiresAt)
+		}
+		mu.Lock()
+		now = now.Add(9 * time.Minute)
+		mu.Unlock()
+		if entries, err := b.List(); err != nil || len(entries) != 0 {
+			t.Fatalf("history after the touched TTL: %+v err %v", entries, err)
+		}
+
+		// An entry can expire even if the others are kept forever.
+		b = newBackend(t, historyPolicy{}, clock)
+		add("forever", 0)
+		add("short", time.Minute)
+		mu.Lock()
+		now = now.Add(2 * time.Minute)
+		mu.Unlock()
+		if err := b.PruneExpired(); err != nil {
+			t.Fatal(err)
+		}
+		if entries, err := b.List(); err != nil || len(entries) != 1 || entries[0].Preview != "forever" || entries[0].ExpiresAt != nil {
+			t.Fatalf("history without the default TTL: %+v err %v", entries, err)
+		}
+	})
+
+	t.Run("MaxReads", func(t *testing.T) {
+		b := newBackend(t, historyPolicy{limit: 3}, time.Now)
+		if _, err := b.Add(newTestUpload(t, []byte("older"), false)); err != nil {
+			t.Fatal(err)
+		}
+		upload := newTestUpload(t, []byte("secret"), false)
+		upload.MaxReads = 3
+		added, err := b.Add(upload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added.ReadsLeft == nil || *added.ReadsLeft != 3 {
+			t.Fatalf("added entry: %+v", added)
+		}
+		// The metadata, which can be read without counting, reveals nothing of the body.
+		listed, err := b.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := json.Marshal(append(listed, added)); bytes.Contains(data, []byte("secret")) {
+			t.Fatalf("the metadata contains the body: %s", data)
+		}
+		// Neither getting nor listing counts.
+		if _, _, err := readHistory(b.Get(added.ID)); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := readHistory(b.Latest()); err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			wg    sync.WaitGroup
+			mu    sync.Mutex
+			reads []int
+		)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				entry, body, err := readHistory(b.Read(added.ID))
+				if errors.Is(err, ErrHistoryNotFound) {
+					return
+				}
+				if err != nil || string(body) != "secret" {
+					t.Errorf("read: %q err %v", body, err)
+					return
+				}
+				mu.Lock()
+				reads = append(reads, *entry.ReadsLeft)
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		if len(reads) != 3 {
+			t.Fatalf("successful reads: got %d want 3", len(reads))
+		}
+		if _, _, err := readHistory(b.Get(added.ID)); !errors.Is(err, ErrHistoryNotFound) {
+			t.Fatalf("entry read up: got %v want %v", err, ErrHistoryNotFound)
+		}
+		entries, err := b.List()
+		if err != nil || len(entries) != 1 || entries[0].Preview != "older" || !entries[0].Latest {
+			t.Fatalf("history after the entry is read up: %+v err %v", entries, err)
+		}
+		// Entries without a read limit are read as many times as asked.
+		for i := 0; i < 3; i++ {
+			if entry, _, err := readHistory(b.Read(entries[0].ID)); err != nil || entry.ReadsLeft != nil {
+				t.Fatalf("read of an entry without a limit: %+v err %v", entry, err)
+			}
+		}
+	})
+
+	t.Run("Share", func(t *testing.T) {
+		b := newBackend(t, historyPolicy{limit: 3, dedup: historyDedupShare}, time.Now)
+		var ids []string
+		for _, body := range []string{"same", "other", "same"} {
+			added, err := b.Add(newTestUpload(t, []byte(body), false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, added.ID)
+		}
+		if entries, err := b.List(); err != nil || len(entries) != 3 || ids[0] == ids[2] {
+			t.Fatalf("every copy is an entry of its own: %+v err %v", entries, err)
+		}
+		// The body is still there for the other entry sharing it.
+		if err := b.Delete(ids[2]); err != nil {
+			t.Fatal(err)
+		}
+		if _, body, err := readHistory(b.Get(ids[0])); err != nil || string(body) != "same" {
+			t.Fatalf("body of the entry sharing it with a deleted one: %q err %v", body, err)
+		}
+	})
+
+	t.Run("Collapse", func(t *testing.T) {
+		now := time.Now()
+		var mu sync.Mutex
+		clock := func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		}
+		b := newBackend(t, historyPolicy{limit: 3, ttl: time.Minute, dedup: historyDedupCollapse}, clock)
+		var events []HistoryEvent
+		b.Observe(func(ev HistoryEvent) {
+			events = append(events, ev)
+		})
+		first, err := b.Add(newTestUpload(t, []byte("same"), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Add(newTestUpload(t, []byte("other"), false)); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		now = now.Add(45 * time.Second)
+		mu.Unlock()
+		again, err := b.Add(newTestUpload(t, []byte("same"), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.ID != first.ID || !again.Latest || !again.CreatedAt.After(first.CreatedAt) {
+			t.Fatalf("collapsed entry: got %+v first %+v", again, first)
+		}
+		entries, err := b.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].ID != first.ID || entries[1].Preview != "other" {
+			t.Fatalf("history after collapse: %+v", entries)
+		}
+		if len(events) != 3 || events[2].Type != historyEventAdded || events[2].Entry.ID != first.ID {
+			t.Fatalf("events: %+v", events)
+		}
+
+		// The TTL starts over as well.
+		mu.Lock()
+		now = now.Add(30 * time.Second)
+		mu.Unlock()
+		if _, body, err := readHistory(b.Latest()); err != nil || string(body) != "same" {
+			t.Fatalf("collapsed entry after the first TTL: %q err %v", body, err)
+		}
+	})
+
+	t.Run("Tags", func(t *testing.T) {
+		b := newBackend(t, historyPolicy{limit: 3, dedup: historyDedupCollapse}, time.Now)
+		upload := newTestUpload(t, []byte("kubeconfig"), false)
+		upload.Tags = []string{"k8s", "prod", "k8s"}
+		upload.Note = "prod kubeconfig"
+		entry, err := b.Add(upload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(entry.Tags, []string{"k8s", "prod"}) || entry.Note != "prod kubeconfig" {
+			t.Fatalf("added entry: %+v", entry)
+		}
+
+		// A copy of the same body without its own tags and note keeps those of the entry collapsed into it.
+		entry, err = b.Add(newTestUpload(t, []byte("kubeconfig"), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !entry.HasTag("prod") || entry.Note != "prod kubeconfig" {
+			t.Fatalf("collapsed entry: %+v", entry)
+		}
+
+		tags := []string{"staging"}
+		note := ""
+		if _, err := b.Update(entry.ID, HistoryPatch{Tags: &tags, Note: &note}); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := b.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || !reflect.DeepEqual(entries[0].Tags, tags) || entries[0].Note != "" {
+			t.Fatalf("history after the tags are changed: %+v", entries)
+		}
+		tags = nil
+		if entry, err = b.Update(entry.ID, HistoryPatch{Tags: &tags}); err != nil || entry.Tags != nil {
+			t.Fatalf("entry after the tags are removed: %+v err %v", entry, err)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		b := newBackend(t, historyPolicy{limit: 5}, time.Now)
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if _, err := b.Add(newTestUpload(t, []byte(fmt.Sprintf("body-%d", i)), false)); err != nil {
+					t.Error(err)
+				}
+				if _, err := b.List(); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		entries, err := b.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 5 {
+			t.Fatalf("history length: got %d want 5", len(entries))
+		}
+	})
+}
+
+func TestHistoryStoreConformance(t *testing.T) {
+	testHistoryBackend(t, func(t *testing.T, policy historyPolicy, now func() time.Time) HistoryBackend {
+		s := newHistoryStore(policy)
+		s.now = now
+		return s
+	})
+}
+
+func TestDiskHistoryStoreConformance(t *testing.T) {
+	testHistoryBackend(t, func(t *testing.T, policy historyPolicy, now func() time.Time) HistoryBackend {
+		s, err := openHistoryStore(t.TempDir(), policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.now = now
+		return s
+	})
+}
+
+func TestRedisHistoryStoreConformance(t *testing.T) {
+	testHistoryBackend(t, func(t *testing.T, policy historyPolicy, now func() time.Time) HistoryBackend {
+		s := newRedisHistoryStore(newTestRedisClient(t), "pbgopy:history:", policy)
+		s.now = now
+		return s
+	})
+}
+
+func newTestRedisClient(t *testing.T) *rediscache.Client {
+	t.Helper()
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	client, err := rediscache.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newTestUpload spools the given body as an upload that is closed when the test finishes.
+func newTestUpload(t *testing.T, body []byte, encrypted bool) *HistoryUpload {
+	t.Helper()
+	upload, err := spoolUpload(bytes.NewReader(body), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { upload.Close() })
+	upload.Encrypted = encrypted
+	return upload
+}
+
+// readHistory reads up and closes the body given back by Get or Latest of a HistoryBackend.
+func readHistory(entry HistoryEntry, body io.ReadSeekCloser, err error) (HistoryEntry, []byte, error) {
+	if err != nil {
+		return entry, nil, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	return entry, data, err
+}
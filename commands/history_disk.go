@@ -0,0 +1,321 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	historyIndexFile = "index.json"
+	historyBodiesDir = "bodies"
+	// historyTmpDir is where uploads are spooled, so that they can be renamed into bodies.
+	historyTmpDir = "tmp"
+)
+
+// historyIndex is the on-disk representation of the history metadata.
+type historyIndex struct {
+	Entries []historyRecord `json:"entries"`
+}
+
+type historyRecord struct {
+	HistoryEntry
+	// Body is the name of the body file if it isn't the id, that is, if the body may be shared with other entries.
+	Body string `json:"body,omitempty"`
+}
+
+// openHistoryStore gives back a history store persisted under the given directory.
+// Entries left by a previous run are loaded; records whose body is missing or
+// corrupted, for instance after a crash, are dropped.
+func openHistoryStore(dir string, policy historyPolicy) (*historyStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, historyBodiesDir), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	// Uploads left in the middle of a previous run are never going to be completed.
+	if err := os.RemoveAll(filepath.Join(dir, historyTmpDir)); err != nil {
+		return nil, fmt.Errorf("failed to clean up temporary files: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, historyTmpDir), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	s := newHistoryStore(policy)
+	s.dir = dir
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *historyStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(s.dir, historyIndexFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read history index: %w", err)
+	}
+	records, err := decodeHistoryIndex(data)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]*historyItem, 0, len(records))
+	// A shared body is hashed once, and loaded as a single blob.
+	type loadedBody struct {
+		blob *historyBlob
+		sha  string
+		err  error
+	}
+	bodies := make(map[string]*loadedBody)
+	for _, item := range records {
+		path := s.bodyPath(item.bodyName())
+		body, ok := bodies[path]
+		if !ok {
+			sha, err := hashFile(path)
+			body = &loadedBody{blob: &historyBlob{path: path}, sha: sha, err: err}
+			bodies[path] = body
+		}
+		if body.err != nil {
+			log.Printf("Drop history entry %s: %v\n", item.ID, body.err)
+			continue
+		}
+		if body.sha != item.SHA256 {
+			log.Printf("Drop history entry %s: the body is corrupted\n", item.ID)
+			continue
+		}
+		blob := body.blob
+		blob.refs++
+		item.blob = blob
+		entries = append(entries, item)
+	}
+	s.entries = entries
+	s.pruneExpiredLocked(s.now())
+	entries, evicted := s.evict(s.entries)
+	s.entries = entries
+	s.removeBodiesLocked(evicted)
+	if err := s.saveIndexLocked(s.entries); err != nil {
+		return err
+	}
+	return s.removeOrphanBodiesLocked()
+}
+
+// saveIndexLocked atomically replaces the on-disk index with the given entries.
+func (s *historyStore) saveIndexLocked(entries []*historyItem) error {
+	if s.dir == "" {
+		return nil
+	}
+	data, err := encodeHistoryIndex(entries)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, historyIndexFile), data); err != nil {
+		return fmt.Errorf("failed to save history index: %w", err)
+	}
+	return nil
+}
+
+// encodeHistoryIndex serializes the metadata of the given items, leaving their bodies out.
+func encodeHistoryIndex(items []*historyItem) ([]byte, error) {
+	index := historyIndex{Entries: make([]historyRecord, 0, len(items))}
+	for _, item := range items {
+		index.Entries = append(index.Entries, historyRecord{
+			HistoryEntry: item.HistoryEntry,
+			Body:         item.body,
+		})
+	}
+	data, err := json.Marshal(&index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode history index: %w", err)
+	}
+	return data, nil
+}
+
+// decodeHistoryIndex gives back the items without bodies. Empty data is treated as an empty index.
+func decodeHistoryIndex(data []byte) ([]*historyItem, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var index historyIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to decode history index: %w", err)
+	}
+	items := make([]*historyItem, 0, len(index.Entries))
+	for _, record := range index.Entries {
+		entry := record.HistoryEntry
+		entry.Latest = false
+		// Older indexes have the zero time for entries that never expire.
+		if entry.ExpiresAt != nil && entry.ExpiresAt.IsZero() {
+			entry.ExpiresAt = nil
+		}
+		// Older indexes have the preview of the body even for entries with a read limit.
+		if entry.ReadsLeft != nil {
+			entry.Preview = readLimitedPreview(entry)
+		}
+		items = append(items, &historyItem{
+			HistoryEntry: entry,
+			body:         record.Body,
+		})
+	}
+	return items, nil
+}
+
+// writeBodyLocked takes over the body of the upload. It is moved into the bodies directory if the store is persisted.
+// If bodies are shared, the body of an entry with the same digest is used instead if any,
+// and otherwise the body is named after its digest so that later copies can share it.
+func (s *historyStore) writeBodyLocked(item *historyItem, upload *HistoryUpload) error {
+	if s.dedup == historyDedupShare {
+		if i := s.indexOfBodyLocked(upload.SHA256()); i >= 0 {
+			// The body may have been stored before sharing was turned on, named after the id of the other entry.
+			item.blob, item.body = s.entries[i].blob, s.entries[i].bodyName()
+			item.blob.refs++
+			return nil
+		}
+	}
+	if s.dir == "" {
+		item.blob = upload.detach()
+		return nil
+	}
+	if s.dedup == historyDedupShare {
+		item.body = upload.SHA256()
+	}
+	path := s.bodyPath(item.bodyName())
+	if err := upload.moveTo(path); err != nil {
+		return fmt.Errorf("failed to save history body: %w", err)
+	}
+	item.blob = &historyBlob{path: path, refs: 1}
+	return nil
+}
+
+// removeBodiesLocked releases the bodies of the given items, deleting the ones no other entry shares.
+// Failures are only logged since leftovers are cleaned up when the store is opened next time.
+func (s *historyStore) removeBodiesLocked(items []*historyItem) {
+	for _, item := range items {
+		if item.blob == nil {
+			continue
+		}
+		if item.blob.refs--; item.blob.refs > 0 {
+			continue
+		}
+		if err := item.blob.remove(); err != nil {
+			log.Printf("Failed to remove history body %s: %v\n", item.ID, err)
+		}
+	}
+}
+
+// removeOrphanBodiesLocked deletes body files and temporary files that no entry refers to.
+func (s *historyStore) removeOrphanBodiesLocked() error {
+	known := make(map[string]bool, len(s.entries))
+	for _, item := range s.entries {
+		known[item.bodyName()] = true
+	}
+	files, err := os.ReadDir(filepath.Join(s.dir, historyBodiesDir))
+	if err != nil {
+		return fmt.Errorf("failed to read history bodies: %w", err)
+	}
+	for _, f := range files {
+		if known[f.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, historyBodiesDir, f.Name())); err != nil {
+			log.Printf("Failed to remove orphan history body %s: %v\n", f.Name(), err)
+		}
+	}
+	tmpFiles, err := filepath.Glob(filepath.Join(s.dir, "."+historyIndexFile+".tmp-*"))
+	if err != nil {
+		return err
+	}
+	for _, f := range tmpFiles {
+		_ = os.Remove(f)
+	}
+	return nil
+}
+
+func (s *historyStore) bodyPath(name string) string {
+	return filepath.Join(s.dir, historyBodiesDir, name)
+}
+
+// bodyName gives back the name of the file holding the body of the item.
+func (item *historyItem) bodyName() string {
+	if item.body != "" {
+		return item.body
+	}
+	return item.ID
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory,
+// flushes it to stable storage and then renames it into place,
+// so that readers see either the old or the new content even after a crash.
+func writeFileAtomic(path string, data []byte) error {
+	return writeFileAtomicFunc(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeFileAtomicFrom is the same as writeFileAtomic, except that the content is read from r.
+func writeFileAtomicFrom(path string, r io.Reader) error {
+	return writeFileAtomicFunc(path, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+func writeFileAtomicFunc(path string, write func(w io.Writer) error) error {
+	dir, base := filepath.Split(path)
+	f, err := os.CreateTemp(dir, "."+strings.TrimPrefix(base, ".")+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// hashFile gives back the hex-encoded SHA-256 digest of the file, reading it in a streaming manner.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// Some platforms don't support syncing a directory; the rename has been done anyway.
+	_ = d.Sync()
+	return nil
+}
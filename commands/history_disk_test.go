@@ -0,0 +1,254 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryStoreSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openHistoryStore(dir, historyPolicy{limit: 3, ttl: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := store.Add(newTestUpload(t, []byte("first"), false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Add(newTestUpload(t, []byte("secret"), true)); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openHistoryStore(dir, historyPolicy{limit: 3, ttl: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := reopened.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("history length after reopen: got %d want 2", len(entries))
+	}
+	if entries[0].Kind != historyKindEncrypted || !entries[0].Latest || entries[1].ID != first.ID {
+		t.Fatalf("history after reopen: %+v", entries)
+	}
+	entry, body, err := readHistory(reopened.Get(first.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "first" || entry.SHA256 != first.SHA256 || !entry.CreatedAt.Equal(first.CreatedAt) {
+		t.Fatalf("entry after reopen: %+v body %q", entry, body)
+	}
+	if got, want := reopened.entries[1].expiry(), store.entries[1].expiry(); want.IsZero() || !got.Equal(want) {
+		t.Fatalf("expiresAt after reopen: got %v want %v", got, want)
+	}
+}
+
+func TestHistoryStoreReopenPrunesExpired(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Now().Add(-time.Hour)
+	store, err := openHistoryStore(dir, historyPolicy{ttl: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.now = func() time.Time { return base }
+	for _, body := range []string{"first", "second", "third"} {
+		if _, err := store.Add(newTestUpload(t, []byte(body), false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopened, err := openHistoryStore(dir, historyPolicy{limit: 2, ttl: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := reopened.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expired entries should be pruned on reopen: %+v", entries)
+	}
+	if files := bodyFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expired bodies should be removed: %v", files)
+	}
+}
+
+func TestHistoryStoreEnforcesLimitOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openHistoryStore(dir, historyPolicy{limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"first", "second", "third"} {
+		if _, err := store.Add(newTestUpload(t, []byte(body), false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files := bodyFiles(t, dir); len(files) != 2 {
+		t.Fatalf("body files: got %d want 2", len(files))
+	}
+
+	entries, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := openHistoryStore(dir, historyPolicy{limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, body, err := readHistory(reopened.Latest())
+	if err != nil || string(body) != "second" {
+		t.Fatalf("latest after delete and reopen: %+v body %q err %v", latest, body, err)
+	}
+
+	if err := reopened.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if files := bodyFiles(t, dir); len(files) != 0 {
+		t.Fatalf("bodies should be removed after clear: %v", files)
+	}
+}
+
+func TestHistoryStoreDropsCorruptedEntries(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openHistoryStore(dir, historyPolicy{limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken, err := store.Add(newTestUpload(t, []byte("broken"), false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, err := store.Add(newTestUpload(t, []byte("missing"), false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Add(newTestUpload(t, []byte("intact"), false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, historyBodiesDir, broken.ID), []byte("tampered"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, historyBodiesDir, missing.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, historyBodiesDir, ".orphan.tmp-1"), []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openHistoryStore(dir, historyPolicy{limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := reopened.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Preview != "intact" {
+		t.Fatalf("history after reopen: %+v", entries)
+	}
+	if files := bodyFiles(t, dir); len(files) != 1 || files[0] != entries[0].ID {
+		t.Fatalf("body files after reopen: %v", files)
+	}
+}
+
+func bodyFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := os.ReadDir(filepath.Join(dir, historyBodiesDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	return names
+}
+
+func TestHistoryStoreSharesBodies(t *testing.T) {
+	dir := t.TempDir()
+	policy := historyPolicy{maxTotalSize: 10, dedup: historyDedupShare}
+	store, err := openHistoryStore(dir, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	// The shared body is counted once against the total size.
+	for _, body := range []string{"same", "other", "same"} {
+		added, err := store.Add(newTestUpload(t, []byte(body), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, added.ID)
+	}
+	bodies := func() []os.DirEntry {
+		t.Helper()
+		files, err := os.ReadDir(filepath.Join(dir, historyBodiesDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+	if files := bodies(); len(files) != 2 {
+		t.Fatalf("body files: got %d want 2", len(files))
+	}
+
+	reopened, err := openHistoryStore(dir, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := reopened.List(); err != nil || len(entries) != 3 {
+		t.Fatalf("history after reopen: %+v err %v", entries, err)
+	}
+	if err := reopened.Delete(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, body, err := readHistory(reopened.Get(ids[2])); err != nil || string(body) != "same" {
+		t.Fatalf("body shared with a deleted entry: %q err %v", body, err)
+	}
+	if err := reopened.Delete(ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	if files := bodies(); len(files) != 1 {
+		t.Fatalf("body files after deleting every entry sharing one: got %d want 1", len(files))
+	}
+}
+
+func TestHistoryStoreSharesBodiesStoredBefore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openHistoryStore(dir, historyPolicy{dedup: historyDedupOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := store.Add(newTestUpload(t, []byte("same"), false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The body stored without sharing, named after the id of the entry, is shared once sharing is turned on.
+	reopened, err := openHistoryStore(dir, historyPolicy{dedup: historyDedupShare})
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := reopened.Add(newTestUpload(t, []byte("same"), false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Delete(old.ID); err != nil {
+		t.Fatal(err)
+	}
+	again, err := openHistoryStore(dir, historyPolicy{dedup: historyDedupShare})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, body, err := readHistory(again.Get(added.ID)); err != nil || string(body) != "same" {
+		t.Fatalf("body stored before sharing: %q err %v", body, err)
+	}
+}
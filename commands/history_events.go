@@ -0,0 +1,61 @@
+package commands
+
+import "sync"
+
+const (
+	// historyEventAdded is reported when an entry is added.
+	historyEventAdded = "added"
+	// historyEventUpdated is reported when the metadata of an entry is changed on request, such as when it is pinned.
+	historyEventUpdated = "updated"
+	// historyEventDeleted is reported when an entry is deleted on request, or read as many times as its read limit.
+	historyEventDeleted = "deleted"
+	// historyEventEvicted is reported when an entry is dropped to stay within the history limit or the total size budget.
+	historyEventEvicted = "evicted"
+	// historyEventExpired is reported when an entry is dropped because of its TTL.
+	historyEventExpired = "expired"
+	// historyEventCleared is reported once when all entries are deleted, without an entry.
+	historyEventCleared = "cleared"
+)
+
+// HistoryEvent is a change made to a history.
+type HistoryEvent struct {
+	Type  string        `json:"type"`
+	Entry *HistoryEntry `json:"entry,omitempty"`
+}
+
+// historyObservers implements the Observe method of the HistoryBackend interface.
+type historyObservers struct {
+	mu        sync.Mutex
+	observers []func(HistoryEvent)
+}
+
+func (o *historyObservers) Observe(fn func(HistoryEvent)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.observers = append(o.observers, fn)
+}
+
+// emit reports an event of the given type for each of the items, or a single event without an entry if none is given.
+func (o *historyObservers) emit(typ string, items ...*historyItem) {
+	o.mu.Lock()
+	observers := o.observers
+	o.mu.Unlock()
+	if len(observers) == 0 {
+		return
+	}
+
+	events := make([]HistoryEvent, 0, len(items))
+	for _, item := range items {
+		entry := item.HistoryEntry
+		entry.Latest = false
+		events = append(events, HistoryEvent{Type: typ, Entry: &entry})
+	}
+	if len(items) == 0 {
+		events = append(events, HistoryEvent{Type: typ})
+	}
+	for _, ev := range events {
+		for _, fn := range observers {
+			fn(ev)
+		}
+	}
+}
@@ -0,0 +1,614 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/nakabonne/pbgopy/cache/rediscache"
+)
+
+const (
+	// redisHistoryMaxRetries is how many times an update is retried when
+	// another server modifies the history concurrently.
+	redisHistoryMaxRetries = 32
+	// redisBodyChunkSize is how much of a body is fetched at once.
+	redisBodyChunkSize = 1 << 20
+	// redisBurnGrace is how long the body of an entry deleted by its last read is kept,
+	// since it is fetched from the server after the read is counted.
+	redisBurnGrace = time.Minute
+)
+
+// redisDoer is implemented by both rediscache.Client and rediscache.Conn.
+type redisDoer interface {
+	Do(args ...interface{}) (interface{}, error)
+}
+
+// redisHistoryStore is a HistoryBackend on a Redis server, which lets multiple pbgopy servers share one history.
+// The metadata of all entries is kept in a single index key updated with optimistic locking (WATCH/MULTI),
+// while each body lives in its own key that expires natively along with the entry.
+type redisHistoryStore struct {
+	historyPolicy
+	historyObservers
+	client *rediscache.Client
+	prefix string
+	now    func() time.Time
+}
+
+var _ HistoryBackend = (*redisHistoryStore)(nil)
+
+func newRedisHistoryStore(client *rediscache.Client, prefix string, policy historyPolicy) *redisHistoryStore {
+	return &redisHistoryStore{
+		historyPolicy: policy,
+		client:        client,
+		prefix:        prefix,
+		now:           time.Now,
+	}
+}
+
+func (s *redisHistoryStore) Add(upload *HistoryUpload) (HistoryEntry, error) {
+	if err := s.admit(upload.Size()); err != nil {
+		return HistoryEntry{}, err
+	}
+	id, err := newHistoryID()
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+
+	now := s.now()
+	item := &historyItem{
+		HistoryEntry: newHistoryEntryFromUpload(id, now, upload),
+	}
+	item.ExpiresAt = s.expiresAt(now, upload.TTL)
+
+	// The body is streamed to the server, so it has to be opened again every time the update is retried.
+	var opened []io.Closer
+	defer func() {
+		for _, c := range opened {
+			c.Close()
+		}
+	}()
+	var (
+		evicted []*historyItem
+		added   *historyItem
+	)
+	err = s.update(now, func(items []*historyItem) ([]*historyItem, [][]interface{}, error) {
+		added, evicted = item, nil
+		if s.dedup == historyDedupCollapse {
+			// Bodies aren't shared on Redis, since each of them expires along with its entry, but they can be collapsed.
+			for i, existing := range items {
+				if existing.SHA256 != upload.SHA256() {
+					continue
+				}
+				collapsed := *item
+				collapsed.ID = existing.ID
+				collapsed.inherit(existing.HistoryEntry)
+				added = &collapsed
+				kept := make([]*historyItem, 0, len(items))
+				kept = append(kept, added)
+				kept = append(kept, items[:i]...)
+				kept = append(kept, items[i+1:]...)
+				return kept, [][]interface{}{s.expireCommand(s.bodyKey(added.ID), added.expiry(), now)}, nil
+			}
+		}
+		body, err := upload.Open()
+		if err != nil {
+			return nil, nil, err
+		}
+		opened = append(opened, body)
+		var kept []*historyItem
+		kept, evicted = s.evict(append([]*historyItem{item}, items...))
+		value := rediscache.Stream{Reader: body, Size: upload.Size()}
+		cmds := [][]interface{}{s.setCommand(s.bodyKey(item.ID), value, item.expiry(), now)}
+		cmds = append(cmds, s.deleteBodiesCommands(evicted)...)
+		return kept, cmds, nil
+	})
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	s.emit(historyEventAdded, added)
+	if len(evicted) > 0 {
+		s.emit(historyEventEvicted, evicted...)
+	}
+	entry := added.HistoryEntry
+	entry.Latest = true
+	return entry, nil
+}
+
+func (s *redisHistoryStore) List() ([]HistoryEntry, error) {
+	items, err := s.load(s.client)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]HistoryEntry, 0, len(items))
+	for i, item := range items {
+		entry := item.HistoryEntry
+		entry.Latest = i == 0
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *redisHistoryStore) Get(id string) (HistoryEntry, io.ReadSeekCloser, error) {
+	items, err := s.load(s.client)
+	if err != nil {
+		return HistoryEntry{}, nil, err
+	}
+	for i, item := range items {
+		if item.ID == id {
+			entry := item.HistoryEntry
+			entry.Latest = i == 0
+			return s.withBody(entry)
+		}
+	}
+	return HistoryEntry{}, nil, ErrHistoryNotFound
+}
+
+// Read counts the read in the index before the body is fetched, so that the body is fetched only once.
+func (s *redisHistoryStore) Read(id string) (HistoryEntry, io.ReadSeekCloser, error) {
+	items, err := s.load(s.client)
+	if err != nil {
+		return HistoryEntry{}, nil, err
+	}
+	limited := false
+	for i, item := range items {
+		if item.ID != id {
+			continue
+		}
+		if item.ReadsLeft == nil {
+			entry := item.HistoryEntry
+			entry.Latest = i == 0
+			return s.withBody(entry)
+		}
+		limited = true
+	}
+	if !limited {
+		return HistoryEntry{}, nil, ErrHistoryNotFound
+	}
+
+	now := s.now()
+	var (
+		read   *historyItem
+		latest bool
+	)
+	err = s.update(now, func(items []*historyItem) ([]*historyItem, [][]interface{}, error) {
+		for i, item := range items {
+			if item.ID != id {
+				continue
+			}
+			r := *item
+			read, latest = &r, i == 0
+			if read.ReadsLeft == nil {
+				return items, nil, nil
+			}
+			left := *read.ReadsLeft - 1
+			read.ReadsLeft = &left
+			kept := make([]*historyItem, 0, len(items))
+			kept = append(kept, items[:i]...)
+			if left > 0 {
+				kept = append(kept, read)
+			}
+			kept = append(kept, items[i+1:]...)
+			if left > 0 {
+				return kept, nil, nil
+			}
+			return kept, [][]interface{}{s.expireCommand(s.bodyKey(id), now.Add(redisBurnGrace), now)}, nil
+		}
+		return nil, nil, ErrHistoryNotFound
+	})
+	if err != nil {
+		return HistoryEntry{}, nil, err
+	}
+	if read.ReadsLeft != nil && *read.ReadsLeft == 0 {
+		s.emit(historyEventDeleted, read)
+	}
+	entry := read.HistoryEntry
+	entry.Latest = latest
+	return s.withBody(entry)
+}
+
+func (s *redisHistoryStore) Latest() (HistoryEntry, io.ReadSeekCloser, error) {
+	items, err := s.load(s.client)
+	if err != nil {
+		return HistoryEntry{}, nil, err
+	}
+	if len(items) == 0 {
+		return HistoryEntry{}, nil, ErrHistoryNotFound
+	}
+	entry := items[0].HistoryEntry
+	entry.Latest = true
+	return s.withBody(entry)
+}
+
+func (s *redisHistoryStore) Delete(id string) error {
+	var deleted *historyItem
+	err := s.update(s.now(), func(items []*historyItem) ([]*historyItem, [][]interface{}, error) {
+		for i, item := range items {
+			if item.ID != id {
+				continue
+			}
+			deleted = item
+			kept := make([]*historyItem, 0, len(items)-1)
+			kept = append(kept, items[:i]...)
+			kept = append(kept, items[i+1:]...)
+			return kept, s.deleteBodiesCommands([]*historyItem{item}), nil
+		}
+		return nil, nil, ErrHistoryNotFound
+	})
+	if err != nil {
+		return err
+	}
+	s.emit(historyEventDeleted, deleted)
+	return nil
+}
+
+func (s *redisHistoryStore) Update(id string, patch HistoryPatch) (HistoryEntry, error) {
+	now := s.now()
+	var (
+		updated *historyItem
+		latest  bool
+		evicted []*historyItem
+	)
+	err := s.update(now, func(items []*historyItem) ([]*historyItem, [][]interface{}, error) {
+		for i, item := range items {
+			if item.ID != id {
+				continue
+			}
+			u := *item
+			patch.apply(&u.HistoryEntry, s.historyPolicy, now)
+			updated, latest = &u, i == 0
+			kept := make([]*historyItem, len(items))
+			copy(kept, items)
+			kept[i] = updated
+			// An unpinned entry counts toward the limits again, and may push the oldest entries out.
+			kept, evicted = s.evict(kept)
+			// The body of a pinned entry must not expire natively.
+			cmds := [][]interface{}{s.expireCommand(s.bodyKey(id), updated.expiry(), now)}
+			cmds = append(cmds, s.deleteBodiesCommands(evicted)...)
+			return kept, cmds, nil
+		}
+		return nil, nil, ErrHistoryNotFound
+	})
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	s.emit(historyEventUpdated, updated)
+	if len(evicted) > 0 {
+		s.emit(historyEventEvicted, evicted...)
+	}
+	entry := updated.HistoryEntry
+	entry.Latest = latest
+	return entry, nil
+}
+
+func (s *redisHistoryStore) Clear() error {
+	err := s.update(s.now(), func(items []*historyItem) ([]*historyItem, [][]interface{}, error) {
+		return nil, s.deleteBodiesCommands(items), nil
+	})
+	if err != nil {
+		return err
+	}
+	s.emit(historyEventCleared)
+	return nil
+}
+
+// PruneExpired drops the expired entries from the index. Their bodies expire natively,
+// so the index is updated only if it holds any expired entry.
+func (s *redisHistoryStore) PruneExpired() error {
+	reply, err := s.client.Do("GET", s.indexKey())
+	if err != nil {
+		return fmt.Errorf("failed to get history index: %w", err)
+	}
+	data, _ := reply.([]byte)
+	items, err := decodeHistoryIndex(data)
+	if err != nil {
+		return err
+	}
+	if _, expired := pruneExpiredHistoryItems(items, s.now()); len(expired) == 0 {
+		return nil
+	}
+	return s.update(s.now(), func(items []*historyItem) ([]*historyItem, [][]interface{}, error) {
+		return items, nil, nil
+	})
+}
+
+func (s *redisHistoryStore) Range(fn func(HistoryEntry) bool) error {
+	entries, err := s.List()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !fn(entry) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// withBody gives back a reader of the body of the given entry.
+// The body may have expired natively in the meantime, in which case the entry is treated as not found.
+func (s *redisHistoryStore) withBody(entry HistoryEntry) (HistoryEntry, io.ReadSeekCloser, error) {
+	body, err := s.openBody(entry)
+	if err != nil {
+		return HistoryEntry{}, nil, err
+	}
+	return entry, body, nil
+}
+
+// openBody fetches the whole body of the entry before it is served, so that a body removed midway, such as by
+// being deleted, evicted or burnt, fails the request instead of being cut short. A body that fits in a chunk is
+// fetched with a single GET, while a larger one is fetched chunk by chunk into a temporary file.
+// A body already gone is ErrHistoryNotFound.
+func (s *redisHistoryStore) openBody(entry HistoryEntry) (io.ReadSeekCloser, error) {
+	key := s.bodyKey(entry.ID)
+	if entry.Size <= redisBodyChunkSize {
+		reply, err := s.client.Do("GET", key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get history body: %w", err)
+		}
+		if reply == nil {
+			return nil, ErrHistoryNotFound
+		}
+		body, _ := reply.([]byte)
+		if len(body) != entry.Size {
+			return nil, fmt.Errorf("history body of %s has %d bytes instead of %d", entry.ID, len(body), entry.Size)
+		}
+		return nopSeekCloser{bytes.NewReader(body)}, nil
+	}
+
+	f, err := os.CreateTemp("", "pbgopy-body-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a temporary file: %w", err)
+	}
+	body := &tempFile{File: f}
+	r := &redisBodyReader{client: s.client, key: key, size: int64(entry.Size)}
+	if _, err := io.Copy(f, r); err != nil {
+		body.Close()
+		if r.off == 0 && errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrHistoryNotFound
+		}
+		return nil, fmt.Errorf("failed to get history body: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		body.Close()
+		return nil, err
+	}
+	return body, nil
+}
+
+// load gives back the live items in the index.
+func (s *redisHistoryStore) load(conn redisDoer) ([]*historyItem, error) {
+	reply, err := conn.Do("GET", s.indexKey())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history index: %w", err)
+	}
+	var data []byte
+	if reply != nil {
+		var ok bool
+		if data, ok = reply.([]byte); !ok {
+			return nil, fmt.Errorf("unexpected reply type %T", reply)
+		}
+	}
+	items, err := decodeHistoryIndex(data)
+	if err != nil {
+		return nil, err
+	}
+	items, _ = pruneExpiredHistoryItems(items, s.now())
+	return items, nil
+}
+
+// update applies fn to the live items and saves the index it gives back, along with
+// the extra commands, in a single transaction. It starts over if the index is modified
+// by someone else in the meantime.
+func (s *redisHistoryStore) update(now time.Time, fn func(items []*historyItem) ([]*historyItem, [][]interface{}, error)) error {
+	conn, err := s.client.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for i := 0; i < redisHistoryMaxRetries; i++ {
+		if _, err := conn.Do("WATCH", s.indexKey()); err != nil {
+			return fmt.Errorf("failed to watch history index: %w", err)
+		}
+		reply, err := conn.Do("GET", s.indexKey())
+		if err != nil {
+			return fmt.Errorf("failed to get history index: %w", err)
+		}
+		data, _ := reply.([]byte)
+		items, err := decodeHistoryIndex(data)
+		if err != nil {
+			_, _ = conn.Do("UNWATCH")
+			return err
+		}
+		items, expired := pruneExpiredHistoryItems(items, now)
+		kept, cmds, err := fn(items)
+		if err != nil {
+			_, _ = conn.Do("UNWATCH")
+			return err
+		}
+		cmds = append(cmds, s.deleteBodiesCommands(expired)...)
+		indexCmd, err := s.indexCommand(kept, now)
+		if err != nil {
+			_, _ = conn.Do("UNWATCH")
+			return err
+		}
+		cmds = append(cmds, indexCmd)
+
+		committed, err := s.exec(conn, cmds)
+		if err != nil {
+			return fmt.Errorf("failed to update history: %w", err)
+		}
+		if committed {
+			if len(expired) > 0 {
+				s.emit(historyEventExpired, expired...)
+			}
+			return nil
+		}
+		// Back off a little so that contending updates don't keep aborting each other.
+		time.Sleep(time.Duration(rand.Int63n(int64(i+1) * int64(time.Millisecond))))
+	}
+	return errors.New("failed to update history: too many concurrent updates")
+}
+
+// exec runs the commands in a transaction. It gives back false if the transaction was aborted by WATCH.
+func (s *redisHistoryStore) exec(conn *rediscache.Conn, cmds [][]interface{}) (bool, error) {
+	if _, err := conn.Do("MULTI"); err != nil {
+		return false, err
+	}
+	for _, cmd := range cmds {
+		if _, err := conn.Do(cmd...); err != nil {
+			_, _ = conn.Do("DISCARD")
+			return false, err
+		}
+	}
+	reply, err := conn.Do("EXEC")
+	if err != nil {
+		return false, err
+	}
+	if reply == nil {
+		return false, nil
+	}
+	replies, _ := reply.([]interface{})
+	for _, r := range replies {
+		if err, ok := r.(error); ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// indexCommand gives back the command to save the index, which lives as long as its longest-lived item.
+func (s *redisHistoryStore) indexCommand(items []*historyItem, now time.Time) ([]interface{}, error) {
+	if len(items) == 0 {
+		return []interface{}{"DEL", s.indexKey()}, nil
+	}
+	data, err := encodeHistoryIndex(items)
+	if err != nil {
+		return nil, err
+	}
+	var expiresAt time.Time
+	for _, item := range items {
+		if item.expiry().IsZero() {
+			expiresAt = time.Time{}
+			break
+		}
+		if item.expiry().After(expiresAt) {
+			expiresAt = item.expiry()
+		}
+	}
+	return s.setCommand(s.indexKey(), data, expiresAt, now), nil
+}
+
+func (s *redisHistoryStore) setCommand(key string, value interface{}, expiresAt, now time.Time) []interface{} {
+	cmd := []interface{}{"SET", key, value}
+	if !expiresAt.IsZero() {
+		ttl := expiresAt.Sub(now).Milliseconds()
+		if ttl < 1 {
+			ttl = 1
+		}
+		cmd = append(cmd, "PX", ttl)
+	}
+	return cmd
+}
+
+// expireCommand gives back the command to make the key expire at the given time, or never if it is zero.
+func (s *redisHistoryStore) expireCommand(key string, expiresAt, now time.Time) []interface{} {
+	if expiresAt.IsZero() {
+		return []interface{}{"PERSIST", key}
+	}
+	ttl := expiresAt.Sub(now).Milliseconds()
+	if ttl < 1 {
+		ttl = 1
+	}
+	return []interface{}{"PEXPIRE", key, ttl}
+}
+
+func (s *redisHistoryStore) deleteBodiesCommands(items []*historyItem) [][]interface{} {
+	cmds := make([][]interface{}, 0, len(items))
+	for _, item := range items {
+		cmds = append(cmds, []interface{}{"DEL", s.bodyKey(item.ID)})
+	}
+	return cmds
+}
+
+func (s *redisHistoryStore) indexKey() string {
+	return s.prefix + "index"
+}
+
+func (s *redisHistoryStore) bodyKey(id string) string {
+	return s.prefix + "body:" + id
+}
+
+// redisBodyReader reads a body chunk by chunk with GETRANGE, so that a large body is never held in memory at once.
+// It fails with io.ErrUnexpectedEOF if the body is removed while being read.
+type redisBodyReader struct {
+	client *rediscache.Client
+	key    string
+	size   int64
+	off    int64
+}
+
+func (r *redisBodyReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	n := int64(len(p))
+	if n > redisBodyChunkSize {
+		n = redisBodyChunkSize
+	}
+	if rest := r.size - r.off; n > rest {
+		n = rest
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	reply, err := r.client.Do("GETRANGE", r.key, r.off, r.off+n-1)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get history body: %w", err)
+	}
+	chunk, _ := reply.([]byte)
+	if len(chunk) == 0 {
+		// The body has been removed while being read.
+		return 0, io.ErrUnexpectedEOF
+	}
+	copied := copy(p, chunk)
+	r.off += int64(copied)
+	return copied, nil
+}
+
+// WriteTo writes the rest of the body to w a whole chunk at a time, however small the buffers of w are.
+func (r *redisBodyReader) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	buf := make([]byte, redisBodyChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if errors.Is(err, io.EOF) {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// tempFile is a temporary file removed once closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
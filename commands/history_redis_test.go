@@ -0,0 +1,179 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nakabonne/pbgopy/cache/rediscache"
+	"github.com/nakabonne/pbgopy/cache/rediscache/redistest"
+)
+
+func TestRedisHistoryStoreSharedBetweenReplicas(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	newReplica := func() http.Handler {
+		client, err := rediscache.NewClient(server.URL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		r := &serveRunner{
+			cache:   rediscache.NewCache(client, redisKeyPrefix, time.Hour),
+			history: newRedisHistoryStore(client, redisKeyPrefix+"history:", historyPolicy{limit: 2, ttl: time.Hour}),
+		}
+		return r.newServer().Handler
+	}
+	a, b := newReplica(), newReplica()
+
+	putClipboard(t, a, []byte("from a"), false)
+	rr := serveHistoryRequest(t, b, http.MethodGet, "/", nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != "from a" {
+		t.Fatalf("GET / on another replica: status %d body %q", rr.Code, rr.Body.String())
+	}
+	rr = serveHistoryRequest(t, b, http.MethodGet, lastUpdatedPath, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /lastupdated on another replica: status %d", rr.Code)
+	}
+
+	putClipboard(t, b, []byte("from b"), false)
+	putClipboard(t, a, []byte("from a again"), false)
+	entries := getHistory(t, b)
+	if len(entries) != 2 || entries[0].Preview != "from a again" || entries[1].Preview != "from b" {
+		t.Fatalf("shared history: %+v", entries)
+	}
+	// The body of the evicted entry must be gone as well.
+	bodies := 0
+	for _, key := range server.Keys() {
+		if strings.HasPrefix(key, redisKeyPrefix+"history:body:") {
+			bodies++
+		}
+	}
+	if bodies != 2 {
+		t.Fatalf("body keys: got %d want 2: %v", bodies, server.Keys())
+	}
+}
+
+func TestRedisHistoryStoreNativeExpiry(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := rediscache.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	store := newRedisHistoryStore(client, "h:", historyPolicy{ttl: time.Minute})
+	entry, err := store.Add(newTestUpload(t, []byte("short-lived"), false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("h:body:" + entry.ID); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("body ttl: got %v", ttl)
+	}
+	if ttl := server.TTL("h:index"); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("index ttl: got %v", ttl)
+	}
+
+	server.FastForward(2 * time.Minute)
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Fatalf("keys after expiry: %v", keys)
+	}
+	if entries, err := store.List(); err != nil || len(entries) != 0 {
+		t.Fatalf("history after expiry: %+v err %v", entries, err)
+	}
+}
+
+func TestRedisHistoryStoreBodyRemovedWhileRead(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := rediscache.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	history := newRedisHistoryStore(client, redisKeyPrefix+"history:", historyPolicy{limit: 3})
+	handler := (&serveRunner{history: history}).newServer().Handler
+
+	large := bytes.Repeat([]byte("a"), redisBodyChunkSize+10)
+	small, err := history.Add(newTestUpload(t, []byte("small"), false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := history.Add(newTestUpload(t, large, false)); err != nil {
+		t.Fatal(err)
+	}
+	rr := serveHistoryRequest(t, handler, http.MethodGet, "/", nil)
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), large) {
+		t.Fatalf("GET / of a body larger than a chunk: status %d, %d bytes", rr.Code, rr.Body.Len())
+	}
+
+	// A body that lost its tail midway, as by being removed between two chunks, must not be served in part.
+	entry := getHistory(t, handler)[0]
+	if _, err := client.Do("SET", history.bodyKey(entry.ID), large[:redisBodyChunkSize]); err != nil {
+		t.Fatal(err)
+	}
+	if rr := serveHistoryRequest(t, handler, http.MethodGet, "/", nil); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("GET / of a cut body: got %d want %d", rr.Code, http.StatusInternalServerError)
+	}
+	if _, err := client.Do("SET", history.bodyKey(small.ID), "sm"); err != nil {
+		t.Fatal(err)
+	}
+	if rr := serveHistoryRequest(t, handler, http.MethodGet, historyPath+"/"+small.ID, nil); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("GET of a cut small body: got %d want %d", rr.Code, http.StatusInternalServerError)
+	}
+
+	if _, err := client.Do("DEL", history.bodyKey(small.ID), history.bodyKey(entry.ID)); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{small.ID, entry.ID} {
+		if _, _, err := history.Get(id); !errors.Is(err, ErrHistoryNotFound) {
+			t.Fatalf("Get of an entry without its body: got %v want %v", err, ErrHistoryNotFound)
+		}
+	}
+}
+
+func TestRedisHistoryStoreReadFetchesBodyOnce(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := rediscache.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	history := newRedisHistoryStore(client, redisKeyPrefix+"history:", historyPolicy{limit: 3})
+	handler := (&serveRunner{history: history}).newServer().Handler
+
+	c := &copyRunner{maxReads: 2}
+	if err := c.upload(newHandlerClient(handler), "http://pbgopy.test/", bytes.Repeat([]byte("a"), redisBodyChunkSize+10)); err != nil {
+		t.Fatal(err)
+	}
+	entry := getHistory(t, handler)[0]
+	if rr := serveHistoryRequest(t, handler, http.MethodGet, historyPath+"/"+entry.ID, nil); rr.Code != http.StatusOK || rr.Body.Len() != entry.Size {
+		t.Fatalf("GET of an entry with a read limit: status %d, %d bytes", rr.Code, rr.Body.Len())
+	}
+	key := history.bodyKey(entry.ID)
+	// A body larger than a chunk is fetched in two chunks.
+	if got := server.Calls("GETRANGE", key) + server.Calls("GET", key); got != 2 {
+		t.Fatalf("body fetched by %d commands, want 2", got)
+	}
+	if entry := getHistory(t, handler)[0]; entry.ReadsLeft == nil || *entry.ReadsLeft != 1 {
+		t.Fatalf("entry after a read: %+v", entry)
+	}
+}
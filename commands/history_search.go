@@ -0,0 +1,131 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"unicode/utf8"
+)
+
+const (
+	// historySearchMaxQuerySize is the maximum size of a search query in bytes.
+	historySearchMaxQuerySize = 1024
+	// historySearchLineSize is the size of the pieces long lines are searched in.
+	// A match spanning two pieces of such a line isn't found.
+	historySearchLineSize = 64 << 10
+	// historySnippetContextRunes is how many runes before the match a snippet starts with.
+	historySnippetContextRunes = 20
+)
+
+// historySearch finds the entries matching a query, by the lines of their bodies or by their tags and notes.
+type historySearch struct {
+	pattern *regexp.Regexp
+}
+
+// newHistorySearch gives back a search for the query, which is taken as a regular expression in the RE2 syntax
+// if regex is true, or as a plain substring otherwise.
+func newHistorySearch(query string, regex, ignoreCase bool) (*historySearch, error) {
+	if len(query) > historySearchMaxQuerySize {
+		return nil, fmt.Errorf("the query exceeds %d bytes", historySearchMaxQuerySize)
+	}
+	if !regex {
+		query = regexp.QuoteMeta(query)
+	}
+	if ignoreCase {
+		query = "(?i)" + query
+	}
+	pattern, err := regexp.Compile(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression: %w", err)
+	}
+	return &historySearch{pattern: pattern}, nil
+}
+
+// filter gives back the entries matching the search, keeping their order. The preview of an entry matched by its body
+// or its note is replaced with a snippet of the first matching line or the note.
+// Only the bodies of plaintext text entries are searched. Those of entries with a read limit aren't either,
+// since a search doesn't count as a read; they are found only by their tags and notes, the same as encrypted ones.
+func (s *historySearch) filter(ctx context.Context, history HistoryBackend, entries []HistoryEntry) ([]HistoryEntry, error) {
+	matched := make([]HistoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if entry.Kind == historyKindText && entry.ReadsLeft == nil {
+			snippet, ok, err := s.searchBody(history, entry.ID)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				entry.Preview = snippet
+				matched = append(matched, entry)
+				continue
+			}
+		}
+		if snippet, ok := s.matchLabels(entry); ok {
+			if snippet != "" {
+				entry.Preview = snippet
+			}
+			matched = append(matched, entry)
+		}
+	}
+	return matched, nil
+}
+
+// searchBody gives back a snippet of the first line of the body of the entry that matches.
+// An entry removed in the meantime doesn't match.
+func (s *historySearch) searchBody(history HistoryBackend, id string) (string, bool, error) {
+	_, body, err := history.Get(id)
+	if errors.Is(err, ErrHistoryNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	defer body.Close()
+
+	r := bufio.NewReaderSize(body, historySearchLineSize)
+	for {
+		line, _, err := r.ReadLine()
+		if errors.Is(err, io.EOF) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("failed to read history body: %w", err)
+		}
+		if loc := s.pattern.FindIndex(line); loc != nil {
+			return searchSnippet(line, loc[0]), true, nil
+		}
+	}
+}
+
+// matchLabels reports whether the note or any of the tags of the entry matches.
+// It gives back a snippet of the note if the note matches.
+func (s *historySearch) matchLabels(entry HistoryEntry) (string, bool) {
+	if loc := s.pattern.FindStringIndex(entry.Note); entry.Note != "" && loc != nil {
+		return searchSnippet([]byte(entry.Note), loc[0]), true
+	}
+	for _, tag := range entry.Tags {
+		if s.pattern.MatchString(tag) {
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// searchSnippet gives back a preview of the line starting a little before the match at the given offset.
+func searchSnippet(line []byte, match int) string {
+	start := match
+	for n := 0; start > 0 && n < historySnippetContextRunes; n++ {
+		_, size := utf8.DecodeLastRune(line[:start])
+		start -= size
+	}
+	snippet := textPreview(line[start:])
+	if start > 0 {
+		snippet = "..." + snippet
+	}
+	return snippet
+}
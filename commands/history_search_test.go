@@ -0,0 +1,99 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistorySearch(t *testing.T) {
+	handler := newHistoryTestHandler(10, 0)
+	t.Setenv(pbgopyServerEnv, "http://pbgopy.test/")
+	log := strings.Repeat("INFO all good\n", 100) + "2024-01-02 ERROR dial tcp 10.0.0.1:5432: connection refused\n"
+	putClipboard(t, handler, []byte(log), false)
+	putClipboard(t, handler, []byte("Connection refused is in the ciphertext"), true)
+	c := &copyRunner{maxReads: 1}
+	if err := c.upload(newHandlerClient(handler), "http://pbgopy.test/", []byte("connection refused, but burnt after reading")); err != nil {
+		t.Fatal(err)
+	}
+	c = &copyRunner{note: "how I fixed the connection refused", tags: []string{"db"}}
+	if err := c.upload(newHandlerClient(handler), "http://pbgopy.test/", []byte("retry: 3")); err != nil {
+		t.Fatal(err)
+	}
+	entries := getHistory(t, handler)
+	note, burnt, encrypted, logEntry := entries[0], entries[1], entries[2], entries[3]
+
+	search := func(query url.Values) []HistoryEntry {
+		t.Helper()
+		rr := serveHistoryRequest(t, handler, http.MethodGet, historyPath+"?"+query.Encode(), nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("search %v: got %d %q", query, rr.Code, rr.Body.String())
+		}
+		var entries []HistoryEntry
+		if err := json.Unmarshal(rr.Body.Bytes(), &entries); err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	found := search(url.Values{historySearchQuery: {"connection refused"}})
+	if len(found) != 2 || found[0].ID != note.ID || found[1].ID != logEntry.ID {
+		t.Fatalf("substring search: %+v", found)
+	}
+	if found[0].Preview != "how I fixed the connection refused" || found[1].Preview != "...tcp 10.0.0.1:5432: connection refused" {
+		t.Fatalf("snippets: %q %q", found[0].Preview, found[1].Preview)
+	}
+	// Neither the body of the encrypted entry nor that of the one with a read limit is searched.
+	if found := search(url.Values{historySearchQuery: {"CONNECTION"}, historyIgnoreCaseQuery: {"true"}}); len(found) != 2 || encrypted.Kind != historyKindEncrypted {
+		t.Fatalf("case-insensitive search: %+v", found)
+	}
+	if found := search(url.Values{historySearchQuery: {`\d+\.\d+\.\d+\.\d+`}, historyRegexpQuery: {"true"}}); len(found) != 1 || found[0].ID != logEntry.ID {
+		t.Fatalf("regexp search: %+v", found)
+	}
+	if found := search(url.Values{historySearchQuery: {`\d+`}}); len(found) != 0 {
+		t.Fatalf("a substring is taken as a regexp: %+v", found)
+	}
+	if found := search(url.Values{historySearchQuery: {"db"}, historyTagQuery: {"db"}}); len(found) != 1 || found[0].ID != note.ID || found[0].Preview != note.Preview {
+		t.Fatalf("search by a tag: %+v", found)
+	}
+	if entry := getHistory(t, handler)[1]; entry.ID != burnt.ID || entry.ReadsLeft == nil || *entry.ReadsLeft != 1 {
+		t.Fatalf("entry with a read limit after searches: %+v", entry)
+	}
+
+	rr := serveHistoryRequest(t, handler, http.MethodGet, historyPath+"?"+url.Values{historySearchQuery: {"("}, historyRegexpQuery: {"true"}}.Encode(), nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("invalid regexp: got %d want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	var stdout bytes.Buffer
+	h := &historyRunner{timeout: time.Second, ignoreCase: true, stdout: &stdout, client: newHandlerClient(handler)}
+	if err := h.search(nil, []string{"Error"}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], logEntry.ID) || !strings.HasSuffix(lines[1], `"2024-01-02 ERROR dial tcp 10.0.0.1:5432: connection refused"`) {
+		t.Fatalf("history search: %q", stdout.String())
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	tests := []struct {
+		line  string
+		match int
+		want  string
+	}{
+		{line: "short line", match: 6, want: "short line"},
+		{line: strings.Repeat("a", 30) + "match", match: 30, want: "..." + strings.Repeat("a", 20) + "match"},
+		{line: strings.Repeat("é", 30) + "match", match: 60, want: "..." + strings.Repeat("é", 20) + "match"},
+		{line: "match\t" + strings.Repeat("b", 100), match: 0, want: "match " + strings.Repeat("b", 74) + "..."},
+	}
+	for _, tt := range tests {
+		if got := searchSnippet([]byte(tt.line), tt.match); got != tt.want {
+			t.Errorf("searchSnippet(%q, %d): got %q want %q", tt.line, tt.match, got, tt.want)
+		}
+	}
+}
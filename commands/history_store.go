@@ -5,12 +5,15 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"io"
 	"net/http"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -26,8 +29,22 @@ const (
 	historyKindUnknown   = "unknown"
 
 	historyPreviewRunes = 80
+
+	// historyMaxTags is the maximum number of tags of an entry.
+	historyMaxTags = 16
+	// historyMaxNoteSize is the maximum size of the note of an entry in bytes.
+	historyMaxNoteSize = 1024
+
+	// historyDedupOff stores every copy on its own.
+	historyDedupOff = "off"
+	// historyDedupShare adds every copy as an entry of its own, but stores identical bodies only once.
+	historyDedupShare = "share"
+	// historyDedupCollapse moves the entry with the identical body to the newest instead of adding another one.
+	historyDedupCollapse = "collapse"
 )
 
+var historyTagPattern = regexp.MustCompile(`^[A-Za-z0-9._:/-]{1,64}$`)
+
 // HistoryEntry is the metadata returned by the history API.
 type HistoryEntry struct {
 	ID        string    `json:"id"`
@@ -38,57 +55,265 @@ type HistoryEntry struct {
 	Kind      string    `json:"kind"`
 	Preview   string    `json:"preview"`
 	SHA256    string    `json:"sha256"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	// ExpiresAt is when the entry expires by its TTL. Nil means never.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// ReadsLeft is how many more times the entry can be read before it is deleted. Nil means unlimited.
+	ReadsLeft *int `json:"reads_left,omitempty"`
+	// Pinned entries are kept regardless of the history limit, the total size budget and the TTL.
+	Pinned bool `json:"pinned"`
+	// Tags are the labels given by the user to find the entry by.
+	Tags []string `json:"tags,omitempty"`
+	// Note is a free-text description given by the user.
+	Note string `json:"note,omitempty"`
+	// ContentEncoding is how the data was compressed before encryption, which paste undoes after decryption.
+	ContentEncoding string `json:"content_encoding,omitempty"`
+}
+
+// HistoryPatch is a change to the metadata of an entry. Nil fields are left as they are.
+type HistoryPatch struct {
+	Pinned *bool `json:"pinned,omitempty"`
+	// TTL makes the entry expire after the given time from now, or after the default TTL if zero.
+	TTL *jsonDuration `json:"ttl,omitempty"`
+	// Tags replace the tags of the entry. An empty list removes them.
+	Tags *[]string `json:"tags,omitempty"`
+	// Note replaces the note of the entry. An empty one removes it.
+	Note *string `json:"note,omitempty"`
+}
+
+// validate reports whether the tags and the note of the patch are valid.
+func (p HistoryPatch) validate() error {
+	if p.Tags != nil {
+		if err := validateHistoryTags(*p.Tags); err != nil {
+			return err
+		}
+	}
+	if p.Note != nil {
+		return validateHistoryNote(*p.Note)
+	}
+	return nil
+}
+
+func (p HistoryPatch) apply(entry *HistoryEntry, policy historyPolicy, now time.Time) {
+	if p.Pinned != nil {
+		entry.Pinned = *p.Pinned
+	}
+	if p.TTL != nil {
+		entry.ExpiresAt = policy.expiresAt(now, time.Duration(*p.TTL))
+	}
+	if p.Tags != nil {
+		entry.Tags = normalizeHistoryTags(*p.Tags)
+	}
+	if p.Note != nil {
+		entry.Note = *p.Note
+	}
+}
+
+// inherit keeps what the user has set on old, an entry of the same body collapsed into this one.
+// The tags and the note are kept unless the new copy is given its own.
+func (e *HistoryEntry) inherit(old HistoryEntry) {
+	e.Pinned = old.Pinned
+	if len(e.Tags) == 0 {
+		e.Tags = old.Tags
+	}
+	if e.Note == "" {
+		e.Note = old.Note
+	}
+}
+
+// HasTag reports whether the entry has the given tag.
+func (e HistoryEntry) HasTag(tag string) bool {
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// validateHistoryTags reports whether the tags are valid. Tags can't contain commas,
+// since they are sent in a comma-separated header.
+func validateHistoryTags(tags []string) error {
+	if len(tags) > historyMaxTags {
+		return fmt.Errorf("too many tags: up to %d are allowed", historyMaxTags)
+	}
+	for _, tag := range tags {
+		if !historyTagPattern.MatchString(tag) {
+			return fmt.Errorf("invalid tag %q: use up to 64 letters, digits, dots, colons, slashes, underscores and hyphens", tag)
+		}
+	}
+	return nil
+}
+
+// validateHistoryNote reports whether the note is valid.
+func validateHistoryNote(note string) error {
+	if len(note) > historyMaxNoteSize {
+		return fmt.Errorf("the note exceeds %d bytes", historyMaxNoteSize)
+	}
+	if !utf8.ValidString(note) {
+		return fmt.Errorf("the note isn't valid UTF-8")
+	}
+	return nil
+}
+
+// normalizeHistoryTags drops the duplicates of the tags, keeping their order. It gives back nil if there are none.
+func normalizeHistoryTags(tags []string) []string {
+	var normalized []string
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized
+}
+
+// jsonDuration is a non-negative duration encoded in JSON as a string such as "5m", the way it is given on the command line.
+type jsonDuration time.Duration
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *jsonDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("negative duration %q", s)
+	}
+	*d = jsonDuration(v)
+	return nil
 }
 
 type historyItem struct {
 	HistoryEntry
-	body      []byte
-	expiresAt time.Time
+	blob *historyBlob
+	// body is the name of the file holding the body, if it isn't named after the id because it is shared.
+	body string
+}
+
+// historyPolicy is the retention policy applied by every HistoryBackend.
+type historyPolicy struct {
+	// limit is the maximum number of entries. Zero means unlimited.
+	limit int
+	// ttl is how long an entry is kept unless the client asks otherwise. Zero means forever.
+	ttl time.Duration
+	// maxTTL is the longest TTL a client can ask for. Zero means unlimited.
+	maxTTL time.Duration
+	// maxTotalSize is the maximum sum of the body sizes in bytes. Zero means unlimited.
+	// A body shared by several entries is counted once.
+	maxTotalSize int64
+	// dedup is what to do with a copy identical to an entry, out of historyDedupOff, historyDedupShare and historyDedupCollapse.
+	// Empty means historyDedupOff.
+	dedup string
 }
 
+// historyStore is the reference HistoryBackend. It keeps every entry in memory
+// and optionally persists them to a directory.
 type historyStore struct {
-	mu        sync.Mutex
-	entries   []*historyItem
-	limit     int
-	ttl       time.Duration
-	everAdded bool
-	now       func() time.Time
+	historyPolicy
+	historyObservers
+	mu      sync.Mutex
+	entries []*historyItem
+	now     func() time.Time
+	// dir is the directory entries are persisted to.
+	// Empty means the history is kept only in memory.
+	dir string
 }
 
-func newHistoryStore(limit int, ttl time.Duration) *historyStore {
+var _ HistoryBackend = (*historyStore)(nil)
+
+func newHistoryStore(policy historyPolicy) *historyStore {
 	return &historyStore{
-		limit: limit,
-		ttl:   ttl,
-		now:   time.Now,
+		historyPolicy: policy,
+		now:           time.Now,
 	}
 }
 
-func (s *historyStore) Add(body []byte, encrypted bool) (*historyItem, error) {
+func (s *historyStore) Add(upload *HistoryUpload) (HistoryEntry, error) {
+	if err := s.admit(upload.Size()); err != nil {
+		return HistoryEntry{}, err
+	}
 	id, err := newHistoryID()
 	if err != nil {
-		return nil, err
+		return HistoryEntry{}, err
 	}
 
 	now := s.now()
 	item := &historyItem{
-		HistoryEntry: newHistoryEntry(id, now, body, encrypted),
-		body:         append([]byte(nil), body...),
-	}
-	if s.ttl > 0 {
-		item.expiresAt = now.Add(s.ttl)
+		HistoryEntry: newHistoryEntryFromUpload(id, now, upload),
 	}
+	item.ExpiresAt = s.expiresAt(now, upload.TTL)
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	s.pruneExpiredLocked(now)
-	s.entries = append([]*historyItem{item}, s.entries...)
-	s.everAdded = true
-	s.enforceLimitLocked()
-	return item.copy(), nil
+	if s.dedup == historyDedupCollapse {
+		if i := s.indexOfBodyLocked(upload.SHA256()); i >= 0 {
+			return s.collapseLocked(i, upload, now)
+		}
+	}
+	if err := s.writeBodyLocked(item, upload); err != nil {
+		return HistoryEntry{}, err
+	}
+	entries, evicted := s.evict(append([]*historyItem{item}, s.entries...))
+	if err := s.saveIndexLocked(entries); err != nil {
+		s.removeBodiesLocked([]*historyItem{item})
+		return HistoryEntry{}, err
+	}
+	s.entries = entries
+	s.removeBodiesLocked(evicted)
+	s.emit(historyEventAdded, item)
+	if len(evicted) > 0 {
+		s.emit(historyEventEvicted, evicted...)
+	}
+
+	entry := item.HistoryEntry
+	entry.Latest = true
+	return entry, nil
 }
 
-func (s *historyStore) List() []HistoryEntry {
+// collapseLocked makes the i-th entry, of which the body is identical to the upload, the newest one,
+// as if it has just been copied. It keeps its id, and is reported as added again.
+func (s *historyStore) collapseLocked(i int, upload *HistoryUpload, now time.Time) (HistoryEntry, error) {
+	item := *s.entries[i]
+	item.HistoryEntry = newHistoryEntryFromUpload(item.ID, now, upload)
+	item.inherit(s.entries[i].HistoryEntry)
+	item.ExpiresAt = s.expiresAt(now, upload.TTL)
+	entries := make([]*historyItem, 0, len(s.entries))
+	entries = append(entries, &item)
+	entries = append(entries, s.entries[:i]...)
+	entries = append(entries, s.entries[i+1:]...)
+	if err := s.saveIndexLocked(entries); err != nil {
+		return HistoryEntry{}, err
+	}
+	s.entries = entries
+	s.emit(historyEventAdded, &item)
+
+	entry := item.HistoryEntry
+	entry.Latest = true
+	return entry, nil
+}
+
+// indexOfBodyLocked gives back the index of the newest entry with the body of the given digest, or -1 if there is none.
+func (s *historyStore) indexOfBodyLocked(sha string) int {
+	for i, item := range s.entries {
+		if item.SHA256 == sha {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *historyStore) List() ([]HistoryEntry, error) {
 	now := s.now()
 
 	s.mu.Lock()
@@ -101,10 +326,10 @@ func (s *historyStore) List() []HistoryEntry {
 		entry.Latest = i == 0
 		entries = append(entries, entry)
 	}
-	return entries
+	return entries, nil
 }
 
-func (s *historyStore) Latest() (*historyItem, bool) {
+func (s *historyStore) Latest() (HistoryEntry, io.ReadSeekCloser, error) {
 	now := s.now()
 
 	s.mu.Lock()
@@ -112,14 +337,12 @@ func (s *historyStore) Latest() (*historyItem, bool) {
 
 	s.pruneExpiredLocked(now)
 	if len(s.entries) == 0 {
-		return nil, false
+		return HistoryEntry{}, nil, ErrHistoryNotFound
 	}
-	item := s.entries[0].copy()
-	item.Latest = true
-	return item, true
+	return s.openLocked(0)
 }
 
-func (s *historyStore) Get(id string) (*historyItem, bool) {
+func (s *historyStore) Get(id string) (HistoryEntry, io.ReadSeekCloser, error) {
 	now := s.now()
 
 	s.mu.Lock()
@@ -128,70 +351,263 @@ func (s *historyStore) Get(id string) (*historyItem, bool) {
 	s.pruneExpiredLocked(now)
 	for i, item := range s.entries {
 		if item.ID == id {
-			copied := item.copy()
-			copied.Latest = i == 0
-			return copied, true
+			return s.openLocked(i)
 		}
 	}
-	return nil, false
+	return HistoryEntry{}, nil, ErrHistoryNotFound
 }
 
-func (s *historyStore) Delete(id string) bool {
+// openLocked opens the body of the i-th entry. Since the body is opened while the lock is held,
+// it stays readable even if the entry is removed before the caller is done with it.
+func (s *historyStore) openLocked(i int) (HistoryEntry, io.ReadSeekCloser, error) {
+	item := s.entries[i]
+	body, err := item.blob.open()
+	if err != nil {
+		return HistoryEntry{}, nil, fmt.Errorf("failed to open history body: %w", err)
+	}
+	entry := item.HistoryEntry
+	entry.Latest = i == 0
+	return entry, body, nil
+}
+
+func (s *historyStore) Read(id string) (HistoryEntry, io.ReadSeekCloser, error) {
 	now := s.now()
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	s.pruneExpiredLocked(now)
+	i := s.indexLocked(id)
+	if i < 0 {
+		return HistoryEntry{}, nil, ErrHistoryNotFound
+	}
+	entry, body, err := s.openLocked(i)
+	if err != nil || entry.ReadsLeft == nil {
+		return entry, body, err
+	}
+
+	item := s.entries[i]
+	left := *item.ReadsLeft - 1
+	entry.ReadsLeft = &left
+	entries := make([]*historyItem, 0, len(s.entries))
+	entries = append(entries, s.entries[:i]...)
+	if left > 0 {
+		updated := *item
+		updated.ReadsLeft = &left
+		entries = append(entries, &updated)
+	}
+	entries = append(entries, s.entries[i+1:]...)
+	if err := s.saveIndexLocked(entries); err != nil {
+		body.Close()
+		return HistoryEntry{}, nil, err
+	}
+	s.entries = entries
+	if left == 0 {
+		// The body stays readable through the reader opened above.
+		s.removeBodiesLocked([]*historyItem{item})
+		s.emit(historyEventDeleted, item)
+	}
+	return entry, body, nil
+}
+
+// indexLocked gives back the index of the entry with the given id, or -1 if there is none.
+func (s *historyStore) indexLocked(id string) int {
 	for i, item := range s.entries {
 		if item.ID == id {
-			s.entries = append(s.entries[:i], s.entries[i+1:]...)
-			return true
+			return i
 		}
 	}
-	return false
+	return -1
+}
+
+func (s *historyStore) Delete(id string) error {
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneExpiredLocked(now)
+	for i, item := range s.entries {
+		if item.ID != id {
+			continue
+		}
+		entries := make([]*historyItem, 0, len(s.entries)-1)
+		entries = append(entries, s.entries[:i]...)
+		entries = append(entries, s.entries[i+1:]...)
+		if err := s.saveIndexLocked(entries); err != nil {
+			return err
+		}
+		s.entries = entries
+		s.removeBodiesLocked([]*historyItem{item})
+		s.emit(historyEventDeleted, item)
+		return nil
+	}
+	return ErrHistoryNotFound
 }
 
-func (s *historyStore) Clear() {
+func (s *historyStore) Update(id string, patch HistoryPatch) (HistoryEntry, error) {
+	now := s.now()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.pruneExpiredLocked(now)
+	for i, item := range s.entries {
+		if item.ID != id {
+			continue
+		}
+		updated := *item
+		patch.apply(&updated.HistoryEntry, s.historyPolicy, now)
+		entries := make([]*historyItem, len(s.entries))
+		copy(entries, s.entries)
+		entries[i] = &updated
+		// An unpinned entry counts toward the limits again, and may push the oldest entries out.
+		entries, evicted := s.evict(entries)
+		if err := s.saveIndexLocked(entries); err != nil {
+			return HistoryEntry{}, err
+		}
+		s.entries = entries
+		s.removeBodiesLocked(evicted)
+		s.emit(historyEventUpdated, &updated)
+		if len(evicted) > 0 {
+			s.emit(historyEventEvicted, evicted...)
+		}
+		// It also expires right away if its TTL has passed while it was pinned.
+		s.pruneExpiredLocked(now)
+
+		entry := updated.HistoryEntry
+		entry.Latest = i == 0
+		return entry, nil
+	}
+	return HistoryEntry{}, ErrHistoryNotFound
+}
+
+func (s *historyStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.saveIndexLocked(nil); err != nil {
+		return err
+	}
+	s.removeBodiesLocked(s.entries)
 	s.entries = nil
-	s.everAdded = true
+	s.emit(historyEventCleared)
+	return nil
 }
 
-func (s *historyStore) EverAdded() bool {
+func (s *historyStore) PruneExpired() error {
+	now := s.now()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	return s.everAdded
+	s.pruneExpiredLocked(now)
+	return nil
 }
 
+// Range calls fn on a snapshot of the entries,
+// so fn is free to call other methods of the store.
+func (s *historyStore) Range(fn func(HistoryEntry) bool) error {
+	entries, err := s.List()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !fn(entry) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// pruneExpiredLocked drops expired entries. The on-disk index is left as it is
+// because expired records are pruned again when the store is opened.
 func (s *historyStore) pruneExpiredLocked(now time.Time) {
-	if s.ttl <= 0 {
-		return
-	}
-	n := 0
-	for _, item := range s.entries {
-		if item.expiresAt.IsZero() || item.expiresAt.After(now) {
-			s.entries[n] = item
-			n++
+	var expired []*historyItem
+	s.entries, expired = pruneExpiredHistoryItems(s.entries, now)
+	s.removeBodiesLocked(expired)
+	if len(expired) > 0 {
+		s.emit(historyEventExpired, expired...)
+	}
+}
+
+// pruneExpiredHistoryItems splits the items into the live ones and the expired ones, keeping their order.
+func pruneExpiredHistoryItems(items []*historyItem, now time.Time) ([]*historyItem, []*historyItem) {
+	var live, expired []*historyItem
+	for _, item := range items {
+		if expiresAt := item.expiry(); expiresAt.IsZero() || expiresAt.After(now) {
+			live = append(live, item)
+			continue
 		}
+		expired = append(expired, item)
 	}
-	s.entries = s.entries[:n]
+	return live, expired
 }
 
-func (s *historyStore) enforceLimitLocked() {
-	if s.limit <= 0 || len(s.entries) <= s.limit {
-		return
+// expiry gives back when the item expires, or zero if it never does.
+func (item *historyItem) expiry() time.Time {
+	if item.Pinned || item.ExpiresAt == nil {
+		return time.Time{}
 	}
-	s.entries = s.entries[:s.limit]
+	return *item.ExpiresAt
 }
 
-func (item *historyItem) copy() *historyItem {
-	copied := *item
-	copied.body = append([]byte(nil), item.body...)
-	return &copied
+// expiresAt gives back when an entry kept for the given TTL from now expires, or nil if it never does.
+// Zero means the default TTL. A longer TTL than maxTTL is cut down to it.
+func (p historyPolicy) expiresAt(now time.Time, ttl time.Duration) *time.Time {
+	if ttl <= 0 {
+		ttl = p.ttl
+	} else if p.maxTTL > 0 && ttl > p.maxTTL {
+		ttl = p.maxTTL
+	}
+	if ttl <= 0 {
+		return nil
+	}
+	t := now.Add(ttl)
+	return &t
+}
+
+// admit checks if a body of the given size can be added at all.
+func (p historyPolicy) admit(size int64) error {
+	if p.maxTotalSize > 0 && size > p.maxTotalSize {
+		return ErrHistoryTooLarge
+	}
+	return nil
+}
+
+// evict splits the newest-first items into the ones to keep and the ones to evict, keeping their order.
+// The oldest items are evicted until the rest fit in both the limit and the total size budget.
+// Pinned items are always kept, and count toward neither.
+func (p historyPolicy) evict(items []*historyItem) ([]*historyItem, []*historyItem) {
+	var (
+		kept, evicted []*historyItem
+		n             int
+		total         int64
+		full          bool
+	)
+	counted := make(map[*historyBlob]bool)
+	for _, item := range items {
+		if item.Pinned {
+			kept = append(kept, item)
+			continue
+		}
+		if item.blob == nil || !counted[item.blob] {
+			total += int64(item.Size)
+		}
+		if item.blob != nil {
+			counted[item.blob] = true
+		}
+		n++
+		if (p.limit > 0 && n > p.limit) || (p.maxTotalSize > 0 && total > p.maxTotalSize) {
+			full = true
+		}
+		if full {
+			evicted = append(evicted, item)
+			continue
+		}
+		kept = append(kept, item)
+	}
+	return kept, evicted
 }
 
 func newHistoryID() (string, error) {
@@ -204,12 +620,44 @@ func newHistoryID() (string, error) {
 
 func newHistoryEntry(id string, createdAt time.Time, body []byte, encrypted bool) HistoryEntry {
 	sum := sha256.Sum256(body)
-	sha := hex.EncodeToString(sum[:])
+	head := body
+	if len(head) > historySniffLen {
+		head = head[:historySniffLen]
+	}
+	return historyEntryOf(id, createdAt, int64(len(body)), hex.EncodeToString(sum[:]), head, isLikelyText(body), encrypted)
+}
+
+func newHistoryEntryFromUpload(id string, createdAt time.Time, u *HistoryUpload) HistoryEntry {
+	entry := historyEntryOf(id, createdAt, u.size, u.sha256, u.head, u.text, u.Encrypted)
+	if u.MIME != "" {
+		entry.MIME = u.MIME
+	}
+	entry.CreatedBy = u.CreatedBy
+	entry.Tags = normalizeHistoryTags(u.Tags)
+	entry.Note = u.Note
+	entry.ContentEncoding = u.ContentEncoding
+	if u.MaxReads > 0 {
+		reads := u.MaxReads
+		entry.ReadsLeft = &reads
+		entry.Preview = readLimitedPreview(entry)
+	}
+	return entry
+}
+
+// readLimitedPreview gives back the preview of an entry with a read limit, which reveals nothing of the body,
+// since the metadata can be listed, watched and searched without counting as a read.
+func readLimitedPreview(entry HistoryEntry) string {
+	return entry.Kind + " sha256:" + entry.SHA256[:8]
+}
+
+// historyEntryOf builds the metadata of a body from its digest and its head, which is at most historySniffLen bytes.
+// text reports whether the whole body, not only the head, looks like text.
+func historyEntryOf(id string, createdAt time.Time, size int64, sha string, head []byte, text, encrypted bool) HistoryEntry {
 	entry := HistoryEntry{
 		ID:        id,
 		CreatedAt: createdAt,
-		Size:      len(body),
-		MIME:      detectMIME(body),
+		Size:      int(size),
+		MIME:      detectMIME(head),
 		SHA256:    sha,
 	}
 
@@ -218,10 +666,17 @@ func newHistoryEntry(id string, createdAt time.Time, body []byte, encrypted bool
 		entry.MIME = "application/octet-stream"
 		entry.Kind = historyKindEncrypted
 		entry.Preview = "encrypted sha256:" + sha[:8]
-	case setImageMetadata(&entry, body):
-	case isLikelyText(body):
+	case setImageMetadata(&entry, head):
+	case text:
 		entry.Kind = historyKindText
-		entry.Preview = textPreview(body)
+		truncated := int64(len(head)) < size
+		if truncated {
+			head = trimIncompleteRune(head)
+		}
+		entry.Preview = textPreview(head)
+		if truncated && !strings.HasSuffix(entry.Preview, "...") {
+			entry.Preview += "..."
+		}
 	case entry.MIME == "":
 		entry.Kind = historyKindUnknown
 		entry.Preview = "unknown sha256:" + sha[:8]
@@ -274,6 +729,19 @@ func isLikelyText(body []byte) bool {
 	return true
 }
 
+// trimIncompleteRune drops a rune cut off at the end of b.
+func trimIncompleteRune(b []byte) []byte {
+	for i := 1; i <= utf8.UTFMax && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if !utf8.FullRune(b[len(b)-i:]) {
+				return b[:len(b)-i]
+			}
+			break
+		}
+	}
+	return b
+}
+
 func textPreview(body []byte) string {
 	var b strings.Builder
 	for _, r := range string(body) {
@@ -8,12 +8,19 @@ import (
 	"image"
 	"image/color"
 	"image/png"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/spf13/cobra"
+
 	"github.com/nakabonne/pbgopy/cache/memorycache"
 )
 
@@ -80,6 +87,61 @@ func TestHistoryLimitPasteByIDAndBinaryRoundTrip(t *testing.T) {
 	}
 }
 
+func TestHistoryLargeBodyRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openHistoryStore(dir, historyPolicy{limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &serveRunner{history: store, spoolDir: filepath.Join(dir, historyTmpDir)}
+	handler := r.newServer().Handler
+	body := bytes.Repeat([]byte{0x00, 0xff, 0x10, 0x20}, uploadMemoryLimit)
+
+	putClipboard(t, handler, body, false)
+	rr := serveHistoryRequest(t, handler, http.MethodGet, "/", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET / status: got %d want %d", rr.Code, http.StatusOK)
+	}
+	if got := rr.Header().Get("Content-Length"); got != strconv.Itoa(len(body)) {
+		t.Fatalf("Content-Length: got %s want %d", got, len(body))
+	}
+	if !bytes.Equal(rr.Body.Bytes(), body) {
+		t.Fatalf("large body differs: got %d bytes want %d", rr.Body.Len(), len(body))
+	}
+	if files, _ := os.ReadDir(r.spoolDir); len(files) != 0 {
+		t.Fatalf("temporary files left: %v", files)
+	}
+}
+
+func TestHistorySizeLimits(t *testing.T) {
+	r := &serveRunner{entrySizeLimit: 8, totalSizeLimit: 12}
+	handler := r.newServer().Handler
+
+	rr := serveHistoryRequest(t, handler, http.MethodPut, "/", []byte("123456789"))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("PUT over the entry size: got %d want %d", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+	// Without Content-Length, the body is cut off while being read.
+	req := httptest.NewRequest(http.MethodPut, "/", io.MultiReader(strings.NewReader("12345"), strings.NewReader("6789")))
+	req.ContentLength = -1
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("chunked PUT over the entry size: got %d want %d", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+	if entries := getHistory(t, handler); len(entries) != 0 {
+		t.Fatalf("rejected uploads were stored: %+v", entries)
+	}
+
+	for _, body := range []string{"first", "second", "third"} {
+		putClipboard(t, handler, []byte(body), false)
+	}
+	entries := getHistory(t, handler)
+	if len(entries) != 2 || entries[0].Preview != "third" || entries[1].Preview != "second" {
+		t.Fatalf("history over the total size: %+v", entries)
+	}
+}
+
 func TestHistoryMetadataPreviewKinds(t *testing.T) {
 	now := time.Date(2026, 4, 29, 10, 0, 0, 0, time.FixedZone("JST", 9*60*60))
 
@@ -141,25 +203,109 @@ func TestHistoryEncryptedServerEntryDoesNotExposePlaintext(t *testing.T) {
 	}
 }
 
+func TestHistoryContentTypeRoundTrip(t *testing.T) {
+	handler := newHistoryTestHandler(10, 0)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	put := func(body []byte, header map[string]string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPut, "/", bytes.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	latest := func() *httptest.ResponseRecorder {
+		t.Helper()
+		rr := serveHistoryRequest(t, handler, http.MethodGet, "/", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET / status: got %d want %d", rr.Code, http.StatusOK)
+		}
+		return rr
+	}
+
+	// The declared type wins over the detected one.
+	if code := put([]byte("# Title"), map[string]string{"Content-Type": "text/markdown; charset=utf-8"}); code != http.StatusOK {
+		t.Fatalf("PUT markdown: got %d", code)
+	}
+	rr := latest()
+	if got := rr.Header().Get("Content-Type"); got != "text/markdown; charset=utf-8" {
+		t.Fatalf("markdown Content-Type: got %q", got)
+	}
+	if got := rr.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Fatalf("X-Content-Type-Options: got %q", got)
+	}
+
+	// The form type curl sends by default is ignored.
+	if code := put([]byte("plain"), map[string]string{"Content-Type": "application/x-www-form-urlencoded"}); code != http.StatusOK {
+		t.Fatalf("PUT form: got %d", code)
+	}
+	if entry := getHistory(t, handler)[0]; entry.MIME != "text/plain; charset=utf-8" {
+		t.Fatalf("form entry MIME: got %q", entry.MIME)
+	}
+
+	// The type of encrypted data is kept apart from the ciphertext.
+	if code := put([]byte("ciphertext"), map[string]string{historyEncryptedHeader: "true", historyContentTypeHeader: "image/png"}); code != http.StatusOK {
+		t.Fatalf("PUT encrypted: got %d", code)
+	}
+	rr = latest()
+	if got := rr.Header().Get("Content-Type"); got != "application/octet-stream" {
+		t.Fatalf("encrypted Content-Type: got %q", got)
+	}
+	if rr.Header().Get(historyContentTypeHeader) != "image/png" || rr.Header().Get(historyEncryptedHeader) != "true" {
+		t.Fatalf("encrypted headers: got %v", rr.Header())
+	}
+	if entry := getHistory(t, handler)[0]; historyDisplayType(entry) != "encrypted image/png" {
+		t.Fatalf("encrypted display type: got %q", historyDisplayType(entry))
+	}
+
+	if code := put([]byte("data"), map[string]string{historyContentTypeHeader: "not a type/"}); code != http.StatusBadRequest {
+		t.Fatalf("PUT with an invalid type: got %d want %d", code, http.StatusBadRequest)
+	}
+
+	// The client detects the type before encryption, or takes the given one.
+	r := &copyRunner{password: "secret"}
+	if err := r.upload(server.Client(), server.URL, testPNG(t, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if entry := getHistory(t, handler)[0]; entry.Kind != historyKindEncrypted || entry.MIME != "image/png" {
+		t.Fatalf("uploaded PNG: got %+v", entry)
+	}
+	r = &copyRunner{mime: "application/json"}
+	if err := r.upload(server.Client(), server.URL, []byte(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := latest().Header().Get("Content-Type"); got != "application/json" {
+		t.Fatalf("uploaded JSON Content-Type: got %q", got)
+	}
+	r = &copyRunner{mime: "bad/"}
+	if err := r.upload(server.Client(), server.URL, []byte("data")); err == nil {
+		t.Fatal("uploaded with an invalid --mime")
+	}
+}
+
 func TestHistoryListExcludesExpiredEntries(t *testing.T) {
 	base := time.Date(2026, 4, 29, 10, 0, 0, 0, time.UTC)
 	now := base
-	store := newHistoryStore(10, time.Second)
+	store := newHistoryStore(historyPolicy{limit: 10, ttl: time.Second})
 	store.now = func() time.Time { return now }
 
-	item, err := store.Add([]byte("expired"), false)
+	item, err := store.Add(newTestUpload(t, []byte("expired"), false))
 	if err != nil {
 		t.Fatal(err)
 	}
 	now = base.Add(2 * time.Second)
 
-	if entries := store.List(); len(entries) != 0 {
+	if entries, _ := store.List(); len(entries) != 0 {
 		t.Fatalf("history length after expiration: got %d want 0", len(entries))
 	}
-	if _, ok := store.Get(item.ID); ok {
+	if _, _, err := readHistory(store.Get(item.ID)); err != ErrHistoryNotFound {
 		t.Fatalf("expired entry should not be pasteable")
 	}
-	if _, ok := store.Latest(); ok {
+	if _, _, err := readHistory(store.Latest()); err != ErrHistoryNotFound {
 		t.Fatalf("expired entry should not be latest")
 	}
 }
@@ -208,6 +354,263 @@ func TestHistoryClear(t *testing.T) {
 	}
 }
 
+func TestHistoryPin(t *testing.T) {
+	handler := newHistoryTestHandler(1, 0)
+	putClipboard(t, handler, []byte("snippet"), false)
+	snippet := getHistory(t, handler)[0]
+	t.Setenv(pbgopyServerEnv, "http://pbgopy.test/")
+
+	var stdout bytes.Buffer
+	r := &historyRunner{timeout: time.Second, stdout: &stdout, client: newHandlerClient(handler)}
+	if err := r.pin(nil, []string{snippet.ID}); err != nil {
+		t.Fatal(err)
+	}
+	putClipboard(t, handler, []byte("first"), false)
+	putClipboard(t, handler, []byte("second"), false)
+	entries := getHistory(t, handler)
+	if len(entries) != 2 || entries[0].Preview != "second" || entries[1].ID != snippet.ID || !entries[1].Pinned {
+		t.Fatalf("history with a pinned entry: %+v", entries)
+	}
+	if err := r.list(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(stdout.String(), "\n")
+	if !strings.Contains(lines[0], "PINNED") || !strings.Contains(lines[2], snippet.ID) || strings.Count(lines[2], "*") != 1 {
+		t.Fatalf("history table: %q", stdout.String())
+	}
+
+	if err := r.unpin(nil, []string{snippet.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if entries := getHistory(t, handler); len(entries) != 1 || entries[0].Preview != "second" {
+		t.Fatalf("history after unpin: %+v", entries)
+	}
+	if err := r.pin(nil, []string{snippet.ID}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("pin of a missing entry: got %v", err)
+	}
+	for _, body := range []string{`{"pinned": "yes"}`, `{"pined": true}`} {
+		if rr := serveHistoryRequest(t, handler, http.MethodPatch, historyPath+"/"+entries[0].ID, []byte(body)); rr.Code != http.StatusBadRequest {
+			t.Fatalf("PATCH %s: got %d want %d", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestHistoryEntryTTL(t *testing.T) {
+	r := &serveRunner{cache: memorycache.NewCache(), historyLimit: 3, ttl: time.Hour, maxTTL: 10 * time.Minute}
+	handler := r.newServer().Handler
+	t.Setenv(pbgopyServerEnv, "http://pbgopy.test/")
+	c := &copyRunner{ttl: time.Minute}
+	start := time.Now()
+	if err := c.upload(newHandlerClient(handler), "http://pbgopy.test/", []byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	entry := getHistory(t, handler)[0]
+	if entry.ExpiresAt == nil || entry.ExpiresAt.Before(start.Add(time.Minute)) || entry.ExpiresAt.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("entry copied with --ttl 1m expires at %v", entry.ExpiresAt)
+	}
+
+	var stdout bytes.Buffer
+	h := &historyRunner{timeout: time.Second, ttl: time.Hour, stdout: &stdout, client: newHandlerClient(handler)}
+	if err := h.touch(nil, []string{entry.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.list(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Cut down to the max TTL of the server.
+	lines := strings.Split(stdout.String(), "\n")
+	if fields := strings.Fields(lines[1]); !strings.Contains(lines[0], "TTL") || (fields[2] != "9m" && fields[2] != "10m") {
+		t.Fatalf("history table: %q", stdout.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader("data"))
+	req.Header.Set(historyTTLHeader, "-1m")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("PUT with a negative TTL: got %d want %d", rr.Code, http.StatusBadRequest)
+	}
+	if rr := serveHistoryRequest(t, handler, http.MethodPatch, historyPath+"/"+entry.ID, []byte(`{"ttl": "-1m"}`)); rr.Code != http.StatusBadRequest {
+		t.Fatalf("PATCH with a negative TTL: got %d want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHistoryMaxReads(t *testing.T) {
+	handler := newHistoryTestHandler(3, 0)
+	t.Setenv(pbgopyServerEnv, "http://pbgopy.test/")
+	putClipboard(t, handler, []byte("older"), false)
+	c := &copyRunner{maxReads: 2}
+	if err := c.upload(newHandlerClient(handler), "http://pbgopy.test/", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	entry := getHistory(t, handler)[0]
+	if entry.ReadsLeft == nil || *entry.ReadsLeft != 2 {
+		t.Fatalf("entry copied with --max-reads 2: %+v", entry)
+	}
+	path := historyPath + "/" + entry.ID
+
+	// Neither HEAD nor a conditional GET of what the client already has counts.
+	if rr := serveHistoryRequest(t, handler, http.MethodHead, path, nil); rr.Code != http.StatusOK {
+		t.Fatalf("HEAD: got %d", rr.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("If-None-Match", strconv.Quote(entry.SHA256))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("conditional GET: got %d", rr.Code)
+	}
+	// A range is served whole so as not to spend a read on a part.
+	req = httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Range", "bytes=0-1")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "secret" || rr.Header().Get(historyReadsLeftHeader) != "1" || rr.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("first read: got %d %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+	if entry := getHistory(t, handler)[0]; entry.ReadsLeft == nil || *entry.ReadsLeft != 1 {
+		t.Fatalf("entry after a read: %+v", entry)
+	}
+	if rr := serveHistoryRequest(t, handler, http.MethodGet, "/", nil); rr.Body.String() != "secret" || rr.Header().Get(historyReadsLeftHeader) != "0" {
+		t.Fatalf("last read: got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := serveHistoryRequest(t, handler, http.MethodGet, path, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("read of an entry read up: got %d want %d", rr.Code, http.StatusNotFound)
+	}
+	if rr := serveHistoryRequest(t, handler, http.MethodGet, "/", nil); rr.Body.String() != "older" {
+		t.Fatalf("latest after the entry is read up: got %q", rr.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/", strings.NewReader("data"))
+	req.Header.Set(historyMaxReadsHeader, "-1")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("PUT with negative max reads: got %d want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHistoryTags(t *testing.T) {
+	handler := newHistoryTestHandler(5, 0)
+	t.Setenv(pbgopyServerEnv, "http://pbgopy.test/")
+	c := &copyRunner{tags: []string{"k8s"}, note: "prod kubeconfig 🔑"}
+	if err := c.upload(newHandlerClient(handler), "http://pbgopy.test/", []byte("apiVersion: v1")); err != nil {
+		t.Fatal(err)
+	}
+	putClipboard(t, handler, []byte("newer"), false)
+	kubeconfig := getHistory(t, handler)[1]
+	if !kubeconfig.HasTag("k8s") || kubeconfig.Note != "prod kubeconfig 🔑" {
+		t.Fatalf("entry copied with --tag and --note: %+v", kubeconfig)
+	}
+
+	var stdout bytes.Buffer
+	p := &pasteRunner{maxBufSize: "500mb", tag: "k8s", stdout: &stdout, client: newHandlerClient(handler)}
+	if err := p.run(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "apiVersion: v1" {
+		t.Fatalf("paste --tag: got %q", stdout.String())
+	}
+	p.tag = "missing"
+	if err := p.run(nil, nil); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("paste --tag of a missing tag: got %v", err)
+	}
+
+	stdout.Reset()
+	h := &historyRunner{timeout: time.Second, tag: "k8s", stdout: &stdout, client: newHandlerClient(handler)}
+	if err := h.list(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "TAGS") || !strings.Contains(lines[1], kubeconfig.ID) || !strings.Contains(lines[1], `"prod kubeconfig 🔑"`) {
+		t.Fatalf("history --tag: %q", stdout.String())
+	}
+
+	// Only the flags given are changed.
+	edit := func(args ...string) {
+		t.Helper()
+		cmd := &cobra.Command{}
+		cmd.Flags().StringSliceVar(&h.tags, "tag", nil, "")
+		cmd.Flags().StringVar(&h.note, "note", "", "")
+		if err := cmd.ParseFlags(args); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.edit(cmd, []string{kubeconfig.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	edit("--tag", "staging", "--tag", "k8s")
+	if entry := getHistory(t, handler)[1]; !reflect.DeepEqual(entry.Tags, []string{"staging", "k8s"}) || entry.Note != kubeconfig.Note {
+		t.Fatalf("entry after edit --tag: %+v", entry)
+	}
+	edit("--note", "")
+	if entry := getHistory(t, handler)[1]; len(entry.Tags) != 2 || entry.Note != "" {
+		t.Fatalf("entry after edit --note: %+v", entry)
+	}
+
+	for _, header := range []map[string]string{
+		{historyTagsHeader: "a b"},
+		{historyTagsHeader: strings.Repeat("t,", historyMaxTags) + "t"},
+		{historyNoteHeader: "%zz"},
+	} {
+		req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader("data"))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("PUT with %v: got %d want %d", header, rr.Code, http.StatusBadRequest)
+		}
+	}
+	if rr := serveHistoryRequest(t, handler, http.MethodPatch, historyPath+"/"+kubeconfig.ID, []byte(`{"tags": ["a,b"]}`)); rr.Code != http.StatusBadRequest {
+		t.Fatalf("PATCH with an invalid tag: got %d want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestLatestTaggedEntryRemovedAfterListed(t *testing.T) {
+	history := &removedOnOpenHistory{HistoryBackend: newHistoryStore(historyPolicy{limit: 5})}
+	r := &serveRunner{cache: memorycache.NewCache(), history: history}
+	handler := r.newServer().Handler
+	for _, body := range []string{"older", "newer"} {
+		req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body))
+		req.Header.Set(historyTagsHeader, "k8s")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", body, rr.Code)
+		}
+	}
+	// The newest tagged entry is removed between listing the history and opening its body.
+	history.removed = getHistory(t, handler)[0].ID
+
+	rr := serveHistoryRequest(t, handler, http.MethodGet, "/?"+historyTagQuery+"=k8s", nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != "older" {
+		t.Fatalf("GET /?tag=k8s: status %d body %q", rr.Code, rr.Body.String())
+	}
+}
+
+// removedOnOpenHistory removes the entry with the given id when its body is opened, as if by another client
+// right after the entry is listed.
+type removedOnOpenHistory struct {
+	HistoryBackend
+	removed string
+}
+
+func (h *removedOnOpenHistory) Get(id string) (HistoryEntry, io.ReadSeekCloser, error) {
+	if id == h.removed {
+		h.HistoryBackend.Delete(id)
+	}
+	return h.HistoryBackend.Get(id)
+}
+
+func (h *removedOnOpenHistory) Read(id string) (HistoryEntry, io.ReadSeekCloser, error) {
+	if id == h.removed {
+		h.HistoryBackend.Delete(id)
+	}
+	return h.HistoryBackend.Read(id)
+}
+
 func TestPasteRunnerPasteByID(t *testing.T) {
 	handler := newHistoryTestHandler(3, 0)
 	putClipboard(t, handler, []byte("first"), false)
@@ -0,0 +1,294 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// uploadMemoryLimit is the size up to which an upload is kept in memory
+	// before it is spooled to a temporary file.
+	uploadMemoryLimit = 1 << 20
+	// historySniffLen is how much of the head of a body is kept to detect its type and to make its preview.
+	historySniffLen = 64 << 10
+)
+
+// HistoryUpload is a body to be added to the history.
+// Its digest and the head used to detect its type are computed while it streams in,
+// so that the whole body never has to be held in memory.
+type HistoryUpload struct {
+	// Encrypted reports whether the body has been encrypted by the client.
+	Encrypted bool
+	// MIME is the type of the body declared by the client, or of the plaintext if it is encrypted.
+	// Empty means it is detected from the body.
+	MIME string
+	// ContentEncoding is how the client compressed the body before encryption, if it did.
+	ContentEncoding string
+	// CreatedBy is the name of the client who uploaded the body, if authenticated.
+	CreatedBy string
+	// TTL is how long the client asks the entry to be kept. Zero means the default of the backend.
+	TTL time.Duration
+	// MaxReads is how many times the entry can be read before it is deleted. Zero means unlimited.
+	MaxReads int
+	// Tags are the labels the client gives the entry.
+	Tags []string
+	// Note is the free-text description the client gives the entry.
+	Note string
+
+	size   int64
+	sha256 string
+	head   []byte
+	text   bool
+	// data is the body if it fits in uploadMemoryLimit; path is the temporary file holding it otherwise.
+	data []byte
+	path string
+}
+
+// spoolUpload reads r to the end. A body larger than uploadMemoryLimit is written to a temporary file in dir,
+// or in the default directory for temporary files if dir is empty. The caller must Close the upload.
+func spoolUpload(r io.Reader, dir string) (*HistoryUpload, error) {
+	sw := &spoolWriter{dir: dir}
+	digest := sha256.New()
+	text := &textDetector{}
+	head := &headWriter{limit: historySniffLen}
+	n, err := io.Copy(io.MultiWriter(digest, text, head, sw), r)
+	if cerr := sw.close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		sw.remove()
+		return nil, err
+	}
+	return &HistoryUpload{
+		size:   n,
+		sha256: hex.EncodeToString(digest.Sum(nil)),
+		head:   head.buf,
+		text:   text.valid(),
+		data:   sw.buf.Bytes(),
+		path:   sw.path(),
+	}, nil
+}
+
+// Size gives back the size of the body in bytes.
+func (u *HistoryUpload) Size() int64 {
+	return u.size
+}
+
+// SHA256 gives back the hex-encoded SHA-256 digest of the body.
+func (u *HistoryUpload) SHA256() string {
+	return u.sha256
+}
+
+// Open gives back a reader of the body.
+func (u *HistoryUpload) Open() (io.ReadSeekCloser, error) {
+	return u.blob().open()
+}
+
+// Close removes the temporary file unless a backend has taken it over.
+func (u *HistoryUpload) Close() error {
+	if u.path == "" {
+		return nil
+	}
+	err := os.Remove(u.path)
+	u.path = ""
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// detach hands the body over to the caller, who becomes responsible for removing it.
+func (u *HistoryUpload) detach() *historyBlob {
+	b := u.blob()
+	b.refs = 1
+	u.path = ""
+	return b
+}
+
+// moveTo durably stores the body at the given path. A temporary file is renamed when possible
+// instead of being copied, so the upload should be spooled on the same file system.
+func (u *HistoryUpload) moveTo(path string) error {
+	if u.path == "" {
+		return writeFileAtomic(path, u.data)
+	}
+	f, err := os.OpenFile(u.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(u.path, path); err == nil {
+		u.path = ""
+		return syncDir(filepath.Dir(path))
+	}
+	// Fall back to copying, e.g. across file systems.
+	src, err := os.Open(u.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return writeFileAtomicFrom(path, src)
+}
+
+func (u *HistoryUpload) blob() *historyBlob {
+	return &historyBlob{data: u.data, path: u.path}
+}
+
+// historyBlob is an immutable body kept either in memory or in a file.
+type historyBlob struct {
+	data []byte
+	path string
+	// refs is the number of entries sharing the body, guarded by the lock of the store.
+	refs int
+}
+
+func (b *historyBlob) open() (io.ReadSeekCloser, error) {
+	if b.path == "" {
+		return nopSeekCloser{bytes.NewReader(b.data)}, nil
+	}
+	return os.Open(b.path)
+}
+
+// remove deletes the file holding the body, if any.
+// Readers that have already opened it can keep reading on Unix-like systems.
+func (b *historyBlob) remove() error {
+	if b.path == "" {
+		return nil
+	}
+	if err := os.Remove(b.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+// spoolWriter buffers writes in memory and switches to a temporary file
+// once they exceed uploadMemoryLimit.
+type spoolWriter struct {
+	dir  string
+	buf  bytes.Buffer
+	file *os.File
+}
+
+func (w *spoolWriter) Write(p []byte) (int, error) {
+	if w.file == nil && w.buf.Len()+len(p) > uploadMemoryLimit {
+		f, err := os.CreateTemp(w.dir, "upload-*")
+		if err != nil {
+			return 0, fmt.Errorf("failed to create a temporary file: %w", err)
+		}
+		w.file = f
+		if _, err := f.Write(w.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		w.buf = bytes.Buffer{}
+	}
+	if w.file != nil {
+		return w.file.Write(p)
+	}
+	return w.buf.Write(p)
+}
+
+func (w *spoolWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
+
+func (w *spoolWriter) remove() {
+	if w.file != nil {
+		os.Remove(w.file.Name())
+	}
+}
+
+func (w *spoolWriter) path() string {
+	if w.file == nil {
+		return ""
+	}
+	return w.file.Name()
+}
+
+// headWriter keeps the first limit bytes written to it.
+type headWriter struct {
+	limit int
+	buf   []byte
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if rest := w.limit - len(w.buf); rest > 0 {
+		if len(p) < rest {
+			rest = len(p)
+		}
+		w.buf = append(w.buf, p[:rest]...)
+	}
+	return len(p), nil
+}
+
+// textDetector reports whether everything written to it is valid UTF-8 without control characters
+// other than newlines and tabs, the same as isLikelyText does for a whole body.
+type textDetector struct {
+	pending [utf8.UTFMax]byte
+	npend   int
+	binary  bool
+}
+
+func (d *textDetector) Write(p []byte) (int, error) {
+	n := len(p)
+	if d.binary {
+		return n, nil
+	}
+	// Complete the rune split by the previous write.
+	for d.npend > 0 && len(p) > 0 {
+		d.pending[d.npend] = p[0]
+		d.npend++
+		p = p[1:]
+		if utf8.FullRune(d.pending[:d.npend]) {
+			r, size := utf8.DecodeRune(d.pending[:d.npend])
+			d.check(r, size)
+			d.npend = 0
+		}
+	}
+	for len(p) > 0 && !d.binary {
+		if !utf8.FullRune(p) {
+			d.npend = copy(d.pending[:], p)
+			break
+		}
+		r, size := utf8.DecodeRune(p)
+		d.check(r, size)
+		p = p[size:]
+	}
+	return n, nil
+}
+
+func (d *textDetector) check(r rune, size int) {
+	if r == utf8.RuneError && size == 1 {
+		d.binary = true
+		return
+	}
+	if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+		d.binary = true
+	}
+}
+
+func (d *textDetector) valid() bool {
+	return !d.binary && d.npend == 0
+}
@@ -0,0 +1,130 @@
+package commands
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestSpoolUploadKeepsSmallBodyInMemory(t *testing.T) {
+	dir := t.TempDir()
+	upload, err := spoolUpload(strings.NewReader("small"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upload.Close()
+	if upload.path != "" || string(upload.data) != "small" {
+		t.Fatalf("small upload: path %q data %q", upload.path, upload.data)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("unexpected temporary files: %v", files)
+	}
+	if upload.Size() != 5 || upload.SHA256() != newHistoryEntry("", time.Time{}, []byte("small"), false).SHA256 {
+		t.Fatalf("size %d sha256 %s", upload.Size(), upload.SHA256())
+	}
+}
+
+func TestSpoolUploadWritesLargeBodyToFile(t *testing.T) {
+	dir := t.TempDir()
+	body := bytes.Repeat([]byte{0x00, 0xff}, uploadMemoryLimit)
+	// Feed it in small reads to exercise the switch from memory to the file.
+	upload, err := spoolUpload(iotest.HalfReader(bytes.NewReader(body)), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.path == "" || filepath.Dir(upload.path) != dir || upload.data != nil {
+		t.Fatalf("large upload: path %q, %d bytes in memory", upload.path, len(upload.data))
+	}
+	if len(upload.head) != historySniffLen || upload.text {
+		t.Fatalf("head of %d bytes, text %v", len(upload.head), upload.text)
+	}
+
+	r, err := upload.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("spooled body differs: %d bytes err %v", len(got), err)
+	}
+
+	if err := upload.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("temporary files left after close: %v", files)
+	}
+}
+
+func TestDiskHistoryStoreTakesOverSpooledFile(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openHistoryStore(dir, historyPolicy{limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(dir, historyTmpDir)
+	upload, err := spoolUpload(bytes.NewReader(make([]byte, 2*uploadMemoryLimit)), tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := store.Add(upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upload.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(tmp); len(files) != 0 {
+		t.Fatalf("temporary files left: %v", files)
+	}
+	if got := bodyFiles(t, dir); len(got) != 1 || got[0] != entry.ID {
+		t.Fatalf("body files: %v", got)
+	}
+}
+
+func TestTextDetector(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want bool
+	}{
+		{name: "ascii", body: "hello\tworld\r\n", want: true},
+		{name: "multi-byte", body: "こんにちは 世界 🌏", want: true},
+		{name: "control", body: "bell\a", want: false},
+		{name: "invalid", body: "caf\xe9", want: false},
+		{name: "truncated", body: "世界"[:4], want: false},
+		{name: "empty", body: "", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLikelyText([]byte(tt.body)); got != tt.want {
+				t.Fatalf("isLikelyText: got %v want %v", got, tt.want)
+			}
+			// Split the body at every position, so that runes are cut across writes.
+			for i := 0; i <= len(tt.body); i++ {
+				d := &textDetector{}
+				d.Write([]byte(tt.body[:i]))
+				d.Write([]byte(tt.body[i:]))
+				if got := d.valid(); got != tt.want {
+					t.Fatalf("split at %d: got %v want %v", i, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLargeTextPreviewIsTruncated(t *testing.T) {
+	// The head ends in the middle of a three-byte rune.
+	body := []byte(strings.Repeat(" ", historySniffLen-1) + "世界")
+	upload := newTestUpload(t, body, false)
+	entry := newHistoryEntryFromUpload("id", time.Time{}, upload)
+	if entry.Kind != historyKindText || entry.Preview != "..." {
+		t.Fatalf("entry: %+v", entry)
+	}
+}
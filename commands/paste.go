@@ -9,7 +9,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
-	"os"
+	"net/url"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -26,12 +26,22 @@ type pasteRunner struct {
 	gpgUserID              string
 	gpgPath                string
 	basicAuth              string
+	channel                string
+	token                  string
+	tls                    tlsClientOptions
 	maxBufSize             string
 	id                     string
+	tag                    string
+	watch                  bool
+	toClipboard            bool
+	extract                string
+	output                 string
+	resume                 bool
 
-	stdout io.Writer
-	stderr io.Writer
-	client *http.Client
+	stdout    io.Writer
+	stderr    io.Writer
+	client    *http.Client
+	clipboard clipboardAccessor
 }
 
 func NewPasteCommand(stdout, stderr io.Writer) *cobra.Command {
@@ -44,7 +54,12 @@ func NewPasteCommand(stdout, stderr io.Writer) *cobra.Command {
 		Short: "Paste to stdout",
 		Example: `  export PBGOPY_SERVER=http://host.xz:9090
   pbgopy paste >hello.txt
-  pbgopy paste --id <entry-id> >hello.txt`,
+  pbgopy paste --id <entry-id> >hello.txt
+  pbgopy paste --tag k8s >kubeconfig
+  pbgopy paste --watch
+  pbgopy paste --to-clipboard
+  pbgopy paste --extract ./dest
+  pbgopy paste --output backup.tar --resume`,
 		RunE: r.run,
 	}
 	cmd.Flags().DurationVar(&r.timeout, "timeout", 5*time.Second, "Time limit for requests")
@@ -55,28 +70,69 @@ func NewPasteCommand(stdout, stderr io.Writer) *cobra.Command {
 	cmd.Flags().StringVar(&r.gpgPath, "gpg-path", defaultGPGExecutablePath, "Path to gpg executable")
 	cmd.Flags().StringVar(&r.privateKeyPasswordFile, "private-key-password-file", "", "Path to password file to decrypt the encrypted private key")
 	cmd.Flags().StringVarP(&r.basicAuth, "basic-auth", "a", "", "Basic authentication, username:password")
+	r.tls.addFlags(cmd.Flags())
+	cmd.Flags().StringVar(&r.token, "token", "", "API token to authenticate with. Defaults to $PBGOPY_TOKEN")
+	cmd.Flags().StringVar(&r.channel, "channel", "", "Name of the channel to use. Defaults to $PBGOPY_CHANNEL, or the default channel if it is not set either")
 	cmd.Flags().StringVar(&r.maxBufSize, "max-size", "500mb", "Max data size with unit")
 	cmd.Flags().StringVar(&r.id, "id", "", "History entry id to paste")
+	cmd.Flags().StringVar(&r.tag, "tag", "", "Paste the latest entry with the given tag")
+	cmd.Flags().BoolVarP(&r.toClipboard, "to-clipboard", "c", false, "Write the data to the local clipboard instead of stdout. Only text can be written")
+	cmd.Flags().StringVarP(&r.extract, "extract", "x", "", "Extract the files and directories copied with \"pbgopy copy PATH...\" into the given directory")
+	cmd.Flags().StringVarP(&r.output, "output", "o", "", "Write the data to the given file instead of stdout, replacing it only once the download completes")
+	cmd.Flags().BoolVar(&r.resume, "resume", false, "Continue the interrupted download to --output, if it is of the same data")
+	cmd.Flags().BoolVarP(&r.watch, "watch", "w", false, "Keep printing each new entry as it arrives, separated by newlines")
 	return cmd
 }
 
 func (r *pasteRunner) run(_ *cobra.Command, _ []string) error {
-	address := os.Getenv(pbgopyServerEnv)
-	if address == "" {
-		return fmt.Errorf("put the pbgopy server's address into %s environment variable", pbgopyServerEnv)
+	address, err := serverAddress(r.channel)
+	if err != nil {
+		return err
+	}
+	client, err := r.httpClient()
+	if err != nil {
+		return err
+	}
+	if r.extract != "" && (r.watch || r.toClipboard) {
+		return fmt.Errorf("can't specify --extract along with --watch or --to-clipboard")
+	}
+	if r.output != "" && (r.watch || r.toClipboard || r.extract != "") {
+		return fmt.Errorf("can't specify --output along with --watch, --to-clipboard or --extract")
+	}
+	if r.resume && r.output == "" {
+		return fmt.Errorf("--resume requires --output")
+	}
+	if r.id != "" && r.tag != "" {
+		return fmt.Errorf("can't specify both --id and --tag")
+	}
+	if r.watch {
+		if r.id != "" || r.tag != "" {
+			return fmt.Errorf("can't specify --id or --tag along with --watch")
+		}
+		return r.runWatch(context.Background(), client, address)
 	}
-	client := r.httpClient()
 
 	// Start reading data.
 	reqURL := address
 	if r.id != "" {
 		reqURL = historyEntryURL(address, r.id)
 	}
+	if r.tag != "" {
+		reqURL = address + "?" + url.Values{historyTagQuery: {r.tag}}.Encode()
+	}
+	sizeInBytes, err := datasizeToBytes(r.maxBufSize)
+	if err != nil {
+		return fmt.Errorf("failed to parse data size: %w", err)
+	}
+	if r.output != "" {
+		return r.download(client, reqURL, sizeInBytes)
+	}
 	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
 	if err != nil {
 		return fmt.Errorf("failed to make request: %w", err)
 	}
 	addBasicAuthHeader(req, r.basicAuth)
+	addTokenHeader(req, r.token)
 	res, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to issue get request: %w", err)
@@ -85,10 +141,6 @@ func (r *pasteRunner) run(_ *cobra.Command, _ []string) error {
 	if res.StatusCode != http.StatusOK {
 		return failedRequestError(res)
 	}
-	sizeInBytes, err := datasizeToBytes(r.maxBufSize)
-	if err != nil {
-		return fmt.Errorf("failed to parse data size: %w", err)
-	}
 	data, err := readNoMoreThan(res.Body, sizeInBytes)
 	if err != nil {
 		return fmt.Errorf("failed to read the response body: %w", err)
@@ -99,20 +151,55 @@ func (r *pasteRunner) run(_ *cobra.Command, _ []string) error {
 	if err != nil {
 		return err
 	}
+	data, err = decodePayload(data, res.Header.Get(historyContentEncodingHeader), sizeInBytes)
+	if err != nil {
+		return err
+	}
 
+	if r.toClipboard {
+		return r.writeClipboard(data, res.Header.Get(historyContentTypeHeader))
+	}
+	if r.extract != "" {
+		if err := extractArchive(bytes.NewReader(data), r.extract); err != nil {
+			return fmt.Errorf("failed to extract into %s: %w", r.extract, err)
+		}
+		return nil
+	}
 	if _, err := r.stdout.Write(data); err != nil {
 		return fmt.Errorf("failed to write to stdout: %w", err)
 	}
 	return nil
 }
 
-func (r *pasteRunner) httpClient() *http.Client {
+// writeClipboard writes the data of the given MIME type to the clipboard.
+func (r *pasteRunner) writeClipboard(data []byte, mimeType string) error {
+	c := r.clipboard
+	if c == nil {
+		c = systemClipboard{}
+	}
+	err := writeClipboard(c, data)
+	if errors.Is(err, errNotText) && mimeType != "" {
+		return fmt.Errorf("%w: it is %s; paste it to stdout instead, e.g. pbgopy paste >file", err, mimeType)
+	}
+	if errors.Is(err, errNotText) {
+		return fmt.Errorf("%w; paste it to stdout instead, e.g. pbgopy paste >file", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write to the clipboard: %w", err)
+	}
+	return nil
+}
+
+func (r *pasteRunner) httpClient() (*http.Client, error) {
 	if r.client != nil {
-		return r.client
+		return r.client, nil
 	}
-	return &http.Client{
-		Timeout: r.timeout,
+	timeout := r.timeout
+	if r.watch && timeout > 0 {
+		// Watch requests are held by the server until a new entry arrives.
+		timeout += defaultWatchTimeout
 	}
+	return newHTTPClient(timeout, r.tls)
 }
 
 // decrypts with the user-specified way. It directly gives back the given data if any key doesn't exists.
@@ -1 +1,50 @@
 package commands
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPasteToClipboard(t *testing.T) {
+	handler := newHistoryTestHandler(3, 0)
+	t.Setenv(pbgopyServerEnv, "http://pbgopy.test")
+
+	tests := []struct {
+		name    string
+		body    []byte
+		want    string
+		wantErr error
+	}{
+		{name: "text", body: []byte("hello\nworld"), want: "hello\nworld"},
+		{name: "image", body: testPNG(t, 2, 2), wantErr: errNotText},
+		{name: "binary", body: []byte{0x00, 0xff, 0x10}, wantErr: errNotText},
+	}
+	for _, tt := range tests {
+		putClipboard(t, handler, tt.body, false)
+		var stdout bytes.Buffer
+		clipboard := &fakeClipboard{text: "untouched"}
+		r := &pasteRunner{
+			timeout:     time.Second,
+			maxBufSize:  "500mb",
+			toClipboard: true,
+			stdout:      &stdout,
+			client:      newHandlerClient(handler),
+			clipboard:   clipboard,
+		}
+		err := r.run(nil, nil)
+		if !errors.Is(err, tt.wantErr) {
+			t.Fatalf("%s: got error %v want %v", tt.name, err, tt.wantErr)
+		}
+		if tt.wantErr != nil {
+			tt.want = "untouched"
+		}
+		if text, _ := clipboard.ReadAll(); text != tt.want {
+			t.Fatalf("%s: clipboard got %q want %q", tt.name, text, tt.want)
+		}
+		if stdout.Len() != 0 {
+			t.Fatalf("%s: written to stdout: %q", tt.name, stdout.String())
+		}
+	}
+}
@@ -1,14 +1,20 @@
 package commands
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,6 +22,7 @@ import (
 
 	"github.com/nakabonne/pbgopy/cache"
 	"github.com/nakabonne/pbgopy/cache/memorycache"
+	"github.com/nakabonne/pbgopy/cache/rediscache"
 )
 
 const (
@@ -27,22 +34,82 @@ const (
 	lastUpdatedPath = "/lastupdated"
 	historyPath     = "/history"
 
-	dataCacheKey        = "data"
 	lastUpdatedCacheKey = "lastUpdated"
 
+	redisKeyPrefix = "pbgopy:"
+
 	historyEncryptedHeader = "X-Pbgopy-Encrypted"
+	// historyContentTypeHeader carries the MIME type of the data before encryption.
+	historyContentTypeHeader = "X-Pbgopy-Content-Type"
+	// historyTTLHeader carries how long the client asks the entry it uploads to be kept, e.g. "5m".
+	historyTTLHeader = "X-Pbgopy-Ttl"
+
+	// historyMaxReadsHeader carries how many times the entry the client uploads can be read before it is deleted.
+	historyMaxReadsHeader = "X-Pbgopy-Max-Reads"
+	// historyReadsLeftHeader carries how many more times the entry can be read, after the read it is sent by.
+	historyReadsLeftHeader = "X-Pbgopy-Reads-Left"
+	// historyTagsHeader carries the comma-separated tags of the entry the client uploads.
+	historyTagsHeader = "X-Pbgopy-Tags"
+	// historyNoteHeader carries the percent-encoded note of the entry the client uploads.
+	historyNoteHeader = "X-Pbgopy-Note"
+	// historyTagQuery is the query parameter to narrow down entries to those with the given tag.
+	historyTagQuery = "tag"
+	// historySearchQuery is the query parameter to search history for, as a substring unless historyRegexpQuery is "true".
+	historySearchQuery = "q"
+	// historyRegexpQuery makes the search query a regular expression if it is "true".
+	historyRegexpQuery = "regexp"
+	// historyIgnoreCaseQuery makes the search case-insensitive if it is "true".
+	historyIgnoreCaseQuery = "ignore_case"
+
+	// maxHistoryPatchSize is the maximum size of the JSON body of a PATCH request to a history entry.
+	maxHistoryPatchSize = 64 << 10
+
+	// historySHA256Header carries the hex-encoded SHA-256 digest of the body of a history entry, as it is stored.
+	historySHA256Header = "X-Pbgopy-Sha256"
 )
 
 type serveRunner struct {
 	port         int
 	ttl          time.Duration
+	maxTTL       time.Duration
 	historyLimit int
 	basicAuth    string
+	tokenFile    string
+	dataDir      string
+	redisURL     string
+	maxEntrySize string
+	maxTotalSize string
+	dedup        string
+	tlsCert      string
+	tlsKey       string
+	selfSigned   bool
+	clientCA     string
+	maxChannels  int
+	// channelTTLFlag and channelHistoryLimits are the TTLs and the history limits of the named channels,
+	// which default to those of the default channel.
+	channelTTLFlag       map[string]string
+	channelHistoryLimits map[string]int
+	// channelTTLs is the parsed channelTTLFlag.
+	channelTTLs map[string]time.Duration
+
+	// entrySizeLimit and totalSizeLimit are the parsed maxEntrySize and maxTotalSize in bytes. Zero means unlimited.
+	entrySizeLimit int64
+	totalSizeLimit int64
 
-	cache   cache.Cache
-	history *historyStore
-	stdout  io.Writer
-	stderr  io.Writer
+	tokens      *tokenSet
+	cache       cache.Cache
+	redisClient *rediscache.Client
+	// history is the history of the default channel.
+	history  HistoryBackend
+	channels *channelSet
+	routes   http.Handler
+	// done is closed when the server starts shutting down.
+	done chan struct{}
+	// spoolDir is where large uploads are temporarily written to.
+	// Empty means the default directory for temporary files.
+	spoolDir string
+	stdout   io.Writer
+	stderr   io.Writer
 }
 
 func NewServeCommand(stdout, stderr io.Writer) *cobra.Command {
@@ -60,25 +127,120 @@ func NewServeCommand(stdout, stderr io.Writer) *cobra.Command {
 
 	cmd.Flags().IntVarP(&r.port, "port", "p", defaultPort, "The port the server listens on")
 	cmd.Flags().DurationVar(&r.ttl, "ttl", defaultTTL, "The time that the contents is stored. Give 0s for disabling TTL")
+	cmd.Flags().DurationVar(&r.maxTTL, "max-ttl", 0, "The longest TTL clients can ask for an entry with \"copy --ttl\" or \"history touch --ttl\". Longer ones are cut down to it. Unlimited if not given")
 	cmd.Flags().IntVar(&r.historyLimit, "history-limit", defaultHistoryLimit, "Number of clipboard entries to retain. Give 0 for unlimited history")
 	cmd.Flags().StringVarP(&r.basicAuth, "basic-auth", "a", "", "Basic authentication, username:password")
+	cmd.Flags().StringVar(&r.tokenFile, "token-file", "", "Path to a file of API tokens, each line of which is \"<name> <token> <scopes>\" with comma-separated scopes out of read, write and admin")
+	cmd.Flags().StringVar(&r.dataDir, "data-dir", "", "Path to the directory to persist the clipboard history to. The history is kept only in memory if not given")
+	cmd.Flags().StringVar(&r.redisURL, "redis", "", "URL of a Redis server to share the clipboard among multiple pbgopy servers, e.g. redis://:password@host:6379/0")
+	cmd.Flags().StringVar(&r.tlsCert, "tls-cert", "", "Path to a PEM-encoded certificate to serve HTTPS with")
+	cmd.Flags().StringVar(&r.tlsKey, "tls-key", "", "Path to the PEM-encoded private key of the certificate")
+	cmd.Flags().BoolVar(&r.selfSigned, "tls-self-signed", false, "Serve HTTPS with a self-signed certificate, generated at --tls-cert/--tls-key, or in the data directory, on first run")
+	cmd.Flags().StringVar(&r.clientCA, "client-ca", "", "Path to a PEM-encoded CA certificate to require client certificates signed by. The certificate subject becomes the name of the client")
+	cmd.Flags().StringVar(&r.maxEntrySize, "max-entry-size", "", "Max size of a single entry with unit, e.g. 100mb. Larger uploads are rejected. Unlimited if not given")
+	cmd.Flags().StringVar(&r.maxTotalSize, "max-total-size", "", "Max total size of the history with unit, e.g. 1gb. The oldest entries are evicted to stay within it. Unlimited if not given")
+	cmd.Flags().IntVar(&r.maxChannels, "max-channels", defaultMaxChannels, "Max number of named channels. Writes to a new channel beyond it are rejected. Give 0 for unlimited")
+	cmd.Flags().StringToStringVar(&r.channelTTLFlag, "channel-ttl", nil, "TTLs of named channels, e.g. team-a=1h,scratch=5m. The --ttl if not given")
+	cmd.Flags().StringToIntVar(&r.channelHistoryLimits, "channel-history-limit", nil, "History limits of named channels, e.g. team-a=50. The --history-limit if not given")
+	cmd.Flags().StringVar(&r.dedup, "dedup", historyDedupShare, "What to do with a copy identical to an entry in the history: \"share\" to store the body once for both entries, \"collapse\" to move the entry to the latest instead of adding another one, or \"off\". \"share\" isn't supported with --redis, where the default is \"off\"")
 	return cmd
 }
 
-func (r *serveRunner) run(_ *cobra.Command, _ []string) error {
+func (r *serveRunner) run(cmd *cobra.Command, _ []string) error {
 	if r.historyLimit < 0 {
 		return fmt.Errorf("history-limit must be greater than or equal to 0")
 	}
+	if r.maxTTL < 0 {
+		return fmt.Errorf("max-ttl must be greater than or equal to 0")
+	}
+	if r.maxChannels < 0 {
+		return fmt.Errorf("max-channels must be greater than or equal to 0")
+	}
+	if err := r.parseChannelPolicies(); err != nil {
+		return err
+	}
+	if err := r.resolveDedup(cmd != nil && cmd.Flags().Changed("dedup")); err != nil {
+		return err
+	}
+	if r.dataDir != "" && r.redisURL != "" {
+		return fmt.Errorf("can't specify both --data-dir and --redis")
+	}
+	if (r.tlsCert == "") != (r.tlsKey == "") {
+		return fmt.Errorf("both --tls-cert and --tls-key must be given")
+	}
+	if r.clientCA != "" && r.tlsCert == "" && !r.selfSigned {
+		return fmt.Errorf("--client-ca requires either --tls-cert or --tls-self-signed")
+	}
+	if r.tokenFile != "" {
+		tokens, err := loadTokenFile(r.tokenFile)
+		if err != nil {
+			return err
+		}
+		r.tokens = tokens
+	}
+	if r.maxEntrySize != "" {
+		size, err := datasizeToBytes(r.maxEntrySize)
+		if err != nil {
+			return fmt.Errorf("failed to parse max-entry-size: %w", err)
+		}
+		r.entrySizeLimit = size
+	}
+	if r.maxTotalSize != "" {
+		size, err := datasizeToBytes(r.maxTotalSize)
+		if err != nil {
+			return fmt.Errorf("failed to parse max-total-size: %w", err)
+		}
+		r.totalSizeLimit = size
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	if r.ttl == 0 {
-		r.cache = memorycache.NewCache()
-	} else {
-		r.cache = memorycache.NewTTLCache(ctx, r.ttl, r.ttl)
+	switch {
+	case r.redisURL != "":
+		client, err := rediscache.NewClient(r.redisURL)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		if _, err := client.Do("PING"); err != nil {
+			return fmt.Errorf("failed to connect to redis: %w", err)
+		}
+		r.redisClient = client
+		r.cache = rediscache.NewCache(client, redisKeyPrefix, r.ttl)
+		r.history = newRedisHistoryStore(client, redisKeyPrefix+"history:", r.historyPolicy())
+	case r.dataDir != "":
+		history, err := openHistoryStore(r.dataDir, r.historyPolicy())
+		if err != nil {
+			return fmt.Errorf("failed to open the history in %s: %w", r.dataDir, err)
+		}
+		r.history = history
+		// Spool uploads next to the bodies so that they can be renamed into place instead of copied.
+		r.spoolDir = filepath.Join(r.dataDir, historyTmpDir)
+	default:
+		r.history = newHistoryStore(r.historyPolicy())
+	}
+	if r.spoolDir == "" {
+		dir, err := os.MkdirTemp("", "pbgopy-")
+		if err != nil {
+			return fmt.Errorf("failed to create a temporary directory: %w", err)
+		}
+		defer os.RemoveAll(dir)
+		r.spoolDir = dir
+	}
+	if r.cache == nil {
+		if r.ttl == 0 {
+			r.cache = memorycache.NewCache()
+		} else {
+			r.cache = memorycache.NewTTLCache(ctx, r.ttl, r.ttl)
+		}
 	}
-	r.history = newHistoryStore(r.historyLimit, r.ttl)
 
+	tlsConfig, err := r.tlsConfig()
+	if err != nil {
+		return err
+	}
 	server := r.newServer()
+	server.TLSConfig = tlsConfig
+	go r.runHistoryJanitor(ctx.Done())
 	defer func() {
 		log.Println("Start gracefully shutting down the server")
 		if err := server.Shutdown(ctx); err != nil {
@@ -86,25 +248,98 @@ func (r *serveRunner) run(_ *cobra.Command, _ []string) error {
 		}
 	}()
 
-	log.Printf("Start listening on %d\n", r.port)
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if tlsConfig != nil {
+		log.Printf("Start listening on %d with TLS\n", r.port)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("Start listening on %d\n", r.port)
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("failed to start the server: %w", err)
 	}
 	return nil
 }
 
+// resolveDedup validates --dedup. Bodies can't be shared on Redis, so "share" is refused along with --redis
+// if given explicitly, and turned into "off" if only the default.
+func (r *serveRunner) resolveDedup(explicit bool) error {
+	switch r.dedup {
+	case historyDedupOff, historyDedupShare, historyDedupCollapse:
+	default:
+		return fmt.Errorf("dedup must be one of %q, %q and %q", historyDedupShare, historyDedupCollapse, historyDedupOff)
+	}
+	if r.redisURL == "" || r.dedup != historyDedupShare {
+		return nil
+	}
+	if explicit {
+		return fmt.Errorf("--dedup %s can't be used with --redis, give %q or %q instead", historyDedupShare, historyDedupCollapse, historyDedupOff)
+	}
+	r.dedup = historyDedupOff
+	return nil
+}
+
+// tlsConfig gives back the TLS configuration to serve with, or nil to serve plain HTTP.
+func (r *serveRunner) tlsConfig() (*tls.Config, error) {
+	if r.tlsCert == "" && !r.selfSigned {
+		return nil, nil
+	}
+	certFile, keyFile := r.tlsCert, r.tlsKey
+	if r.selfSigned && certFile == "" && r.dataDir != "" {
+		certFile = filepath.Join(r.dataDir, tlsDir, selfSignedCertFile)
+		keyFile = filepath.Join(r.dataDir, tlsDir, selfSignedKeyFile)
+	}
+	cert, err := serverCertificate(certFile, keyFile, r.selfSigned)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if r.clientCA != "" {
+		pool, err := loadCertPool(r.clientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
 func (r *serveRunner) newServer() *http.Server {
 	r.ensureCache()
 	r.ensureHistoryStore()
+	r.channels = newChannelSet(newChannel("", r.history, r.spoolDir), r.openChannel, r.maxChannels)
+
+	// routes are served for the default channel at the root, and for each named channel under /c/<name>.
+	routes := http.NewServeMux()
+	routes.HandleFunc(historyPath, r.handleHistory)
+	routes.HandleFunc(historyPath+"/", r.handleHistoryEntry)
+	routes.HandleFunc(rootPath, r.handle)
+	routes.HandleFunc(lastUpdatedPath, r.handleLastUpdated)
+	routes.HandleFunc(watchPath, r.handleWatch)
+	routes.HandleFunc(eventsPath, r.handleEvents)
+	routes.HandleFunc(uploadsPath, r.handleUploads)
+	routes.HandleFunc(uploadsPath+"/", r.handleUploads)
+	r.routes = routes
+
 	mux := http.NewServeMux()
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", r.port),
-		Handler: mux,
+		Handler: advertiseEncodings(mux),
 	}
-	mux.HandleFunc(historyPath, r.basicAuthHandler(r.handleHistory))
-	mux.HandleFunc(historyPath+"/", r.basicAuthHandler(r.handleHistoryEntry))
-	mux.HandleFunc(rootPath, r.basicAuthHandler(r.handle))
-	mux.HandleFunc(lastUpdatedPath, r.basicAuthHandler(r.handleLastUpdated))
+	// Event streams never end on their own, so they are closed for the server to shut down.
+	r.done = make(chan struct{})
+	server.RegisterOnShutdown(func() {
+		close(r.done)
+		for _, c := range r.channels.all() {
+			c.uploads.removeAll()
+		}
+	})
+	mux.HandleFunc(channelPathPrefix, r.authHandler(r.handleChannel))
+	mux.HandleFunc(rootPath, r.authHandler(routes.ServeHTTP))
 	return server
 }
 
@@ -116,52 +351,79 @@ func (r *serveRunner) ensureCache() {
 
 func (r *serveRunner) ensureHistoryStore() {
 	if r.history == nil {
-		r.history = newHistoryStore(r.historyLimit, r.ttl)
+		r.history = newHistoryStore(r.historyPolicy())
+	}
+}
+
+func (r *serveRunner) historyPolicy() historyPolicy {
+	return historyPolicy{
+		limit:        r.historyLimit,
+		ttl:          r.ttl,
+		maxTTL:       r.maxTTL,
+		maxTotalSize: r.totalSizeLimit,
+		dedup:        r.dedup,
 	}
 }
 
 func (r *serveRunner) handle(w http.ResponseWriter, req *http.Request) {
+	ch := r.channelOf(req)
 	switch req.Method {
-	case http.MethodGet:
-		if item, ok := r.history.Latest(); ok {
-			_, _ = w.Write(item.body)
+	case http.MethodGet, http.MethodHead:
+		tag := req.URL.Query().Get(historyTagQuery)
+		for {
+			entry, err := latestHistoryEntry(ch.history, tag)
+			if errors.Is(err, ErrHistoryNotFound) {
+				http.Error(w, "The data not found", http.StatusNotFound)
+				return
+			}
+			if err == nil {
+				err = serveHistoryEntry(w, req, ch.history, entry)
+			}
+			// The entry can be read up or removed by others in the meantime, in which case the one before it is the latest.
+			if errors.Is(err, ErrHistoryNotFound) {
+				continue
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to get data from history: %v", err), http.StatusInternalServerError)
+			}
 			return
 		}
-		if r.history.EverAdded() {
-			http.Error(w, "The data not found", http.StatusNotFound)
+	case http.MethodPut:
+		meta, err := uploadMetadataOf(req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("The upload is invalid: %v", err), http.StatusBadRequest)
 			return
 		}
-		data, err := r.cache.Get(dataCacheKey)
-		if errors.Is(err, cache.ErrNotFound) {
-			http.Error(w, "The data not found", http.StatusNotFound)
+		body, err := decodeRequestBody(req)
+		if errors.Is(err, errUnsupportedEncoding) {
+			http.Error(w, fmt.Sprintf("Failed to decode the request body: %v", err), http.StatusUnsupportedMediaType)
 			return
 		}
 		if err != nil {
-			http.Error(w, "Failed to get data from cache", http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Failed to decode the request body: %v", err), http.StatusBadRequest)
 			return
 		}
-		if d, ok := data.([]byte); ok {
-			w.Write(d)
+		if r.entrySizeLimit > 0 {
+			// The limit applies to the decompressed body, of which the length isn't known in advance.
+			if body == req.Body && req.ContentLength > r.entrySizeLimit {
+				r.entryTooLarge(w)
+				return
+			}
+			body = http.MaxBytesReader(w, io.NopCloser(body), r.entrySizeLimit)
+		}
+		upload, err := spoolUpload(body, ch.spoolDir)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			r.entryTooLarge(w)
 			return
 		}
-		http.Error(w, fmt.Sprintf("The cached data is unknown type: %T", data), http.StatusInternalServerError)
-	case http.MethodPut:
-		body, err := ioutil.ReadAll(req.Body)
 		if err != nil {
 			http.Error(w, "Bad request body", http.StatusBadRequest)
 			return
 		}
-		encrypted := req.Header.Get(historyEncryptedHeader) == "true"
-		if _, err := r.history.Add(body, encrypted); err != nil {
-			http.Error(w, fmt.Sprintf("Failed to save history: %v", err), http.StatusInternalServerError)
-			return
-		}
-		if err := r.cache.Put(dataCacheKey, body); err != nil {
-			http.Error(w, fmt.Sprintf("Failed to cache: %v", err), http.StatusInternalServerError)
-			return
-		}
-		if err := r.cache.Put(lastUpdatedCacheKey, time.Now().UnixNano()); err != nil {
-			http.Error(w, fmt.Sprintf("Failed to save lastUpdated timestamp: %v", err), http.StatusInternalServerError)
+		defer upload.Close()
+		meta.apply(upload)
+		if _, ok := r.addUpload(w, ch, upload); !ok {
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -171,16 +433,39 @@ func (r *serveRunner) handle(w http.ResponseWriter, req *http.Request) {
 }
 
 func (r *serveRunner) handleHistory(w http.ResponseWriter, req *http.Request) {
+	ch := r.channelOf(req)
 	switch req.Method {
 	case http.MethodGet:
+		entries, err := ch.history.List()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list history: %v", err), http.StatusInternalServerError)
+			return
+		}
+		query := req.URL.Query()
+		if tag := query.Get(historyTagQuery); tag != "" {
+			entries = entriesWithTag(entries, tag)
+		}
+		if q := query.Get(historySearchQuery); q != "" {
+			search, err := newHistorySearch(q, query.Get(historyRegexpQuery) == "true", query.Get(historyIgnoreCaseQuery) == "true")
+			if err != nil {
+				http.Error(w, fmt.Sprintf("The search query is invalid: %v", err), http.StatusBadRequest)
+				return
+			}
+			if entries, err = search.filter(req.Context(), ch.history, entries); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to search history: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(r.history.List()); err != nil {
+		if err := json.NewEncoder(w).Encode(entries); err != nil {
 			http.Error(w, "Failed to encode history", http.StatusInternalServerError)
 			return
 		}
 	case http.MethodDelete:
-		r.history.Clear()
-		_ = r.cache.Delete(dataCacheKey)
+		if err := ch.history.Clear(); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to clear history: %v", err), http.StatusInternalServerError)
+			return
+		}
 		w.WriteHeader(http.StatusNoContent)
 	default:
 		http.Error(w, fmt.Sprintf("Method %s is not allowed", req.Method), http.StatusMethodNotAllowed)
@@ -188,6 +473,7 @@ func (r *serveRunner) handleHistory(w http.ResponseWriter, req *http.Request) {
 }
 
 func (r *serveRunner) handleHistoryEntry(w http.ResponseWriter, req *http.Request) {
+	ch := r.channelOf(req)
 	id := strings.TrimPrefix(req.URL.Path, historyPath+"/")
 	if id == "" || strings.Contains(id, "/") {
 		http.Error(w, "The history entry id is invalid", http.StatusBadRequest)
@@ -195,25 +481,52 @@ func (r *serveRunner) handleHistoryEntry(w http.ResponseWriter, req *http.Reques
 	}
 
 	switch req.Method {
-	case http.MethodGet:
-		item, ok := r.history.Get(id)
-		if !ok {
+	case http.MethodGet, http.MethodHead:
+		entry, err := historyEntry(ch.history, id)
+		if err == nil {
+			err = serveHistoryEntry(w, req, ch.history, entry)
+		}
+		if errors.Is(err, ErrHistoryNotFound) {
 			http.Error(w, "The history entry not found", http.StatusNotFound)
 			return
 		}
-		if item.MIME != "" {
-			w.Header().Set("Content-Type", item.MIME)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get history entry: %v", err), http.StatusInternalServerError)
+		}
+	case http.MethodPatch:
+		var patch HistoryPatch
+		dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxHistoryPatchSize))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&patch)
+		if err == nil {
+			err = patch.validate()
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("The patch is invalid: %v", err), http.StatusBadRequest)
+			return
+		}
+		entry, err := ch.history.Update(id, patch)
+		if errors.Is(err, ErrHistoryNotFound) {
+			http.Error(w, "The history entry not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to update history entry: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(entry); err != nil {
+			http.Error(w, "Failed to encode history entry", http.StatusInternalServerError)
 		}
-		_, _ = w.Write(item.body)
 	case http.MethodDelete:
-		if !r.history.Delete(id) {
+		err := ch.history.Delete(id)
+		if errors.Is(err, ErrHistoryNotFound) {
 			http.Error(w, "The history entry not found", http.StatusNotFound)
 			return
 		}
-		if item, ok := r.history.Latest(); ok {
-			_ = r.cache.Put(dataCacheKey, item.body)
-		} else {
-			_ = r.cache.Delete(dataCacheKey)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to delete history entry: %v", err), http.StatusInternalServerError)
+			return
 		}
 		w.WriteHeader(http.StatusNoContent)
 	default:
@@ -221,10 +534,309 @@ func (r *serveRunner) handleHistoryEntry(w http.ResponseWriter, req *http.Reques
 	}
 }
 
+// latestHistoryEntry gives back the metadata of the latest entry with the given tag, or the latest one of all if tag is empty.
+func latestHistoryEntry(history HistoryBackend, tag string) (HistoryEntry, error) {
+	entries, err := history.List()
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	if tag != "" {
+		entries = entriesWithTag(entries, tag)
+	}
+	if len(entries) == 0 {
+		return HistoryEntry{}, ErrHistoryNotFound
+	}
+	return entries[0], nil
+}
+
+// historyEntry gives back the metadata of the entry with the given id.
+func historyEntry(history HistoryBackend, id string) (HistoryEntry, error) {
+	var (
+		found HistoryEntry
+		ok    bool
+	)
+	err := history.Range(func(entry HistoryEntry) bool {
+		found, ok = entry, entry.ID == id
+		return !ok
+	})
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	if !ok {
+		return HistoryEntry{}, ErrHistoryNotFound
+	}
+	return found, nil
+}
+
+// entriesWithTag gives back the entries with the given tag, keeping their order.
+func entriesWithTag(entries []HistoryEntry, tag string) []HistoryEntry {
+	tagged := make([]HistoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.HasTag(tag) {
+			tagged = append(tagged, entry)
+		}
+	}
+	return tagged
+}
+
+func (r *serveRunner) entryTooLarge(w http.ResponseWriter) {
+	http.Error(w, fmt.Sprintf("The data exceeds the entry size limit of %d bytes", r.entrySizeLimit), http.StatusRequestEntityTooLarge)
+}
+
+// uploadMetadata is what the client tells about the body it uploads, apart from the body itself.
+type uploadMetadata struct {
+	encrypted       bool
+	mime            string
+	contentEncoding string
+	createdBy       string
+	ttl             time.Duration
+	maxReads        int
+	tags            []string
+	note            string
+}
+
+// uploadMetadataOf gives back the metadata given by the headers of the upload request.
+func uploadMetadataOf(req *http.Request) (uploadMetadata, error) {
+	encrypted := req.Header.Get(historyEncryptedHeader) == "true"
+	mimeType, err := declaredMIME(req, encrypted)
+	if err != nil {
+		return uploadMetadata{}, fmt.Errorf("invalid content type: %w", err)
+	}
+	encoding := req.Header.Get(historyContentEncodingHeader)
+	if encoding != "" && encoding != encodingGzip {
+		return uploadMetadata{}, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	var ttl time.Duration
+	if s := req.Header.Get(historyTTLHeader); s != "" {
+		if ttl, err = time.ParseDuration(s); err != nil || ttl < 0 {
+			return uploadMetadata{}, fmt.Errorf("invalid TTL %q", s)
+		}
+	}
+	var maxReads int
+	if s := req.Header.Get(historyMaxReadsHeader); s != "" {
+		if maxReads, err = strconv.Atoi(s); err != nil || maxReads < 0 {
+			return uploadMetadata{}, fmt.Errorf("invalid max reads %q", s)
+		}
+	}
+	var tags []string
+	if s := req.Header.Get(historyTagsHeader); s != "" {
+		tags = strings.Split(s, ",")
+		if err := validateHistoryTags(tags); err != nil {
+			return uploadMetadata{}, err
+		}
+	}
+	note, err := url.PathUnescape(req.Header.Get(historyNoteHeader))
+	if err != nil {
+		return uploadMetadata{}, fmt.Errorf("invalid note: %w", err)
+	}
+	if err := validateHistoryNote(note); err != nil {
+		return uploadMetadata{}, err
+	}
+	return uploadMetadata{
+		encrypted:       encrypted,
+		mime:            mimeType,
+		contentEncoding: encoding,
+		createdBy:       identityOf(req),
+		ttl:             ttl,
+		maxReads:        maxReads,
+		tags:            tags,
+		note:            note,
+	}, nil
+}
+
+func (m uploadMetadata) apply(u *HistoryUpload) {
+	u.Encrypted = m.encrypted
+	u.MIME = m.mime
+	u.ContentEncoding = m.contentEncoding
+	u.CreatedBy = m.createdBy
+	u.TTL = m.ttl
+	u.MaxReads = m.maxReads
+	u.Tags = m.tags
+	u.Note = m.note
+}
+
+// addUpload adds the upload to the history of the channel. It responds with an error and gives back false if it fails.
+func (r *serveRunner) addUpload(w http.ResponseWriter, ch *channel, upload *HistoryUpload) (HistoryEntry, bool) {
+	entry, err := ch.history.Add(upload)
+	if errors.Is(err, ErrHistoryTooLarge) {
+		http.Error(w, fmt.Sprintf("The data exceeds the total size limit of %d bytes", r.totalSizeLimit), http.StatusRequestEntityTooLarge)
+		return HistoryEntry{}, false
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save history: %v", err), http.StatusInternalServerError)
+		return HistoryEntry{}, false
+	}
+	if err := r.cache.Put(ch.lastUpdatedKey(), time.Now().UnixNano()); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save lastUpdated timestamp: %v", err), http.StatusInternalServerError)
+		return HistoryEntry{}, false
+	}
+	return entry, true
+}
+
+// declaredMIME gives back the MIME type of the data the client declares, or an empty string if it doesn't.
+// The type of encrypted data is taken only from historyContentTypeHeader, since Content-Type describes the ciphertext.
+func declaredMIME(req *http.Request, encrypted bool) (string, error) {
+	v := req.Header.Get(historyContentTypeHeader)
+	if v == "" && !encrypted {
+		v = req.Header.Get("Content-Type")
+		// Tools like curl send these by default, which say nothing about the data.
+		if mediaType, _, err := mime.ParseMediaType(v); err == nil && (mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data") {
+			return "", nil
+		}
+	}
+	if v == "" {
+		return "", nil
+	}
+	if _, _, err := mime.ParseMediaType(v); err != nil {
+		return "", fmt.Errorf("%q: %w", v, err)
+	}
+	return v, nil
+}
+
+// writeHistoryBody streams the body to the response and closes it. The MIME type of the data is given in historyContentTypeHeader,
+// and in Content-Type as well unless the data is encrypted.
+// Range requests are served for resuming downloads, with the digest of the body as the ETag for If-Range.
+// Otherwise compressible plaintext is compressed by gzip if the client accepts it.
+func writeHistoryBody(w http.ResponseWriter, req *http.Request, entry HistoryEntry, body io.ReadSeekCloser) {
+	defer body.Close()
+	contentType := entry.MIME
+	if entry.Kind == historyKindEncrypted {
+		w.Header().Set(historyEncryptedHeader, "true")
+		contentType = "application/octet-stream"
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if entry.MIME != "" {
+		w.Header().Set(historyContentTypeHeader, entry.MIME)
+	}
+	// Keep browsers from sniffing other types, and from running scripts in pasted HTML on the origin of the server.
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	if entry.ReadsLeft != nil {
+		// Caches must not serve it once more without counting the read.
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set(historyReadsLeftHeader, strconv.Itoa(*entry.ReadsLeft))
+	}
+	if entry.ContentEncoding != "" {
+		w.Header().Set(historyContentEncodingHeader, entry.ContentEncoding)
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set(historyIDHeader, entry.ID)
+	w.Header().Set(historyCreatedAtHeader, strconv.FormatInt(entry.CreatedAt.UnixNano(), 10))
+	w.Header().Set(historySHA256Header, entry.SHA256)
+	w.Header().Set("ETag", strconv.Quote(entry.SHA256))
+
+	gzipped := entry.Kind != historyKindEncrypted && entry.Size >= minCompressSize && compressible(entry.MIME) && acceptsGzip(req)
+	if !gzipped || req.Header.Get("Range") != "" || req.Method == http.MethodHead {
+		// ServeContent answers the conditional headers, If-None-Match, If-Modified-Since and If-Range.
+		http.ServeContent(w, req, "", entry.CreatedAt, body)
+		return
+	}
+	// The compressed body differs byte by byte from the stored one, hence the weak ETag.
+	w.Header().Set("ETag", "W/"+strconv.Quote(entry.SHA256))
+	w.Header().Set("Last-Modified", entry.CreatedAt.UTC().Format(http.TimeFormat))
+	if notModified(req, entry) {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	// Ranges are of the body as it is, so a compressed response is never partial.
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Encoding", encodingGzip)
+	zw := gzip.NewWriter(w)
+	defer func() {
+		if err := zw.Close(); err != nil {
+			log.Printf("Failed to write history entry %s: %v\n", entry.ID, err)
+		}
+	}()
+	if _, err := io.Copy(zw, body); err != nil {
+		log.Printf("Failed to write history entry %s: %v\n", entry.ID, err)
+	}
+}
+
+// serveHistoryEntry responds with the entry given by its metadata. HEAD and conditional requests the client already
+// has the entry for are answered from the metadata alone, so that the body is fetched, and a read of an entry with
+// a read limit is counted, only when the body is sent. Such an entry is always sent whole so that no read is spent
+// on a part of it. ErrHistoryNotFound is given back without writing anything if the entry is gone in the meantime.
+func serveHistoryEntry(w http.ResponseWriter, req *http.Request, history HistoryBackend, entry HistoryEntry) error {
+	if req.Method == http.MethodHead || notModified(req, entry) {
+		writeHistoryBody(w, req, entry, &unopenedBody{size: int64(entry.Size)})
+		return nil
+	}
+	open := history.Get
+	if entry.ReadsLeft != nil {
+		open = history.Read
+	}
+	entry, body, err := open(entry.ID)
+	if err != nil {
+		return err
+	}
+	if entry.ReadsLeft != nil {
+		req = req.Clone(req.Context())
+		req.Header.Del("Range")
+	}
+	writeHistoryBody(w, req, entry, body)
+	return nil
+}
+
+// unopenedBody stands in for the body of an entry in responses without one, for which only its size is needed.
+type unopenedBody struct {
+	size int64
+	off  int64
+}
+
+func (b *unopenedBody) Read([]byte) (int, error) {
+	return 0, errors.New("the history body isn't opened")
+}
+
+func (b *unopenedBody) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.off
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	b.off = offset
+	return offset, nil
+}
+
+func (b *unopenedBody) Close() error {
+	return nil
+}
+
+// notModified reports whether the client already has the entry, by If-None-Match or else by If-Modified-Since.
+// ETags are compared weakly, so that either of the plain and the compressed body matches.
+func notModified(req *http.Request, entry HistoryEntry) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		for _, etag := range strings.Split(inm, ",") {
+			etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+			if etag == "*" || etag == strconv.Quote(entry.SHA256) {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// Last-Modified is of a second granularity.
+	return !entry.CreatedAt.Truncate(time.Second).After(since)
+}
+
 func (r *serveRunner) handleLastUpdated(w http.ResponseWriter, req *http.Request) {
+	ch := r.channelOf(req)
 	switch req.Method {
 	case http.MethodGet:
-		lastUpdated, err := r.cache.Get(lastUpdatedCacheKey)
+		lastUpdated, err := r.cache.Get(ch.lastUpdatedKey())
 		if errors.Is(err, cache.ErrNotFound) {
 			http.Error(w, "The lastUpdated not found", http.StatusNotFound)
 			return
@@ -243,21 +855,64 @@ func (r *serveRunner) handleLastUpdated(w http.ResponseWriter, req *http.Request
 	}
 }
 
-// basicAuthHandler wraps a handler, enforcing basic authentication if the basic auth flag is set.
-func (r *serveRunner) basicAuthHandler(handler http.HandlerFunc) http.HandlerFunc {
-	if r.basicAuth == "" {
+// authHandler wraps a handler, enforcing authentication if any of the basic auth flag, the token file or the client CA is set.
+// Basic authentication grants full access, while a Bearer token grants only its scopes.
+// A verified client certificate grants full access, or the scopes of the token file entry named after its subject if the token file is set.
+// The authenticated name is passed on to the handler as the identity of the request.
+func (r *serveRunner) authHandler(handler http.HandlerFunc) http.HandlerFunc {
+	if r.basicAuth == "" && r.tokens == nil && r.clientCA == "" {
 		return func(w http.ResponseWriter, r *http.Request) {
 			handler(w, r)
 		}
 	}
 	return func(w http.ResponseWriter, req *http.Request) {
+		if name, ok := clientCertName(req); ok && r.clientCA != "" {
+			if r.tokens != nil {
+				t := r.tokens.named(name)
+				if t == nil {
+					http.Error(w, fmt.Sprintf("The client certificate %q isn't allowed", name), http.StatusForbidden)
+					return
+				}
+				if scope := requiredScope(req); !t.scopes[scope] {
+					http.Error(w, fmt.Sprintf("The client certificate doesn't have the %s scope", scope), http.StatusForbidden)
+					return
+				}
+			}
+			handler(w, withIdentity(req, name))
+			return
+		}
+
+		if token, ok := bearerToken(req); ok && r.tokens != nil {
+			t := r.tokens.lookup(token)
+			if t == nil {
+				r.unauthorized(w)
+				return
+			}
+			if scope := requiredScope(req); !t.scopes[scope] {
+				http.Error(w, fmt.Sprintf("The token doesn't have the %s scope", scope), http.StatusForbidden)
+				return
+			}
+			handler(w, withIdentity(req, t.name))
+			return
+		}
+
 		user, pass, ok := req.BasicAuth()
-		if !ok || r.basicAuth != user+":"+pass {
-			w.WriteHeader(401)
-			_, _ = w.Write([]byte("Unauthorized.\n"))
+		if !ok || r.basicAuth == "" || r.basicAuth != user+":"+pass {
+			r.unauthorized(w)
 			return
 		}
 
-		handler(w, req)
+		handler(w, withIdentity(req, user))
+	}
+}
+
+func (r *serveRunner) unauthorized(w http.ResponseWriter) {
+	if r.basicAuth != "" {
+		w.Header().Add("WWW-Authenticate", `Basic realm="pbgopy"`)
+	}
+	if r.tokens != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="pbgopy"`)
 	}
+	w.WriteHeader(http.StatusUnauthorized)
+	_, _ = w.Write([]byte("Unauthorized.\n"))
 }
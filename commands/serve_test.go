@@ -3,8 +3,11 @@ package commands
 import (
 	"encoding/base64"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
@@ -80,8 +83,8 @@ func TestServerCopy(t *testing.T) {
 			status, http.StatusOK)
 	}
 
-	if v, err := cache.Get(dataCacheKey); err != nil || !reflect.DeepEqual(v.([]byte), []byte("clipboardValue")) {
-		t.Errorf("Cache was not populated with clipboard: got value: %s err: %v", string(v.([]byte)), err)
+	if _, v, err := readHistory(r.history.Latest()); err != nil || !reflect.DeepEqual(v, []byte("clipboardValue")) {
+		t.Errorf("History was not populated with clipboard: got value: %s err: %v", string(v), err)
 	}
 }
 
@@ -105,8 +108,8 @@ func TestServerCopyBasicAuth_validCredentials(t *testing.T) {
 			status, http.StatusOK)
 	}
 
-	if v, err := cache.Get(dataCacheKey); err != nil || !reflect.DeepEqual(v.([]byte), []byte("clipboardValue")) {
-		t.Errorf("Cache was not populated with clipboard: got value: %s err: %v", string(v.([]byte)), err)
+	if _, v, err := readHistory(r.history.Latest()); err != nil || !reflect.DeepEqual(v, []byte("clipboardValue")) {
+		t.Errorf("History was not populated with clipboard: got value: %s err: %v", string(v), err)
 	}
 }
 
@@ -130,7 +133,7 @@ func TestServerCopyBasicAuth_invalidCredentials(t *testing.T) {
 			status, http.StatusUnauthorized)
 	}
 
-	_, err = cache.Get(dataCacheKey)
+	_, _, err = readHistory(r.history.Latest())
 	if err == nil {
 		t.Errorf("expected an error, got none")
 	}
@@ -138,8 +141,9 @@ func TestServerCopyBasicAuth_invalidCredentials(t *testing.T) {
 
 func TestServerPaste(t *testing.T) {
 	cache := memorycache.NewCache()
-	r := &serveRunner{cache: cache}
-	_ = cache.Put(dataCacheKey, []byte("clipboardValue"))
+	history := newHistoryStore(historyPolicy{limit: defaultHistoryLimit})
+	_, _ = history.Add(newTestUpload(t, []byte("clipboardValue"), false))
+	r := &serveRunner{cache: cache, history: history}
 
 	handler := r.newServer().Handler
 
@@ -165,8 +169,9 @@ func TestServerPaste(t *testing.T) {
 
 func TestServerPasteBasicAuth_validCredentials(t *testing.T) {
 	cache := memorycache.NewCache()
-	r := &serveRunner{cache: cache, basicAuth: "testUser:testPass"}
-	_ = cache.Put(dataCacheKey, []byte("clipboardValue"))
+	history := newHistoryStore(historyPolicy{limit: defaultHistoryLimit})
+	_, _ = history.Add(newTestUpload(t, []byte("clipboardValue"), false))
+	r := &serveRunner{cache: cache, history: history, basicAuth: "testUser:testPass"}
 
 	handler := r.newServer().Handler
 
@@ -193,8 +198,9 @@ func TestServerPasteBasicAuth_validCredentials(t *testing.T) {
 
 func TestServerPasteBasicAuth_invalidCredentials(t *testing.T) {
 	cache := memorycache.NewCache()
-	r := &serveRunner{cache: cache, basicAuth: "testUser:testPass"}
-	_ = cache.Put(dataCacheKey, []byte("clipboardValue"))
+	history := newHistoryStore(historyPolicy{limit: defaultHistoryLimit})
+	_, _ = history.Add(newTestUpload(t, []byte("clipboardValue"), false))
+	r := &serveRunner{cache: cache, history: history, basicAuth: "testUser:testPass"}
 
 	handler := r.newServer().Handler
 
@@ -217,3 +223,39 @@ func TestServerPasteBasicAuth_invalidCredentials(t *testing.T) {
 		t.Errorf("handler returned unexpected body: got %v but wanted Unauthorized", rr.Body.String())
 	}
 }
+
+func TestServeDedupWithRedis(t *testing.T) {
+	tests := []struct {
+		redisURL string
+		dedup    string
+		explicit bool
+		want     string
+		wantErr  bool
+	}{
+		{dedup: historyDedupShare, want: historyDedupShare},
+		{dedup: historyDedupShare, explicit: true, want: historyDedupShare},
+		{redisURL: "redis://localhost:6379", dedup: historyDedupShare, want: historyDedupOff},
+		{redisURL: "redis://localhost:6379", dedup: historyDedupShare, explicit: true, wantErr: true},
+		{redisURL: "redis://localhost:6379", dedup: historyDedupCollapse, explicit: true, want: historyDedupCollapse},
+		{dedup: "everything", explicit: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		r := &serveRunner{redisURL: tt.redisURL, dedup: tt.dedup}
+		err := r.resolveDedup(tt.explicit)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("resolveDedup(%v) with %+v: unexpected error: %v", tt.explicit, tt, err)
+		}
+		if err == nil && r.dedup != tt.want {
+			t.Fatalf("resolveDedup(%v) with %+v: got %q want %q", tt.explicit, tt, r.dedup, tt.want)
+		}
+	}
+
+	// The explicit flag is refused before connecting to Redis.
+	cmd := NewServeCommand(io.Discard, io.Discard)
+	defer log.SetOutput(os.Stderr)
+	cmd.SetArgs([]string{"--redis", "redis://127.0.0.1:1", "--dedup", historyDedupShare})
+	cmd.SilenceUsage, cmd.SilenceErrors = true, true
+	if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), "--redis") {
+		t.Fatalf("serve --redis --dedup share: got %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package commands
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	defaultSyncInterval = 500 * time.Millisecond
+	// syncRetryInterval is how long to wait before watching the server again after a failure.
+	syncRetryInterval = 5 * time.Second
+)
+
+type syncRunner struct {
+	timeout                time.Duration
+	interval               time.Duration
+	password               string
+	symmetricKeyFile       string
+	publicKeyFile          string
+	privateKeyFile         string
+	privateKeyPasswordFile string
+	gpgUserID              string
+	gpgPath                string
+	basicAuth              string
+	channel                string
+	token                  string
+	tls                    tlsClientOptions
+	maxBufSize             string
+
+	stdout    io.Writer
+	stderr    io.Writer
+	client    *http.Client
+	clipboard clipboardAccessor
+
+	// mu guards lastSHA, the digest of the text last synced in either direction.
+	// Text with the same digest isn't synced again, so that a change doesn't bounce back and forth.
+	mu      sync.Mutex
+	lastSHA [sha256.Size]byte
+}
+
+func NewSyncCommand(stdout, stderr io.Writer) *cobra.Command {
+	r := &syncRunner{
+		stdout:    stdout,
+		stderr:    stderr,
+		clipboard: systemClipboard{},
+	}
+	cmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Keep the local clipboard in sync with the server",
+		Example: `  export PBGOPY_SERVER=http://host.xz:9090
+  pbgopy sync -k ~/.pbgopy/key`,
+		RunE: r.run,
+	}
+	cmd.Flags().DurationVar(&r.timeout, "timeout", 5*time.Second, "Time limit for requests")
+	cmd.Flags().DurationVar(&r.interval, "interval", defaultSyncInterval, "How often to check the local clipboard for changes")
+	cmd.Flags().StringVarP(&r.password, "password", "p", "", "Password to derive the symmetric-key to be used for encryption and decryption")
+	cmd.Flags().StringVarP(&r.symmetricKeyFile, "symmetric-key-file", "k", "", "Path to symmetric-key file to be used for encryption and decryption")
+	cmd.Flags().StringVar(&r.publicKeyFile, "public-key-file", "", "Path to an RSA public-key file to be used for encryption; Must be in PEM or DER format")
+	cmd.Flags().StringVar(&r.privateKeyFile, "private-key-file", "", "Path to an RSA private-key file to be used for decryption; Must be in PEM or DER format")
+	cmd.Flags().StringVar(&r.privateKeyPasswordFile, "private-key-password-file", "", "Path to password file to decrypt the encrypted private key")
+	cmd.Flags().StringVarP(&r.gpgUserID, "gpg-user-id", "u", "", "GPG user id associated with the key-pair to be used for encryption and decryption")
+	cmd.Flags().StringVar(&r.gpgPath, "gpg-path", defaultGPGExecutablePath, "Path to gpg executable")
+	cmd.Flags().StringVarP(&r.basicAuth, "basic-auth", "a", "", "Basic authentication, username:password")
+	r.tls.addFlags(cmd.Flags())
+	cmd.Flags().StringVar(&r.token, "token", "", "API token to authenticate with. Defaults to $PBGOPY_TOKEN")
+	cmd.Flags().StringVar(&r.channel, "channel", "", "Name of the channel to use. Defaults to $PBGOPY_CHANNEL, or the default channel if it is not set either")
+	cmd.Flags().StringVar(&r.maxBufSize, "max-size", "500mb", "Max data size with unit")
+	return cmd
+}
+
+func (r *syncRunner) run(_ *cobra.Command, _ []string) error {
+	if r.interval <= 0 {
+		return fmt.Errorf("interval must be greater than 0")
+	}
+	if (r.publicKeyFile == "") != (r.privateKeyFile == "") {
+		return fmt.Errorf("both --public-key-file and --private-key-file must be given")
+	}
+	return r.sync(context.Background())
+}
+
+// sync uploads the changes to the local clipboard, and writes the entries added to the server into it, until ctx is done.
+func (r *syncRunner) sync(ctx context.Context) error {
+	address, err := serverAddress(r.channel)
+	if err != nil {
+		return err
+	}
+	copier := r.copyRunner()
+	uploadClient, err := copier.httpClient()
+	if err != nil {
+		return err
+	}
+	paster := r.pasteRunner()
+	watchClient, err := paster.httpClient()
+	if err != nil {
+		return err
+	}
+
+	// What is already on the clipboard isn't uploaded, only the changes to it.
+	text, err := r.clipboard.ReadAll()
+	if err != nil {
+		return fmt.Errorf("failed to read the clipboard: %w", err)
+	}
+	r.seen([]byte(text))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.watchRemote(ctx, paster, watchClient, address)
+	}()
+	defer wg.Wait()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		text, err := r.clipboard.ReadAll()
+		if err != nil {
+			fmt.Fprintf(r.stderr, "Failed to read the clipboard: %v\n", err)
+			continue
+		}
+		if !r.seen([]byte(text)) {
+			continue
+		}
+		if err := copier.upload(uploadClient, address, []byte(text)); err != nil {
+			fmt.Fprintf(r.stderr, "Failed to upload the clipboard: %v\n", err)
+		}
+	}
+}
+
+// watchRemote writes each entry added to the server into the local clipboard until ctx is done.
+func (r *syncRunner) watchRemote(ctx context.Context, paster *pasteRunner, client *http.Client, address string) {
+	for {
+		err := paster.watchEntries(ctx, client, address, func(data []byte, _ string) error {
+			if !isLikelyText(data) {
+				fmt.Fprintln(r.stderr, "Skipped an entry that isn't text")
+				return nil
+			}
+			if !r.seen(data) {
+				return nil
+			}
+			if err := writeClipboard(r.clipboard, data); err != nil {
+				fmt.Fprintf(r.stderr, "Failed to write to the clipboard: %v\n", err)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(r.stderr, "Failed to watch the server: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(syncRetryInterval):
+		}
+	}
+}
+
+// seen records the data as the last one synced. It gives back false if it already is.
+func (r *syncRunner) seen(data []byte) bool {
+	sum := sha256.Sum256(data)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if sum == r.lastSHA {
+		return false
+	}
+	r.lastSHA = sum
+	return true
+}
+
+func (r *syncRunner) copyRunner() *copyRunner {
+	return &copyRunner{
+		timeout:          r.timeout,
+		password:         r.password,
+		symmetricKeyFile: r.symmetricKeyFile,
+		publicKeyFile:    r.publicKeyFile,
+		gpgUserID:        r.gpgUserID,
+		gpgPath:          r.gpgPath,
+		basicAuth:        r.basicAuth,
+		token:            r.token,
+		tls:              r.tls,
+		compress:         true,
+		stdout:           r.stdout,
+		stderr:           r.stderr,
+		client:           r.client,
+	}
+}
+
+func (r *syncRunner) pasteRunner() *pasteRunner {
+	return &pasteRunner{
+		timeout:                r.timeout,
+		password:               r.password,
+		symmetricKeyFile:       r.symmetricKeyFile,
+		privateKeyFile:         r.privateKeyFile,
+		privateKeyPasswordFile: r.privateKeyPasswordFile,
+		gpgUserID:              r.gpgUserID,
+		gpgPath:                r.gpgPath,
+		basicAuth:              r.basicAuth,
+		token:                  r.token,
+		tls:                    r.tls,
+		maxBufSize:             r.maxBufSize,
+		watch:                  true,
+		stdout:                 r.stdout,
+		stderr:                 r.stderr,
+		client:                 r.client,
+	}
+}
@@ -0,0 +1,116 @@
+package commands
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nakabonne/pbgopy/cache/memorycache"
+)
+
+// fakeClipboard is a clipboardAccessor recording what is written to it.
+type fakeClipboard struct {
+	mu     sync.Mutex
+	text   string
+	writes []string
+}
+
+func (c *fakeClipboard) ReadAll() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.text, nil
+}
+
+func (c *fakeClipboard) WriteAll(text string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.text = text
+	c.writes = append(c.writes, text)
+	return nil
+}
+
+func (c *fakeClipboard) set(text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.text = text
+}
+
+func (c *fakeClipboard) written() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.writes...)
+}
+
+func TestSync(t *testing.T) {
+	s := &serveRunner{cache: memorycache.NewCache(), historyLimit: 10}
+	handler := s.newServer().Handler
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	t.Setenv(pbgopyServerEnv, server.URL)
+
+	clipboard := &fakeClipboard{text: "already there"}
+	r := &syncRunner{
+		timeout:    time.Second,
+		interval:   10 * time.Millisecond,
+		password:   "secret",
+		maxBufSize: "500mb",
+		stdout:     &syncBuffer{},
+		stderr:     &syncBuffer{},
+		client:     server.Client(),
+		clipboard:  clipboard,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- r.sync(ctx)
+	}()
+	waitWatching(t, s, "")
+
+	// A local change is uploaded encrypted.
+	clipboard.set("local")
+	waitHistory(t, handler, 1)
+	if entry := getHistory(t, handler)[0]; entry.Kind != historyKindEncrypted {
+		t.Fatalf("uploaded entry: %+v", entry)
+	}
+
+	// A remote change is written into the clipboard.
+	waitWatching(t, s, "")
+	remote := &copyRunner{password: "secret"}
+	if err := remote.upload(server.Client(), server.URL, []byte("remote")); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if text, _ := clipboard.ReadAll(); text == "remote" {
+			break
+		}
+	}
+
+	// Neither change bounces back.
+	time.Sleep(10 * r.interval)
+	if got := clipboard.written(); strings.Join(got, ",") != "remote" {
+		t.Fatalf("written to the clipboard: %q", got)
+	}
+	if entries := getHistory(t, handler); len(entries) != 2 {
+		t.Fatalf("history: %+v", entries)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitHistory waits until the history has n entries.
+func waitHistory(t *testing.T, handler http.Handler, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if len(getHistory(t, handler)) == n {
+			return
+		}
+	}
+	t.Fatalf("history: got %+v want %d entries", getHistory(t, handler), n)
+}
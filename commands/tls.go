@@ -0,0 +1,209 @@
+package commands
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	pbgopyCACertEnv     = "PBGOPY_CA_CERT"
+	pbgopyClientCertEnv = "PBGOPY_CLIENT_CERT"
+	pbgopyClientKeyEnv  = "PBGOPY_CLIENT_KEY"
+
+	// tlsDir is where a self-signed certificate is kept under the data directory.
+	tlsDir                 = "tls"
+	selfSignedCertFile     = "cert.pem"
+	selfSignedKeyFile      = "key.pem"
+	selfSignedCertLifetime = 365 * 24 * time.Hour
+)
+
+// tlsClientOptions are the options to connect to a pbgopy server over HTTPS.
+type tlsClientOptions struct {
+	caCert     string
+	insecure   bool
+	clientCert string
+	clientKey  string
+}
+
+func (o *tlsClientOptions) addFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&o.caCert, "ca-cert", "", "Path to a PEM-encoded CA certificate to verify the server with, such as its self-signed certificate. Defaults to $PBGOPY_CA_CERT")
+	flags.BoolVar(&o.insecure, "insecure", false, "Skip verifying the certificate of the server. Use it only for testing")
+	flags.StringVar(&o.clientCert, "client-cert", "", "Path to a PEM-encoded client certificate to authenticate with. Defaults to $PBGOPY_CLIENT_CERT")
+	flags.StringVar(&o.clientKey, "client-key", "", "Path to the PEM-encoded private key of the client certificate. Defaults to $PBGOPY_CLIENT_KEY")
+}
+
+// newHTTPClient builds a client to talk to the pbgopy server with.
+func newHTTPClient(timeout time.Duration, opts tlsClientOptions) (*http.Client, error) {
+	client := &http.Client{
+		Timeout: timeout,
+	}
+	caCert := opts.caCert
+	if caCert == "" {
+		caCert = os.Getenv(pbgopyCACertEnv)
+	}
+	clientCert, clientKey := opts.clientCert, opts.clientKey
+	if clientCert == "" {
+		clientCert = os.Getenv(pbgopyClientCertEnv)
+	}
+	if clientKey == "" {
+		clientKey = os.Getenv(pbgopyClientKeyEnv)
+	}
+	if (clientCert == "") != (clientKey == "") {
+		return nil, fmt.Errorf("both --client-cert and --client-key must be given")
+	}
+	if caCert == "" && !opts.insecure && clientCert == "" {
+		return client, nil
+	}
+
+	cfg := &tls.Config{
+		InsecureSkipVerify: opts.insecure,
+	}
+	if caCert != "" {
+		pool, err := loadCertPool(caCert)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	client.Transport = transport
+	return client, nil
+}
+
+// loadCertPool reads PEM-encoded certificates from the given file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// clientCertName gives back the name of the client, taken from the subject of its verified certificate.
+func clientCertName(req *http.Request) (string, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	subject := req.TLS.VerifiedChains[0][0].Subject
+	if subject.CommonName != "" {
+		return subject.CommonName, true
+	}
+	return subject.String(), true
+}
+
+// serverCertificate gives back the certificate for serve to use.
+// If selfSigned is set and no certificate exists at the given paths, a self-signed one is generated there.
+// Empty paths mean the certificate is kept only in memory.
+func serverCertificate(certFile, keyFile string, selfSigned bool) (tls.Certificate, error) {
+	if !selfSigned {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to load the TLS certificate: %w", err)
+		}
+		return cert, nil
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err == nil {
+			return cert, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return tls.Certificate{}, fmt.Errorf("failed to load the TLS certificate: %w", err)
+		}
+	}
+	certPEM, keyPEM, err := generateSelfSignedCert(time.Now())
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if certFile != "" {
+		for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+			if err := os.MkdirAll(dir, 0o700); err != nil {
+				return tls.Certificate{}, err
+			}
+		}
+		if err := writeFileAtomic(keyFile, keyPEM); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to save the TLS key: %w", err)
+		}
+		if err := writeFileAtomic(certFile, certPEM); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to save the TLS certificate: %w", err)
+		}
+		log.Printf("Generated a self-signed certificate at %s\n", certFile)
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	log.Printf("Serving with a self-signed certificate, SHA-256 fingerprint %s\n", hex.EncodeToString(sum[:]))
+	return cert, nil
+}
+
+// generateSelfSignedCert gives back a PEM-encoded certificate and its key for the local host names.
+// The certificate can sign itself, so that clients can trust it as a CA.
+func generateSelfSignedCert(now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate a key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate a serial number: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"pbgopy"}, CommonName: "pbgopy self-signed"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedCertLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create a certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,244 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nakabonne/pbgopy/cache/memorycache"
+)
+
+func TestServerCertificateSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls", "cert.pem"), filepath.Join(dir, "tls", "key.pem")
+	cert, err := serverCertificate(certFile, keyFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(certFile); err != nil {
+		t.Fatalf("certificate wasn't saved: %v", err)
+	}
+	// The saved certificate is reused after restart.
+	again, err := serverCertificate(certFile, keyFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert.Certificate[0], again.Certificate[0]) {
+		t.Fatal("a new certificate was generated though one exists")
+	}
+	if _, err := serverCertificate(filepath.Join(dir, "missing.pem"), keyFile, false); err == nil {
+		t.Fatal("expected an error for a missing certificate")
+	}
+}
+
+func TestServeTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	r := &serveRunner{dataDir: dir, selfSigned: true}
+	cfg, err := r.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg == nil || len(cfg.Certificates) != 1 {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+	if _, err := os.Stat(filepath.Join(dir, tlsDir, selfSignedCertFile)); err != nil {
+		t.Fatalf("certificate wasn't saved under the data directory: %v", err)
+	}
+
+	r = &serveRunner{}
+	if cfg, err := r.tlsConfig(); err != nil || cfg != nil {
+		t.Fatalf("plain HTTP: got %+v, %v", cfg, err)
+	}
+}
+
+func TestClientTLSOptions(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer server.Close()
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(pbgopyServerEnv, server.URL)
+	t.Setenv(pbgopyCACertEnv, "")
+
+	tests := []struct {
+		name    string
+		opts    tlsClientOptions
+		wantErr bool
+	}{
+		{name: "unknown authority", opts: tlsClientOptions{}, wantErr: true},
+		{name: "ca cert", opts: tlsClientOptions{caCert: caCert}},
+		{name: "insecure", opts: tlsClientOptions{insecure: true}},
+	}
+	for _, tt := range tests {
+		var stdout bytes.Buffer
+		r := &pasteRunner{timeout: time.Second, maxBufSize: "500mb", tls: tt.opts, stdout: &stdout}
+		err := r.run(nil, nil)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: got error %v", tt.name, err)
+		}
+		if !tt.wantErr && stdout.String() != "secure" {
+			t.Fatalf("%s: got %q", tt.name, stdout.String())
+		}
+	}
+
+	t.Setenv(pbgopyCACertEnv, caCert)
+	r := &pasteRunner{timeout: time.Second, maxBufSize: "500mb", stdout: &bytes.Buffer{}}
+	if err := r.run(nil, nil); err != nil {
+		t.Fatalf("with $%s: %v", pbgopyCACertEnv, err)
+	}
+}
+
+func TestClientCertAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newTestCA(t, filepath.Join(dir, "ca.pem"))
+	laptopCert, laptopKey := newTestClientCert(t, dir, "laptop", ca, caKey)
+	readerCert, readerKey := newTestClientCert(t, dir, "reader", ca, caKey)
+	strangerCert, strangerKey := newTestClientCert(t, dir, "stranger", ca, caKey)
+
+	tokens, err := parseTokens(strings.NewReader("laptop - read,write\nreader - read\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &serveRunner{cache: memorycache.NewCache(), historyLimit: 3, tokens: tokens, selfSigned: true, clientCA: filepath.Join(dir, "ca.pem")}
+	cfg, err := r.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(r.newServer().Handler)
+	server.TLS = cfg
+	server.StartTLS()
+	defer server.Close()
+	serverCert := filepath.Join(dir, "server.pem")
+	if err := os.WriteFile(serverCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cfg.Certificates[0].Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path, cert, key string) (*http.Response, error) {
+		client, err := newHTTPClient(time.Second, tlsClientOptions{caCert: serverCert, clientCert: cert, clientKey: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader("from laptop"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client.Do(req)
+	}
+	tests := []struct {
+		method string
+		cert   string
+		key    string
+		want   int
+	}{
+		{method: http.MethodPut, cert: laptopCert, key: laptopKey, want: http.StatusOK},
+		{method: http.MethodPut, cert: readerCert, key: readerKey, want: http.StatusForbidden},
+		{method: http.MethodGet, cert: readerCert, key: readerKey, want: http.StatusOK},
+		{method: http.MethodGet, cert: strangerCert, key: strangerKey, want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		res, err := do(tt.method, "/", tt.cert, tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.want {
+			t.Fatalf("%s with %s: got %d want %d", tt.method, tt.cert, res.StatusCode, tt.want)
+		}
+	}
+	if res, err := do(http.MethodGet, "/", "", ""); err == nil {
+		res.Body.Close()
+		t.Fatal("expected the handshake to fail without a client certificate")
+	}
+
+	res, err := do(http.MethodGet, historyPath, readerCert, readerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var entries []HistoryEntry
+	if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].CreatedBy != "laptop" {
+		t.Fatalf("history: %+v", entries)
+	}
+}
+
+// newTestCA writes a CA certificate to path.
+func newTestCA(t *testing.T, path string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// newTestClientCert writes a client certificate for name signed by the CA, and gives back the paths to it and its key.
+func newTestClientCert(t *testing.T, dir, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
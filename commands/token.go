@@ -0,0 +1,158 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// tokenScopeRead allows pasting and listing the history.
+	tokenScopeRead = "read"
+	// tokenScopeWrite allows copying.
+	tokenScopeWrite = "write"
+	// tokenScopeAdmin allows deleting history entries.
+	tokenScopeAdmin = "admin"
+)
+
+// apiToken is a token loaded from the token file.
+type apiToken struct {
+	// name identifies the holder of the token.
+	name   string
+	scopes map[string]bool
+}
+
+// noToken in place of a token lets the name authenticate only with a client certificate.
+const noToken = "-"
+
+// tokenSet is a set of API tokens. Tokens are looked up by their digest,
+// so that the time taken doesn't depend on how much of a guessed token matches.
+type tokenSet struct {
+	tokens map[[sha256.Size]byte]*apiToken
+	// names holds every entry by its name, which client certificates are matched against.
+	names map[string]*apiToken
+}
+
+// loadTokenFile reads API tokens from the given file.
+// Each line consists of a name, a token and comma-separated scopes, separated by whitespace:
+//
+//	ci     8d6d3bc5a0e0cc2f1e6b8f3c  read
+//	alice  1f5e93f7d37cb1a0f44d5c2e  read,write,admin
+//
+// Empty lines and lines starting with # are ignored. A token of "-" leaves the name
+// to be used only by a client certificate with that subject.
+func loadTokenFile(path string) (*tokenSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open token file: %w", err)
+	}
+	defer f.Close()
+	tokens, err := parseTokens(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	return tokens, nil
+}
+
+func parseTokens(r io.Reader) (*tokenSet, error) {
+	s := &tokenSet{tokens: make(map[[sha256.Size]byte]*apiToken), names: make(map[string]*apiToken)}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: want \"<name> <token> <scopes>\"", n)
+		}
+		name, token := fields[0], fields[1]
+		if _, ok := s.names[name]; ok {
+			return nil, fmt.Errorf("line %d: duplicate name %q", n, name)
+		}
+		key := sha256.Sum256([]byte(token))
+		if _, ok := s.tokens[key]; ok && token != noToken {
+			return nil, fmt.Errorf("line %d: duplicate token", n)
+		}
+		t := &apiToken{name: name, scopes: make(map[string]bool)}
+		for _, scope := range strings.Split(fields[2], ",") {
+			switch scope {
+			case tokenScopeRead, tokenScopeWrite, tokenScopeAdmin:
+				t.scopes[scope] = true
+			default:
+				return nil, fmt.Errorf("line %d: unknown scope %q", n, scope)
+			}
+		}
+		s.names[name] = t
+		if token != noToken {
+			s.tokens[key] = t
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// lookup gives back the token, or nil if it is unknown.
+func (s *tokenSet) lookup(token string) *apiToken {
+	return s.tokens[sha256.Sum256([]byte(token))]
+}
+
+// named gives back the entry with the given name, or nil if there is none.
+func (s *tokenSet) named(name string) *apiToken {
+	return s.names[name]
+}
+
+// requiredScope gives back the scope needed to make the request.
+func requiredScope(req *http.Request) string {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return tokenScopeRead
+	case http.MethodDelete:
+		// Aborting an upload takes no more than making it.
+		if isUploadPath(req.URL.Path) {
+			return tokenScopeWrite
+		}
+		return tokenScopeAdmin
+	default:
+		return tokenScopeWrite
+	}
+}
+
+// isUploadPath reports whether the path is of an upload session, either in the default channel or in a named one.
+func isUploadPath(path string) bool {
+	if rest, ok := strings.CutPrefix(path, channelPathPrefix); ok {
+		_, path, _ = strings.Cut(rest, "/")
+		path = "/" + path
+	}
+	return strings.HasPrefix(path, uploadsPath+"/")
+}
+
+type identityContextKey struct{}
+
+// withIdentity gives back the request with the name of the authenticated client.
+func withIdentity(req *http.Request, name string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), identityContextKey{}, name))
+}
+
+// identityOf gives back the name of the authenticated client, or an empty string if authentication is disabled.
+func identityOf(req *http.Request) string {
+	name, _ := req.Context().Value(identityContextKey{}).(string)
+	return name
+}
+
+// bearerToken gives back the token in the Authorization header, if any.
+func bearerToken(req *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	auth := req.Header.Get("Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return auth[len(prefix):], true
+}
@@ -0,0 +1,166 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nakabonne/pbgopy/cache/memorycache"
+)
+
+const testTokenFile = `
+# name   token         scopes
+ci       ci-token      read
+alice    alice-token   read,write,admin
+writer   writer-token  write
+`
+
+func TestParseTokens(t *testing.T) {
+	tokens, err := parseTokens(strings.NewReader(testTokenFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci := tokens.lookup("ci-token")
+	if ci == nil || ci.name != "ci" || !ci.scopes[tokenScopeRead] || ci.scopes[tokenScopeWrite] || ci.scopes[tokenScopeAdmin] {
+		t.Fatalf("ci token: %+v", ci)
+	}
+	alice := tokens.lookup("alice-token")
+	if alice == nil || !alice.scopes[tokenScopeRead] || !alice.scopes[tokenScopeWrite] || !alice.scopes[tokenScopeAdmin] {
+		t.Fatalf("alice token: %+v", alice)
+	}
+	if tokens.lookup("unknown") != nil || tokens.lookup("ci") != nil {
+		t.Fatal("unknown token was found")
+	}
+	// "-" can't be used as a token, and can be given to many names.
+	certOnly, err := parseTokens(strings.NewReader("laptop - read\nphone - read,write"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certOnly.lookup(noToken) != nil || certOnly.named("phone") == nil || !certOnly.named("phone").scopes[tokenScopeWrite] {
+		t.Fatalf("certificate-only entries: %+v", certOnly)
+	}
+
+	invalid := map[string]string{
+		"missing scopes":               "ci ci-token",
+		"unknown scope":                "ci ci-token read,delete",
+		"duplicate name":               "ci token-1 read\nci token-2 read",
+		"duplicate token":              "ci token read\ncd token read",
+		"duplicate name with no token": "ci - read\nci token read",
+	}
+	for name, file := range invalid {
+		if _, err := parseTokens(strings.NewReader(file)); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLoadTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte(testTokenFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := loadTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens.tokens) != 3 {
+		t.Fatalf("loaded %d tokens want 3", len(tokens.tokens))
+	}
+	if _, err := loadTokenFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	tokens, err := parseTokens(strings.NewReader(testTokenFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &serveRunner{cache: memorycache.NewCache(), historyLimit: 3, tokens: tokens, basicAuth: "user:pass"}
+	handler := r.newServer().Handler
+
+	do := func(method, path, auth string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader("body"))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	tests := []struct {
+		method string
+		path   string
+		auth   string
+		want   int
+	}{
+		{method: http.MethodPut, path: "/", auth: "", want: http.StatusUnauthorized},
+		{method: http.MethodPut, path: "/", auth: "Bearer unknown", want: http.StatusUnauthorized},
+		{method: http.MethodPut, path: "/", auth: "Bearer ci-token", want: http.StatusForbidden},
+		{method: http.MethodPut, path: "/", auth: "Bearer writer-token", want: http.StatusOK},
+		{method: http.MethodGet, path: "/", auth: "Bearer writer-token", want: http.StatusForbidden},
+		{method: http.MethodGet, path: "/", auth: "Bearer ci-token", want: http.StatusOK},
+		{method: http.MethodGet, path: historyPath, auth: "bearer ci-token", want: http.StatusOK},
+		// Reading doesn't create a channel, while writing does.
+		{method: http.MethodGet, path: "/c/team" + historyPath, auth: "Bearer ci-token", want: http.StatusNotFound},
+		{method: http.MethodPut, path: "/c/team", auth: "Bearer writer-token", want: http.StatusOK},
+		{method: http.MethodGet, path: "/c/team" + historyPath, auth: "Bearer ci-token", want: http.StatusOK},
+		{method: http.MethodDelete, path: historyPath, auth: "Bearer ci-token", want: http.StatusForbidden},
+		{method: http.MethodDelete, path: historyPath, auth: "Bearer alice-token", want: http.StatusNoContent},
+		// Writers can abort their uploads.
+		{method: http.MethodDelete, path: "/c/team" + uploadsPath + "/unknown", auth: "Bearer writer-token", want: http.StatusNotFound},
+		{method: http.MethodDelete, path: uploadsPath + "/unknown", auth: "Bearer ci-token", want: http.StatusForbidden},
+		// Basic authentication keeps granting full access.
+		{method: http.MethodPut, path: "/", auth: basic, want: http.StatusOK},
+		{method: http.MethodDelete, path: historyPath, auth: basic, want: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		if got := do(tt.method, tt.path, tt.auth); got != tt.want {
+			t.Fatalf("%s %s with %q: got %d want %d", tt.method, tt.path, tt.auth, got, tt.want)
+		}
+	}
+}
+
+func TestClientSendsToken(t *testing.T) {
+	tokens, err := parseTokens(strings.NewReader(testTokenFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &serveRunner{cache: memorycache.NewCache(), historyLimit: 3, tokens: tokens}
+	handler := r.newServer().Handler
+	req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader("secret"))
+	req.Header.Set("Authorization", "Bearer writer-token")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	t.Setenv(pbgopyServerEnv, "http://pbgopy.test")
+	t.Setenv(pbgopyTokenEnv, "ci-token")
+	for _, token := range []string{"", "alice-token"} {
+		var stdout bytes.Buffer
+		p := &pasteRunner{
+			timeout:    time.Second,
+			maxBufSize: "500mb",
+			token:      token,
+			stdout:     &stdout,
+			client:     newHandlerClient(handler),
+		}
+		if err := p.run(nil, nil); err != nil {
+			t.Fatalf("paste with token %q: %v", token, err)
+		}
+		if got := stdout.String(); got != "secret" {
+			t.Fatalf("paste with token %q: got %q", token, got)
+		}
+	}
+
+	t.Setenv(pbgopyTokenEnv, "writer-token")
+	p := &pasteRunner{maxBufSize: "500mb", client: newHandlerClient(handler), stdout: &bytes.Buffer{}}
+	if err := p.run(nil, nil); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("paste with a write-only token: got %v", err)
+	}
+}
@@ -0,0 +1,541 @@
+package commands
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	uploadsPath = "/uploads"
+
+	// maxUploadChunkSize is the largest chunk the server accepts.
+	maxUploadChunkSize = 64 << 20
+	// uploadSessionTTL is how long an upload session is kept without any request to it.
+	uploadSessionTTL = time.Hour
+	// maxUploadSessions is how many uploads can be in progress in a channel at once.
+	maxUploadSessions = 100
+
+	defaultChunkSize = "1mb"
+	// uploadRetryInterval is how long to wait before retrying a failed request, which doubles up to maxUploadRetryInterval.
+	uploadRetryInterval    = time.Second
+	maxUploadRetryInterval = 30 * time.Second
+)
+
+var (
+	errTooManyUploads  = errors.New("too many uploads in progress")
+	errChunkOutOfOrder = errors.New("chunk out of order")
+	errUploadTooLarge  = errors.New("upload too large")
+	errUploadClosed    = errors.New("upload already committed or aborted")
+)
+
+// uploadStatus is the state of an upload session.
+type uploadStatus struct {
+	ID string `json:"id"`
+	// Chunks is the number of chunks received so far, which is also the number of the next chunk to send.
+	Chunks int   `json:"chunks"`
+	Size   int64 `json:"size"`
+}
+
+// uploadSession is a body uploaded in numbered chunks, which is added to the history only when committed.
+// The digest and the head of the body are computed as the chunks come in, the same as spoolUpload does.
+type uploadSession struct {
+	id   string
+	meta uploadMetadata
+	// transportEncoding is the Content-Encoding of the whole body, which is undone on commit.
+	transportEncoding string
+
+	mu        sync.Mutex
+	file      *os.File
+	chunks    int
+	size      int64
+	digest    hash.Hash
+	text      *textDetector
+	head      *headWriter
+	updatedAt time.Time
+	// entry is the history entry made on commit, kept to answer a retried commit.
+	entry *HistoryEntry
+}
+
+func (s *uploadSession) status() uploadStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return uploadStatus{ID: s.id, Chunks: s.chunks, Size: s.size}
+}
+
+// appendChunk appends the chunk numbered n. A chunk already received is ignored,
+// so that the client can send it again when it missed the response.
+// limit is the maximum size of the whole body in bytes. Zero means unlimited.
+func (s *uploadSession) appendChunk(n int, data []byte, limit int64) (uploadStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.updatedAt = time.Now()
+	switch {
+	case s.entry != nil || s.file == nil:
+		return uploadStatus{}, errUploadClosed
+	case n < s.chunks:
+		return uploadStatus{ID: s.id, Chunks: s.chunks, Size: s.size}, nil
+	case n > s.chunks:
+		return uploadStatus{}, fmt.Errorf("%w: got chunk %d, want %d", errChunkOutOfOrder, n, s.chunks)
+	case limit > 0 && s.size+int64(len(data)) > limit:
+		return uploadStatus{}, errUploadTooLarge
+	}
+	if _, err := s.file.Write(data); err != nil {
+		// Leave no part of the chunk behind, so that it can be sent again.
+		if terr := s.file.Truncate(s.size); terr != nil {
+			return uploadStatus{}, fmt.Errorf("failed to roll back the chunk: %w", terr)
+		}
+		if _, serr := s.file.Seek(s.size, io.SeekStart); serr != nil {
+			return uploadStatus{}, fmt.Errorf("failed to roll back the chunk: %w", serr)
+		}
+		return uploadStatus{}, err
+	}
+	s.digest.Write(data)
+	s.text.Write(data)
+	s.head.Write(data)
+	s.chunks++
+	s.size += int64(len(data))
+	return uploadStatus{ID: s.id, Chunks: s.chunks, Size: s.size}, nil
+}
+
+// upload gives back the body received so far as an upload, with its Content-Encoding undone.
+// The caller must Close the upload. limit is the maximum size of the decoded body in bytes. Zero means unlimited.
+func (s *uploadSession) upload(dir string, limit int64) (*HistoryUpload, error) {
+	if err := s.file.Close(); err != nil {
+		return nil, err
+	}
+	path := s.file.Name()
+	s.file = nil
+	if s.transportEncoding == "" {
+		upload := &HistoryUpload{
+			size:   s.size,
+			sha256: hex.EncodeToString(s.digest.Sum(nil)),
+			head:   s.head.buf,
+			text:   s.text.valid(),
+			path:   path,
+		}
+		s.meta.apply(upload)
+		return upload, nil
+	}
+
+	defer os.Remove(path)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress the body: %w", err)
+	}
+	var r io.Reader = zr
+	if limit > 0 {
+		r = io.LimitReader(zr, limit+1)
+	}
+	upload, err := spoolUpload(r, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress the body: %w", err)
+	}
+	if limit > 0 && upload.Size() > limit {
+		upload.Close()
+		return nil, errUploadTooLarge
+	}
+	s.meta.apply(upload)
+	return upload, nil
+}
+
+// remove deletes the file holding the body received so far.
+func (s *uploadSession) remove() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return
+	}
+	s.file.Close()
+	os.Remove(s.file.Name())
+	s.file = nil
+}
+
+// uploadSessions holds the upload sessions of a channel. They are kept only in memory,
+// so an upload has to be made to the same server from start to commit.
+type uploadSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+func newUploadSessions() *uploadSessions {
+	return &uploadSessions{sessions: make(map[string]*uploadSession)}
+}
+
+// start opens a session, of which the body is written to a temporary file in dir.
+func (u *uploadSessions) start(dir string, meta uploadMetadata, transportEncoding string) (*uploadSession, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.pruneLocked(time.Now())
+	if len(u.sessions) >= maxUploadSessions {
+		return nil, errTooManyUploads
+	}
+	id, err := newHistoryID()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, "upload-session-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a temporary file: %w", err)
+	}
+	s := &uploadSession{
+		id:                id,
+		meta:              meta,
+		transportEncoding: transportEncoding,
+		file:              f,
+		digest:            sha256.New(),
+		text:              &textDetector{},
+		head:              &headWriter{limit: historySniffLen},
+		updatedAt:         time.Now(),
+	}
+	u.sessions[id] = s
+	return s, nil
+}
+
+// get gives back the session with the given ID, if it has been started by the same client.
+func (u *uploadSessions) get(id, createdBy string) (*uploadSession, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.pruneLocked(time.Now())
+	s, ok := u.sessions[id]
+	if !ok || s.meta.createdBy != createdBy {
+		return nil, false
+	}
+	return s, true
+}
+
+func (u *uploadSessions) remove(id string) {
+	u.mu.Lock()
+	s, ok := u.sessions[id]
+	delete(u.sessions, id)
+	u.mu.Unlock()
+	if ok {
+		s.remove()
+	}
+}
+
+// removeAll removes every session, e.g. when the server shuts down.
+func (u *uploadSessions) removeAll() {
+	u.mu.Lock()
+	sessions := u.sessions
+	u.sessions = make(map[string]*uploadSession)
+	u.mu.Unlock()
+	for _, s := range sessions {
+		s.remove()
+	}
+}
+
+func (u *uploadSessions) pruneLocked(now time.Time) {
+	for id, s := range u.sessions {
+		// A session locked by a request in progress isn't idle.
+		if !s.mu.TryLock() {
+			continue
+		}
+		expired := now.Sub(s.updatedAt) > uploadSessionTTL
+		s.mu.Unlock()
+		if expired {
+			delete(u.sessions, id)
+			s.remove()
+		}
+	}
+}
+
+// handleUploads serves the chunked uploads:
+//
+//	POST   /uploads               starts an upload with the same headers as PUT /, and gives back its status
+//	GET    /uploads/<id>          gives back the status, telling which chunk to resume from
+//	PUT    /uploads/<id>/<n>      uploads the chunk numbered n, starting from 0
+//	POST   /uploads/<id>/commit   adds the body to the history, and gives back the history entry
+//	DELETE /uploads/<id>          aborts the upload
+func (r *serveRunner) handleUploads(w http.ResponseWriter, req *http.Request) {
+	ch := r.channelOf(req)
+	rest := strings.Trim(strings.TrimPrefix(req.URL.Path, uploadsPath), "/")
+	if rest == "" {
+		if req.Method != http.MethodPost {
+			http.Error(w, fmt.Sprintf("Method %s is not allowed", req.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		r.startUpload(w, req, ch)
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	s, ok := ch.uploads.get(id, identityOf(req))
+	if !ok {
+		http.Error(w, "The upload not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case action == "" && req.Method == http.MethodGet:
+		writeUploadJSON(w, http.StatusOK, s.status())
+	case action == "" && req.Method == http.MethodDelete:
+		ch.uploads.remove(id)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "commit" && req.Method == http.MethodPost:
+		r.commitUpload(w, ch, s)
+	case action != "" && action != "commit" && req.Method == http.MethodPut:
+		n, err := strconv.Atoi(action)
+		if err != nil || n < 0 {
+			http.Error(w, "The chunk number is invalid", http.StatusBadRequest)
+			return
+		}
+		r.putChunk(w, req, s, n)
+	default:
+		http.Error(w, fmt.Sprintf("Method %s is not allowed", req.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *serveRunner) startUpload(w http.ResponseWriter, req *http.Request, ch *channel) {
+	meta, err := uploadMetadataOf(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("The upload is invalid: %v", err), http.StatusBadRequest)
+		return
+	}
+	var encoding string
+	switch e := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding"))); e {
+	case "", "identity":
+	case encodingGzip, "x-gzip":
+		encoding = encodingGzip
+	default:
+		http.Error(w, fmt.Sprintf("The content encoding %q is not supported", e), http.StatusUnsupportedMediaType)
+		return
+	}
+	s, err := ch.uploads.start(ch.spoolDir, meta, encoding)
+	if errors.Is(err, errTooManyUploads) {
+		http.Error(w, "Too many uploads are in progress", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to start the upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeUploadJSON(w, http.StatusCreated, s.status())
+}
+
+func (r *serveRunner) putChunk(w http.ResponseWriter, req *http.Request, s *uploadSession, n int) {
+	// The chunk is read in full before being appended, so that a broken request leaves nothing behind.
+	data, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxUploadChunkSize))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, fmt.Sprintf("The chunk exceeds the size limit of %d bytes", maxUploadChunkSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Bad request body", http.StatusBadRequest)
+		return
+	}
+	status, err := s.appendChunk(n, data, r.entrySizeLimit)
+	switch {
+	case errors.Is(err, errUploadTooLarge):
+		r.entryTooLarge(w)
+	case errors.Is(err, errChunkOutOfOrder), errors.Is(err, errUploadClosed):
+		http.Error(w, fmt.Sprintf("The chunk can't be accepted: %v", err), http.StatusConflict)
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Failed to save the chunk: %v", err), http.StatusInternalServerError)
+	default:
+		writeUploadJSON(w, http.StatusOK, status)
+	}
+}
+
+func (r *serveRunner) commitUpload(w http.ResponseWriter, ch *channel, s *uploadSession) {
+	// A failed commit can't be tried again, since the body is gone by then.
+	// The session is removed after it is unlocked.
+	failed := false
+	defer func() {
+		if failed {
+			ch.uploads.remove(s.id)
+		}
+	}()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.updatedAt = time.Now()
+	if s.entry != nil {
+		writeUploadJSON(w, http.StatusOK, s.entry)
+		return
+	}
+	if s.file == nil {
+		http.Error(w, fmt.Sprintf("The upload can't be committed: %v", errUploadClosed), http.StatusConflict)
+		return
+	}
+	upload, err := s.upload(ch.spoolDir, r.entrySizeLimit)
+	if err != nil {
+		failed = true
+		if errors.Is(err, errUploadTooLarge) {
+			r.entryTooLarge(w)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to commit the upload: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer upload.Close()
+	entry, ok := r.addUpload(w, ch, upload)
+	if !ok {
+		failed = true
+		return
+	}
+	s.entry = &entry
+	writeUploadJSON(w, http.StatusOK, entry)
+}
+
+func writeUploadJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, "Failed to encode the upload", http.StatusInternalServerError)
+	}
+}
+
+func uploadsURL(address string) string {
+	return strings.TrimRight(address, "/") + uploadsPath
+}
+
+// errChunkedUploadUnsupported is given back by uploadChunked if the server doesn't support chunked uploads,
+// such as a server older than them, in which case the data can be put in a single request instead.
+var errChunkedUploadUnsupported = errors.New("the server doesn't support chunked uploads")
+
+// permanentError is a failure that retrying doesn't fix, such as a request rejected by the server.
+type permanentError struct {
+	err error
+	// status is the status code of the response rejecting the request, if any.
+	status int
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// uploadChunked puts the data to the server at address in chunks of the given size, with the given headers.
+// When a request fails, it asks the server which chunks it has received, and resumes from there.
+func (r *copyRunner) uploadChunked(client *http.Client, address string, data []byte, header http.Header, chunkSize int64) error {
+	var status uploadStatus
+	err := r.withRetries("start the upload", func() error {
+		return r.uploadRequest(client, http.MethodPost, uploadsURL(address), header, nil, &status)
+	}, nil)
+	// An older server answers 404 or 405 since it has no uploads route.
+	var perm *permanentError
+	if errors.As(err, &perm) && (perm.status == http.StatusNotFound || perm.status == http.StatusMethodNotAllowed) {
+		return errChunkedUploadUnsupported
+	}
+	if err != nil {
+		return err
+	}
+	sessionURL := uploadsURL(address) + "/" + url.PathEscape(status.ID)
+
+	chunks := int((int64(len(data)) + chunkSize - 1) / chunkSize)
+	// Resume from the last chunk acknowledged by the server after a failure.
+	resume := func() {
+		var s uploadStatus
+		if err := r.uploadRequest(client, http.MethodGet, sessionURL, nil, nil, &s); err == nil {
+			status = s
+		}
+	}
+	for err == nil && status.Chunks < chunks {
+		err = r.withRetries(fmt.Sprintf("upload chunk %d", status.Chunks), func() error {
+			if status.Chunks >= chunks {
+				return nil
+			}
+			start := int64(status.Chunks) * chunkSize
+			end := start + chunkSize
+			if end > int64(len(data)) {
+				end = int64(len(data))
+			}
+			chunkURL := sessionURL + "/" + strconv.Itoa(status.Chunks)
+			return r.uploadRequest(client, http.MethodPut, chunkURL, nil, data[start:end], &status)
+		}, resume)
+	}
+	if err == nil {
+		err = r.withRetries("commit the upload", func() error {
+			return r.uploadRequest(client, http.MethodPost, sessionURL+"/commit", nil, nil, nil)
+		}, nil)
+	}
+	if err != nil {
+		// Leave nothing behind on the server.
+		r.uploadRequest(client, http.MethodDelete, sessionURL, nil, nil, nil)
+		return err
+	}
+	return nil
+}
+
+// withRetries calls fn until it succeeds, up to r.retries more times in a row, calling beforeRetry if given before each retry.
+// A permanentError isn't retried.
+func (r *copyRunner) withRetries(what string, fn func() error, beforeRetry func()) error {
+	interval := r.retryInterval
+	if interval == 0 {
+		interval = uploadRetryInterval
+	}
+	for failures := 0; ; failures++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		var perm *permanentError
+		if errors.As(err, &perm) || failures >= r.retries {
+			return fmt.Errorf("failed to %s: %w", what, err)
+		}
+		fmt.Fprintf(r.stderr, "Failed to %s, retrying in %s: %v\n", what, interval, err)
+		time.Sleep(interval)
+		if interval *= 2; interval > maxUploadRetryInterval {
+			interval = maxUploadRetryInterval
+		}
+		if beforeRetry != nil {
+			beforeRetry()
+		}
+	}
+}
+
+// uploadRequest issues a request of the chunked upload protocol, and decodes the JSON response into v if given.
+func (r *copyRunner) uploadRequest(client *http.Client, method, url string, header http.Header, body []byte, v interface{}) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return &permanentError{err: fmt.Errorf("failed to make request: %w", err)}
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	addBasicAuthHeader(req, r.basicAuth)
+	addTokenHeader(req, r.token)
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to issue request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		err := failedRequestError(res)
+		switch res.StatusCode {
+		case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+			return err
+		}
+		if res.StatusCode < http.StatusInternalServerError {
+			return &permanentError{err: err, status: res.StatusCode}
+		}
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode the response: %w", err)
+	}
+	return nil
+}
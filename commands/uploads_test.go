@@ -0,0 +1,170 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nakabonne/pbgopy/cache/memorycache"
+)
+
+func TestChunkedUploadProtocol(t *testing.T) {
+	r := &serveRunner{cache: memorycache.NewCache(), historyLimit: 10, entrySizeLimit: 10}
+	handler := r.newServer().Handler
+	do := func(method, path, body string, want int, v interface{}) {
+		t.Helper()
+		rr := serveHistoryRequest(t, handler, method, path, []byte(body))
+		if rr.Code != want {
+			t.Fatalf("%s %s: got %d want %d body %q", method, path, rr.Code, want, rr.Body.String())
+		}
+		if v != nil {
+			if err := json.Unmarshal(rr.Body.Bytes(), v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var status uploadStatus
+	do(http.MethodPost, uploadsPath, "", http.StatusCreated, &status)
+	session := uploadsPath + "/" + status.ID
+	do(http.MethodPut, session+"/0", "hello ", http.StatusOK, &status)
+	// A chunk sent again is ignored, and one ahead of the next is refused.
+	do(http.MethodPut, session+"/0", "hello ", http.StatusOK, &status)
+	do(http.MethodPut, session+"/2", "!", http.StatusConflict, nil)
+	do(http.MethodGet, session, "", http.StatusOK, &status)
+	if status.Chunks != 1 || status.Size != 6 {
+		t.Fatalf("status: %+v", status)
+	}
+	do(http.MethodPut, session+"/1", "chunk", http.StatusRequestEntityTooLarge, nil)
+	do(http.MethodPut, session+"/1", "you", http.StatusOK, &status)
+	if entries := getHistory(t, handler); len(entries) != 0 {
+		t.Fatalf("history before commit: %+v", entries)
+	}
+
+	var entry, again HistoryEntry
+	do(http.MethodPost, session+"/commit", "", http.StatusOK, &entry)
+	do(http.MethodPost, session+"/commit", "", http.StatusOK, &again)
+	if entry.ID != again.ID || entry.Preview != "hello you" || !strings.HasPrefix(entry.SHA256, shaPrefix([]byte("hello you"))) {
+		t.Fatalf("committed entries: %+v, %+v", entry, again)
+	}
+	if entries := getHistory(t, handler); len(entries) != 1 {
+		t.Fatalf("history after commit: %+v", entries)
+	}
+	do(http.MethodPut, session+"/2", "!", http.StatusConflict, nil)
+
+	do(http.MethodPost, uploadsPath, "", http.StatusCreated, &status)
+	do(http.MethodDelete, uploadsPath+"/"+status.ID, "", http.StatusNoContent, nil)
+	do(http.MethodGet, uploadsPath+"/"+status.ID, "", http.StatusNotFound, nil)
+}
+
+func TestCopyResumesChunkedUpload(t *testing.T) {
+	r := &serveRunner{cache: memorycache.NewCache(), historyLimit: 10}
+	handler := r.newServer().Handler
+	t.Setenv(pbgopyServerEnv, "http://pbgopy.test/")
+
+	// Every third request is lost, either before or after reaching the server.
+	var mu sync.Mutex
+	var n int
+	client := &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			n++
+			fail := n%3 == 0
+			mu.Unlock()
+			if fail && n%2 == 0 {
+				return nil, errors.New("connection reset")
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if fail {
+				return nil, errors.New("connection reset")
+			}
+			return rr.Result(), nil
+		}),
+	}
+
+	random := make([]byte, 10<<10)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	var text []byte
+	for i := 0; i < 20000; i++ {
+		text = append(text, fmt.Sprintf("line %d\n", i)...)
+	}
+	for _, data := range [][]byte{random, text} {
+		for _, password := range []string{"", "secret"} {
+			stderr := &syncBuffer{}
+			c := &copyRunner{
+				password:      password,
+				compress:      true,
+				chunkSize:     "1kb",
+				retries:       3,
+				retryInterval: time.Millisecond,
+				stderr:        stderr,
+			}
+			if err := c.upload(client, "http://pbgopy.test/", data); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(stderr.String(), "retrying") {
+				t.Fatalf("no request has failed: %q", stderr.String())
+			}
+
+			var stdout bytes.Buffer
+			p := &pasteRunner{password: password, maxBufSize: "500mb", stdout: &stdout, client: newHandlerClient(handler)}
+			if err := p.run(nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(stdout.Bytes(), data) {
+				t.Fatalf("pasted %d bytes want %d", stdout.Len(), len(data))
+			}
+		}
+	}
+	if entries := getHistory(t, handler); len(entries) != 4 {
+		t.Fatalf("history: got %d entries want 4", len(entries))
+	}
+}
+
+func TestCopyChunkedUploadTooLarge(t *testing.T) {
+	r := &serveRunner{cache: memorycache.NewCache(), historyLimit: 10, entrySizeLimit: 2048}
+	handler := r.newServer().Handler
+	c := &copyRunner{chunkSize: "1kb", retries: 3, retryInterval: time.Millisecond, stderr: &syncBuffer{}}
+	err := c.upload(newHandlerClient(handler), "http://pbgopy.test/", bytes.Repeat([]byte{0}, 4096))
+	if err == nil || !strings.Contains(err.Error(), "413") {
+		t.Fatalf("got %v", err)
+	}
+	// The failed upload is aborted rather than left behind.
+	ch, _ := r.channels.get("", false)
+	if len(ch.uploads.sessions) != 0 {
+		t.Fatalf("sessions left: %d", len(ch.uploads.sessions))
+	}
+}
+
+func TestCopyWithoutChunkedUploads(t *testing.T) {
+	handler := newHistoryTestHandler(10, 0)
+	data := bytes.Repeat([]byte("data"), 1024)
+	for _, status := range []int{http.StatusNotFound, http.StatusMethodNotAllowed} {
+		// A server older than chunked uploads has no route for them.
+		old := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if strings.HasPrefix(req.URL.Path, uploadsPath) {
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
+			handler.ServeHTTP(w, req)
+		})
+		c := &copyRunner{chunkSize: "1kb", retries: 3, retryInterval: time.Millisecond, stderr: &syncBuffer{}}
+		if err := c.upload(newHandlerClient(old), "http://pbgopy.test/", data); err != nil {
+			t.Fatalf("%d: %v", status, err)
+		}
+		if rr := serveHistoryRequest(t, handler, http.MethodGet, "/", nil); !bytes.Equal(rr.Body.Bytes(), data) {
+			t.Fatalf("%d: pasted %d bytes want %d", status, rr.Body.Len(), len(data))
+		}
+	}
+}
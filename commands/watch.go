@@ -0,0 +1,281 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	watchPath = "/watch"
+
+	// historyIDHeader carries the ID of the history entry in a response.
+	historyIDHeader = "X-Pbgopy-Id"
+	// historyCreatedAtHeader carries when the history entry in a response was created, in nanoseconds since the Unix epoch.
+	historyCreatedAtHeader = "X-Pbgopy-Created-At"
+
+	// defaultWatchTimeout is how long a watch request waits for a new entry unless specified.
+	defaultWatchTimeout = 30 * time.Second
+	maxWatchTimeout     = 5 * time.Minute
+	// watchPollInterval is how often a waiting watch request checks the history,
+	// to notice entries added through other servers sharing it.
+	watchPollInterval = time.Second
+)
+
+// watch gives back a channel that is closed when the next entry is added to the channel.
+func (c *channel) watch() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.updated == nil {
+		c.updated = make(chan struct{})
+	}
+	return c.updated
+}
+
+// notify wakes up the requests waiting for a new entry.
+func (c *channel) notify() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.updated != nil {
+		close(c.updated)
+		c.updated = nil
+	}
+}
+
+// handleWatch waits until an entry newer than the given one arrives, and responds with its body.
+// The entry to wait after is given by its ID with the after parameter, or by a timestamp in
+// nanoseconds like the one from /lastupdated or X-Pbgopy-Created-At with the since parameter. Without either,
+// it waits for an entry newer than the latest one at the time of the request. If the after entry is gone,
+// such as by being deleted or read up, only entries created after since, or after the after entry if it is
+// still there at the time of the request, are given, so that no entry older than it is sent again.
+// Entries with a read limit are skipped.
+// 204 No Content is returned if no entry arrives within the timeout parameter.
+func (r *serveRunner) handleWatch(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("Method %s is not allowed", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	ch := r.channelOf(req)
+	query := req.URL.Query()
+	timeout := defaultWatchTimeout
+	if s := query.Get("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			http.Error(w, "The timeout is invalid", http.StatusBadRequest)
+			return
+		}
+		if d < maxWatchTimeout {
+			timeout = d
+		} else {
+			timeout = maxWatchTimeout
+		}
+	}
+	var since time.Time
+	if s := query.Get("since"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, "The since timestamp is invalid", http.StatusBadRequest)
+			return
+		}
+		since = time.Unix(0, n)
+	}
+	after := query.Get("after")
+	if since.IsZero() {
+		// Resolve the time to wait after, in case the after entry is gone while waiting.
+		entries, err := ch.history.List()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list history: %v", err), http.StatusInternalServerError)
+			return
+		}
+		since = watchCursor(entries, after)
+		if after == "" && len(entries) > 0 {
+			after = entries[0].ID
+		}
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	for {
+		// Start watching before looking into the history, so as not to miss an entry added in between.
+		updated := ch.watch()
+		entries, err := ch.history.List()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list history: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if next, ok := nextHistoryEntry(entries, after, since); ok {
+			// Entries with a read limit are left for their recipients to fetch, so that watchers such as
+			// the sender's own sync don't read them up. The watch goes on with the entries after them.
+			if next.ReadsLeft != nil {
+				after, since = next.ID, next.CreatedAt
+				continue
+			}
+			entry, body, err := ch.history.Get(next.ID)
+			if err == nil {
+				writeHistoryBody(w, req, entry, body)
+				return
+			}
+			// The entry can be gone in the meantime, in which case we look for another one.
+			if !errors.Is(err, ErrHistoryNotFound) {
+				http.Error(w, fmt.Sprintf("Failed to get data from history: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		select {
+		case <-updated:
+		case <-ticker.C:
+		case <-deadline.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// watchCursor gives back when the entry with the after ID was created, or the latest entry if after is empty or gone.
+// It gives back the zero time if the history is empty.
+func watchCursor(entries []HistoryEntry, after string) time.Time {
+	for _, entry := range entries {
+		if entry.ID == after {
+			return entry.CreatedAt
+		}
+	}
+	if len(entries) > 0 {
+		return entries[0].CreatedAt
+	}
+	return time.Time{}
+}
+
+// nextHistoryEntry gives back the oldest entry newer than the entry with the after ID,
+// or than since if after is empty or no longer in the history. The entries must be sorted from newest to oldest.
+func nextHistoryEntry(entries []HistoryEntry, after string, since time.Time) (HistoryEntry, bool) {
+	if len(entries) == 0 {
+		return HistoryEntry{}, false
+	}
+	for i, entry := range entries {
+		if after != "" && entry.ID == after {
+			if i == 0 {
+				return HistoryEntry{}, false
+			}
+			return entries[i-1], true
+		}
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].CreatedAt.After(since) {
+			return entries[i], true
+		}
+	}
+	return HistoryEntry{}, false
+}
+
+func watchURL(address, after string, since time.Time, timeout time.Duration) string {
+	query := url.Values{}
+	query.Set("timeout", timeout.String())
+	if after != "" {
+		query.Set("after", after)
+	}
+	if !since.IsZero() {
+		query.Set("since", strconv.FormatInt(since.UnixNano(), 10))
+	}
+	return strings.TrimRight(address, "/") + watchPath + "?" + query.Encode()
+}
+
+// runWatch prints each new entry as it arrives, until ctx is done.
+// Entries are separated by a newline, which is added unless an entry ends with one.
+// Or each entry is written to the clipboard if it is text.
+func (r *pasteRunner) runWatch(ctx context.Context, client *http.Client, address string) error {
+	return r.watchEntries(ctx, client, address, func(data []byte, mimeType string) error {
+		if r.toClipboard {
+			err := r.writeClipboard(data, mimeType)
+			if errors.Is(err, errNotText) {
+				fmt.Fprintf(r.stderr, "Skipped an entry: %v\n", err)
+				return nil
+			}
+			return err
+		}
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			data = append(data, '\n')
+		}
+		if _, err := r.stdout.Write(data); err != nil {
+			return fmt.Errorf("failed to write to stdout: %w", err)
+		}
+		return nil
+	})
+}
+
+// watchEntries calls fn with the decrypted body of each entry added from now on, along with its MIME type if known, until ctx is done.
+func (r *pasteRunner) watchEntries(ctx context.Context, client *http.Client, address string, fn func(data []byte, mimeType string) error) error {
+	sizeInBytes, err := datasizeToBytes(r.maxBufSize)
+	if err != nil {
+		return fmt.Errorf("failed to parse data size: %w", err)
+	}
+	var (
+		after string
+		since time.Time
+	)
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, watchURL(address, after, since, defaultWatchTimeout), nil)
+		if err != nil {
+			return fmt.Errorf("failed to make request: %w", err)
+		}
+		addBasicAuthHeader(req, r.basicAuth)
+		addTokenHeader(req, r.token)
+		res, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to issue get request: %w", err)
+		}
+		switch res.StatusCode {
+		case http.StatusNoContent:
+			res.Body.Close()
+			continue
+		case http.StatusNotFound:
+			// The channel doesn't exist until something is copied to it, and then whatever is in it is new.
+			res.Body.Close()
+			if since.IsZero() {
+				since = time.Unix(0, 1)
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(watchPollInterval):
+			}
+			continue
+		case http.StatusOK:
+		default:
+			defer res.Body.Close()
+			return failedRequestError(res)
+		}
+		after = res.Header.Get(historyIDHeader)
+		if n, err := strconv.ParseInt(res.Header.Get(historyCreatedAtHeader), 10, 64); err == nil {
+			since = time.Unix(0, n)
+		}
+		data, err := readNoMoreThan(res.Body, sizeInBytes)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read the response body: %w", err)
+		}
+		data, err = r.decrypt(data)
+		if err != nil {
+			return err
+		}
+		data, err = decodePayload(data, res.Header.Get(historyContentEncodingHeader), sizeInBytes)
+		if err != nil {
+			return err
+		}
+		if err := fn(data, res.Header.Get(historyContentTypeHeader)); err != nil {
+			return err
+		}
+	}
+}
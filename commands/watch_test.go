@@ -0,0 +1,220 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nakabonne/pbgopy/cache/memorycache"
+)
+
+func TestNextHistoryEntry(t *testing.T) {
+	now := time.Now()
+	entries := []HistoryEntry{
+		{ID: "c", CreatedAt: now},
+		{ID: "b", CreatedAt: now.Add(-time.Minute)},
+		{ID: "a", CreatedAt: now.Add(-2 * time.Minute)},
+	}
+	tests := []struct {
+		name   string
+		after  string
+		since  time.Time
+		want   string
+		wantOK bool
+	}{
+		{name: "after the oldest", after: "a", want: "b", wantOK: true},
+		{name: "after the latest", after: "c", wantOK: false},
+		{name: "after an evicted entry", after: "gone", since: now.Add(-90 * time.Second), want: "b", wantOK: true},
+		{name: "after an evicted entry newer than the rest", after: "gone", since: now, wantOK: false},
+		{name: "since", since: now.Add(-90 * time.Second), want: "b", wantOK: true},
+		{name: "since the latest", since: now, wantOK: false},
+	}
+	for _, tt := range tests {
+		got, ok := nextHistoryEntry(entries, tt.after, tt.since)
+		if ok != tt.wantOK || got.ID != tt.want {
+			t.Fatalf("%s: got %q, %v want %q, %v", tt.name, got.ID, ok, tt.want, tt.wantOK)
+		}
+	}
+	if _, ok := nextHistoryEntry(nil, "", time.Time{}); ok {
+		t.Fatal("got an entry from an empty history")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	r := &serveRunner{cache: memorycache.NewCache(), historyLimit: 10}
+	handler := r.newServer().Handler
+	putClipboard(t, handler, []byte("first"), false)
+	first := getHistory(t, handler)[0]
+
+	if rr := serveHistoryRequest(t, handler, http.MethodGet, watchPath+"?timeout=10ms", nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("watch without a new entry: got %d want %d", rr.Code, http.StatusNoContent)
+	}
+	if rr := serveHistoryRequest(t, handler, http.MethodGet, watchPath+"?since=0", nil); rr.Code != http.StatusOK || rr.Body.String() != "first" || rr.Header().Get(historyIDHeader) != first.ID {
+		t.Fatalf("watch since 0: status %d body %q", rr.Code, rr.Body.String())
+	}
+	if rr := serveHistoryRequest(t, handler, http.MethodGet, watchPath+"?timeout=forever", nil); rr.Code != http.StatusBadRequest {
+		t.Fatalf("watch with an invalid timeout: got %d want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, watchPath+"?timeout=10s&after="+first.ID, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		done <- rr
+	}()
+	waitWatching(t, r, "")
+	putClipboard(t, handler, []byte("second"), false)
+	rr := <-done
+	if rr.Code != http.StatusOK || rr.Body.String() != "second" {
+		t.Fatalf("watch after the first entry: status %d body %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestWatchAfterDeletedEntry(t *testing.T) {
+	r := &serveRunner{cache: memorycache.NewCache(), historyLimit: 10}
+	handler := r.newServer().Handler
+	putClipboard(t, handler, []byte("old"), false)
+	putClipboard(t, handler, []byte("deleted"), false)
+	deleted := getHistory(t, handler)[0]
+	if rr := serveHistoryRequest(t, handler, http.MethodDelete, historyPath+"/"+deleted.ID, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("delete: got %d", rr.Code)
+	}
+
+	// The entry older than the deleted one isn't sent again, whether or not the client gives when the deleted one was created.
+	since := strconv.FormatInt(deleted.CreatedAt.UnixNano(), 10)
+	for _, query := range []string{"after=" + deleted.ID, "after=" + deleted.ID + "&since=" + since} {
+		if rr := serveHistoryRequest(t, handler, http.MethodGet, watchPath+"?timeout=10ms&"+query, nil); rr.Code != http.StatusNoContent {
+			t.Fatalf("watch %s: got %d %q", query, rr.Code, rr.Body.String())
+		}
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, watchPath+"?timeout=10s&after="+deleted.ID+"&since="+since, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		done <- rr
+	}()
+	waitWatching(t, r, "")
+	putClipboard(t, handler, []byte("new"), false)
+	if rr := <-done; rr.Code != http.StatusOK || rr.Body.String() != "new" || rr.Header().Get(historyCreatedAtHeader) == "" {
+		t.Fatalf("watch after the deleted entry: status %d body %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestWatchSkipsEntriesWithReadLimit(t *testing.T) {
+	r := &serveRunner{cache: memorycache.NewCache(), historyLimit: 10}
+	handler := r.newServer().Handler
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	stdout := &syncBuffer{}
+	p := &pasteRunner{maxBufSize: "500mb", stdout: stdout, client: server.Client()}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- p.runWatch(ctx, p.client, server.URL)
+	}()
+
+	waitWatching(t, r, "")
+	c := &copyRunner{maxReads: 1}
+	if err := c.upload(server.Client(), server.URL, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	putClipboard(t, handler, []byte("plain"), false)
+	waitOutput(t, stdout, "plain\n")
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	// The watcher hasn't read up the entry with a read limit.
+	secret := getHistory(t, handler)[1]
+	if secret.ReadsLeft == nil || *secret.ReadsLeft != 1 {
+		t.Fatalf("entry with a read limit after watching: %+v", secret)
+	}
+	if rr := serveHistoryRequest(t, handler, http.MethodGet, historyPath+"/"+secret.ID, nil); rr.Code != http.StatusOK || rr.Body.String() != "secret" {
+		t.Fatalf("GET of the entry with a read limit: status %d body %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestPasteWatch(t *testing.T) {
+	r := &serveRunner{cache: memorycache.NewCache(), historyLimit: 10}
+	handler := r.newServer().Handler
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	putClipboard(t, handler, []byte("old"), false)
+
+	stdout := &syncBuffer{}
+	p := &pasteRunner{maxBufSize: "500mb", stdout: stdout, client: server.Client()}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- p.runWatch(ctx, p.client, server.URL)
+	}()
+
+	waitWatching(t, r, "")
+	putClipboard(t, handler, []byte("one"), false)
+	waitOutput(t, stdout, "one\n")
+	waitWatching(t, r, "")
+	putClipboard(t, handler, []byte("two\n"), false)
+	putClipboard(t, handler, []byte("three"), false)
+	waitOutput(t, stdout, "one\ntwo\nthree\n")
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+}
+
+// waitWatching waits until a watch request is waiting on the channel.
+func waitWatching(t *testing.T, r *serveRunner, name string) {
+	t.Helper()
+	ch, err := r.channels.get(name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		ch.mu.Lock()
+		watching := ch.updated != nil
+		ch.mu.Unlock()
+		if watching {
+			return
+		}
+	}
+	t.Fatal("no watch request arrived")
+}
+
+func waitOutput(t *testing.T, b *syncBuffer, want string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if b.String() == want {
+			return
+		}
+	}
+	t.Fatalf("output: got %q want %q", b.String(), want)
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
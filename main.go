@@ -40,6 +40,7 @@ func main() {
 		commands.NewCopyCommand(a.stdout, a.stderr),
 		commands.NewPasteCommand(a.stdout, a.stderr),
 		commands.NewHistoryCommand(a.stdout, a.stderr),
+		commands.NewSyncCommand(a.stdout, a.stderr),
 		commands.NewServeCommand(a.stdout, a.stderr),
 		commands.NewVersionCommand(a.stderr),
 	)